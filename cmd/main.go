@@ -6,17 +6,29 @@ import (
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	graceful "github.com/leaq-ru/lib-graceful"
+	"github.com/vahter-robot/backend/pkg/broadcast"
 	"github.com/vahter-robot/backend/pkg/child_bot"
 	"github.com/vahter-robot/backend/pkg/child_state"
 	"github.com/vahter-robot/backend/pkg/config"
+	"github.com/vahter-robot/backend/pkg/invite"
+	"github.com/vahter-robot/backend/pkg/leader"
 	"github.com/vahter-robot/backend/pkg/logger"
 	"github.com/vahter-robot/backend/pkg/mongo"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
 	"github.com/vahter-robot/backend/pkg/parent_bot"
 	"github.com/vahter-robot/backend/pkg/parent_state"
 	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/purge"
 	"github.com/vahter-robot/backend/pkg/reply"
+	"github.com/vahter-robot/backend/pkg/scheduled"
+	"github.com/vahter-robot/backend/pkg/transfer"
 	"github.com/vahter-robot/backend/pkg/user"
+	"github.com/vahter-robot/backend/pkg/version"
 	"golang.org/x/sync/errgroup"
+	"time"
+	// the runtime image has no zoneinfo
+	_ "time/tzdata"
 )
 
 func main() {
@@ -72,8 +84,69 @@ func main() {
 		panic(err)
 	}
 
+	operatorRepo, err := operator.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	inviteRepo, err := invite.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	transferRepo, err := transfer.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	msglogRepo, err := msglog.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	versionRepo, err := version.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	broadcastRepo, err := broadcast.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	scheduledRepo, err := scheduled.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	leaderRepo, err := leader.NewRepo(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+
+	purgeService := purge.NewService(
+		logg,
+		db.Client(),
+		userRepo,
+		parentStateRepo,
+		childBotRepo,
+		peerRepo,
+		replyRepo,
+		childStateRepo,
+		operatorRepo,
+		msglogRepo,
+		versionRepo,
+		inviteRepo,
+		transferRepo,
+		broadcastRepo,
+		scheduledRepo,
+		leaderRepo,
+		cfg.ChildBot.DeletedKeepDays,
+	)
+
 	parentBotService, err := parent_bot.NewService(
 		logg,
+		db.Client(),
 		cfg.ParentBot.Host,
 		cfg.ParentBot.Port,
 		cfg.ParentBot.TokenPathPrefix,
@@ -82,18 +155,28 @@ func main() {
 		userRepo,
 		peerRepo,
 		childBotRepo,
-		replyRepo,
 		childStateRepo,
+		transferRepo,
+		operatorRepo,
+		msglogRepo,
+		purgeService,
 		cfg.ChildBot.Host,
 		cfg.ChildBot.TokenPathPrefix,
 		cfg.ChildBot.BotsLimitPerUser,
+		cfg.ChildBot.DeletedKeepDays,
 	)
 	if err != nil {
 		panic(err)
 	}
 
+	location, err := time.LoadLocation(cfg.ChildBot.TimeZone)
+	if err != nil {
+		panic(err)
+	}
+
 	childBotService := child_bot.NewService(
 		logg,
+		db.Client(),
 		cfg.ChildBot.Host,
 		cfg.ChildBot.Port,
 		cfg.ChildBot.TokenPathPrefix,
@@ -102,11 +185,22 @@ func main() {
 		peerRepo,
 		childBotRepo,
 		replyRepo,
+		operatorRepo,
+		inviteRepo,
+		msglogRepo,
+		versionRepo,
+		broadcastRepo,
+		scheduledRepo,
+		leaderRepo,
 		cfg.ChildBot.KeywordsLimitPerBot,
 		cfg.ChildBot.InLimitPerKeyword,
 		cfg.ChildBot.InLimitChars,
 		cfg.ChildBot.OutLimitChars,
-		parentBot.Self.UserName,
+		cfg.Retention.RepliesDays,
+		cfg.Retention.PeersDays,
+		cfg.Retention.MessagesDays,
+		location,
+		parentBot,
 		cfg.SetWebhooksOnStart,
 		cfg.ChildBot.TimeoutOnHandle,
 	)
@@ -117,6 +211,10 @@ func main() {
 		parentBotService.Serve(egc)
 		return nil
 	})
+	eg.Go(func() error {
+		purgeService.Serve(egc)
+		return nil
+	})
 	eg.Go(func() error {
 		e := childBotService.Serve(egc)
 		if e != nil {
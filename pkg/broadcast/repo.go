@@ -0,0 +1,373 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Status uint8
+
+const (
+	Draft     Status = 1
+	Running   Status = 2
+	Done      Status = 3
+	Cancelled Status = 4
+)
+
+// Target is a peer chat the broadcast is sent to. Targets are fixed when the broadcast starts: on confirmation, or
+// at the start time for a scheduled broadcast
+type Target struct {
+	TgUserID int64 `bson:"u,omitempty"`
+	TgChatID int64 `bson:"c,omitempty"`
+}
+
+// Broadcast is a message of the owner or an admin to peers of the bot. UserID is the bot owner, ChatID is the
+// chat of the author, the report is sent there. Next is the index of the first target not sent yet,
+// so a job interrupted by a restart resumes from it once the lease is over
+type Broadcast struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	UserID     primitive.ObjectID `bson:"ui,omitempty"`
+	ChatID     int64              `bson:"ci,omitempty"`
+	Text       string             `bson:"t,omitempty"`
+	Source     string             `bson:"src,omitempty"`
+	Tag        string             `bson:"tag,omitempty"`
+	ActiveDays uint16             `bson:"ad,omitempty"`
+	StartAt    time.Time          `bson:"sa,omitempty"`
+	Status     Status             `bson:"s,omitempty"`
+	Targets    []Target           `bson:"tg,omitempty"`
+	Next       int                `bson:"n,omitempty"`
+	Sent       int                `bson:"sn,omitempty"`
+	Failed     int                `bson:"fl,omitempty"`
+	Blocked    int                `bson:"bl,omitempty"`
+	LeaseUntil time.Time          `bson:"lu,omitempty"`
+	CreatedAt  time.Time          `bson:"ca,omitempty"`
+	ExpireAt   time.Time          `bson:"ea,omitempty"`
+}
+
+const (
+	draftTTL    = 24 * time.Hour
+	finishedTTL = 30 * 24 * time.Hour
+)
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("broadcasts"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "s",
+			Value: 1,
+		}},
+	}, {
+		Keys: bson.D{{
+			Key:   "s",
+			Value: 1,
+		}, {
+			Key:   "lu",
+			Value: 1,
+		}},
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+// CreateDraft replaces a previous draft made in the same chat
+func (r *Repo) CreateDraft(c context.Context, b Broadcast) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteMany(ctx, bson.M{
+		"cbi": b.ChildBotID,
+		"ci":  b.ChatID,
+		"s":   Draft,
+	})
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	now := time.Now().UTC()
+	b.Status = Draft
+	b.CreatedAt = now
+	b.ExpireAt = now.Add(draftTTL)
+	res, err := r.coll.InsertOne(ctx, b)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("r.coll.InsertOne: %w", err)
+	}
+
+	id, _ := res.InsertedID.(primitive.ObjectID)
+	return id, nil
+}
+
+func (r *Repo) GetByID(c context.Context, childBotID, id primitive.ObjectID) (Broadcast, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var b Broadcast
+	err := r.coll.FindOne(ctx, bson.M{
+		"_id": id,
+		"cbi": childBotID,
+	}, options.FindOne().SetProjection(bson.M{
+		"tg": 0,
+	})).Decode(&b)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Broadcast{}, false, nil
+		}
+
+		return Broadcast{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return b, true, nil
+}
+
+// GetRunning returns the running broadcast of the bot without targets
+func (r *Repo) GetRunning(c context.Context, childBotID primitive.ObjectID) (Broadcast, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var b Broadcast
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+		"s":   Running,
+	}, options.FindOne().SetProjection(bson.M{
+		"tg": 0,
+	})).Decode(&b)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Broadcast{}, false, nil
+		}
+
+		return Broadcast{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return b, true, nil
+}
+
+// Start turns the draft into a running job. Targets of a scheduled job are nil, they are set by the worker at
+// the start time. It returns false if the draft is gone or already started
+func (r *Repo) Start(c context.Context, id primitive.ObjectID, targets []Target) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"s":   Draft,
+	}, bson.M{
+		"$set": bson.M{
+			"s":  Running,
+			"tg": targets,
+		},
+		"$unset": bson.M{
+			"ea": "",
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.ModifiedCount != 0, nil
+}
+
+// Acquire takes a running job whose start time has come and whose lease is over, the oldest first
+func (r *Repo) Acquire(c context.Context, lease time.Duration) (Broadcast, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+
+	var b Broadcast
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{
+		"s": Running,
+		"$and": bson.A{bson.M{
+			"$or": bson.A{bson.M{
+				"lu": bson.M{
+					"$exists": false,
+				},
+			}, bson.M{
+				"lu": bson.M{
+					"$lt": now,
+				},
+			}},
+		}, bson.M{
+			"$or": bson.A{bson.M{
+				"sa": bson.M{
+					"$exists": false,
+				},
+			}, bson.M{
+				"sa": bson.M{
+					"$lte": now,
+				},
+			}},
+		}},
+	}, bson.M{
+		"$set": bson.M{
+			"lu": now.Add(lease),
+		},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.M{"ca": 1}).
+		SetReturnDocument(options.After),
+	).Decode(&b)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Broadcast{}, false, nil
+		}
+
+		return Broadcast{}, false, fmt.Errorf("r.coll.FindOneAndUpdate: %w", err)
+	}
+
+	return b, true, nil
+}
+
+// Progress stores counters and prolongs the lease. It returns false if the job was cancelled meanwhile
+func (r *Repo) Progress(c context.Context, b Broadcast, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": b.ID,
+		"s":   Running,
+	}, bson.M{
+		"$set": bson.M{
+			"n":  b.Next,
+			"sn": b.Sent,
+			"fl": b.Failed,
+			"bl": b.Blocked,
+			"lu": time.Now().UTC().Add(lease),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.MatchedCount != 0, nil
+}
+
+// SetTargets fixes targets of a scheduled job when it starts. It returns false if the job was cancelled meanwhile
+func (r *Repo) SetTargets(c context.Context, id primitive.ObjectID, targets []Target) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"s":   Running,
+	}, bson.M{
+		"$set": bson.M{
+			"tg": targets,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.MatchedCount != 0, nil
+}
+
+// Finish stores final counters and drops targets. A finished job is kept for a while for the report
+func (r *Repo) Finish(c context.Context, b Broadcast, status Status) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": b.ID,
+	}, bson.M{
+		"$set": bson.M{
+			"s":  status,
+			"n":  b.Next,
+			"sn": b.Sent,
+			"fl": b.Failed,
+			"bl": b.Blocked,
+			"ea": time.Now().UTC().Add(finishedTTL),
+		},
+		"$unset": bson.M{
+			"tg": "",
+			"lu": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// Cancel stops the running job of the bot, the worker notices it on the next progress update
+func (r *Repo) Cancel(c context.Context, childBotID, id primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"cbi": childBotID,
+		"s": bson.M{
+			"$in": bson.A{Draft, Running},
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"s":  Cancelled,
+			"ea": time.Now().UTC().Add(finishedTTL),
+		},
+		"$unset": bson.M{
+			"tg": "",
+			"lu": "",
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.ModifiedCount != 0, nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,520 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/broadcast"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	broadcastCallbackTag = "b"
+	broadcastGo          = "go"
+	broadcastNo          = "no"
+	broadcastStop        = "stop"
+	broadcastSource      = "источник:"
+	broadcastTag         = "тег:"
+	broadcastActive      = "активность:"
+	broadcastWhen        = "когда:"
+
+	// broadcastRate keeps sending under the Telegram limit of 30 messages per second
+	broadcastRate      = 50 * time.Millisecond
+	broadcastLease     = time.Minute
+	broadcastPoll      = 10 * time.Second
+	broadcastSaveEvery = 20
+	broadcastRetries   = 3
+)
+
+// errBroadcastStopped is returned by sendBroadcast when the job was stopped while waiting to retry
+var errBroadcastStopped = errors.New("broadcast stopped")
+
+var broadcastHelp = fmt.Sprintf(`Рассылка — сообщение всем, кто писал боту. Не получат рассылку забаненные и остановившие бота.
+
+Напишите текст рассылки. Чтобы отправить не всем, начните с фильтров, каждый в своей строке:
+%s метка — только пришедшим по ссылке с меткой, см. %s
+%s клиент — только собеседникам с тегом, см. %s
+%s 30 — только писавшим за последние 30 дней
+%s 25.12 9:00 — отправить позже, в указанное время
+
+Перед отправкой бот покажет, как выглядит рассылка и сколько собеседников ее получат`,
+	broadcastSource, startLinks, broadcastTag, peersCmd, broadcastActive, broadcastWhen)
+
+// parseBroadcast parses leading filter lines and the text, the start time is parsed in the location of now.
+// The error is ready to be shown to the user
+func parseBroadcast(in string, now time.Time) (broadcast.Broadcast, error) {
+	var b broadcast.Broadcast
+	lines := strings.Split(strings.TrimSpace(in), "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		low := strings.ToLower(line)
+		switch {
+		case strings.HasPrefix(low, broadcastSource):
+			b.Source = strings.TrimSpace(line[len(broadcastSource):])
+			if !validPayload(b.Source) {
+				return broadcast.Broadcast{}, fmt.Errorf("метка '%s' некорректна", b.Source)
+			}
+		case strings.HasPrefix(low, broadcastTag):
+			b.Tag = strings.ToLower(strings.TrimSpace(line[len(broadcastTag):]))
+			if !validLabel(b.Tag) {
+				return broadcast.Broadcast{}, fmt.Errorf("тег '%s' некорректен", b.Tag)
+			}
+		case strings.HasPrefix(low, broadcastActive):
+			days, err := strconv.ParseUint(strings.TrimSpace(line[len(broadcastActive):]), 10, 16)
+			if err != nil || days == 0 || days > retentionMaxDays {
+				return broadcast.Broadcast{}, fmt.Errorf("активность — число дней от 1 до %d", retentionMaxDays)
+			}
+			b.ActiveDays = uint16(days)
+		case strings.HasPrefix(low, broadcastWhen):
+			at, rest, err := parseWhen(line[len(broadcastWhen):], now)
+			if err != nil {
+				return broadcast.Broadcast{}, err
+			}
+			if rest != "" {
+				return broadcast.Broadcast{}, fmt.Errorf("лишний текст '%s' после времени", rest)
+			}
+			b.StartAt = at.UTC()
+		default:
+			b.Text = strings.TrimSpace(strings.Join(lines[i:], "\n"))
+			i = len(lines)
+		}
+	}
+
+	if b.Text == "" {
+		return broadcast.Broadcast{}, errors.New("нет текста рассылки")
+	}
+	if utf16Len(b.Text) > messageLimit {
+		return broadcast.Broadcast{}, fmt.Errorf("текст длиннее %d символов", messageLimit)
+	}
+	return b, nil
+}
+
+func tplBroadcastFilter(b broadcast.Broadcast) string {
+	var res []string
+	if b.Source != "" {
+		res = append(res, "метка "+b.Source)
+	}
+	if b.Tag != "" {
+		res = append(res, "тег "+b.Tag)
+	}
+	if b.ActiveDays != 0 {
+		res = append(res, fmt.Sprintf("писали за %d дн.", b.ActiveDays))
+	}
+	if len(res) == 0 {
+		return "все собеседники"
+	}
+	return strings.Join(res, ", ")
+}
+
+func tplBroadcastReport(b broadcast.Broadcast, status broadcast.Status) string {
+	title := "Рассылка завершена"
+	if status == broadcast.Cancelled {
+		title = "Рассылка остановлена"
+	}
+	return fmt.Sprintf("%s (%s)\n\nОтправлено: %d\nНе доставлено: %d\nОстановили бота: %d", title,
+		tplBroadcastFilter(b), b.Sent, b.Failed, b.Blocked)
+}
+
+func broadcastCallback(id primitive.ObjectID, action string) string {
+	return strings.Join([]string{broadcastCallbackTag, id.Hex(), action}, callbackDelim)
+}
+
+func broadcastMarkup(id primitive.ObjectID, actions ...string) tgbotapi.InlineKeyboardMarkup {
+	names := map[string]string{
+		broadcastGo:   "✅ Отправить",
+		broadcastNo:   "Отмена",
+		broadcastStop: "⏹ Остановить",
+	}
+	row := make([]tgbotapi.InlineKeyboardButton, 0, len(actions))
+	for _, a := range actions {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(names[a], broadcastCallback(id, a)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+func (s *service) handleOwnerBroadcast(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	running, found, err := s.broadcastRepo.GetRunning(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.broadcastRepo.GetRunning: %w", err)
+	}
+	if found {
+		text := fmt.Sprintf("Идет рассылка (%s). Отправлено: %d, не доставлено: %d, остановили бота: %d. Новую "+
+			"можно начать после ее завершения", tplBroadcastFilter(running), running.Sent, running.Failed,
+			running.Blocked)
+		if running.StartAt.After(time.Now()) {
+			text = fmt.Sprintf("Запланирована рассылка на %s (%s). Новую можно начать после ее завершения",
+				running.StartAt.In(s.location).Format(laterTimeLayout), tplBroadcastFilter(running))
+		}
+		msg := tgbotapi.NewMessage(upd.Message.Chat.ID, text)
+		msg.ReplyMarkup = broadcastMarkup(running.ID, broadcastStop)
+		_, err = api.Send(msg)
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+		return nil
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.SetBroadcast)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf("%s\n\n%s — отмена", broadcastHelp, help))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+	return nil
+}
+
+func (s *service) onBroadcast(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	b, err := parseBroadcast(upd.Message.Text, time.Now().In(s.location))
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Рассылка не создана: %s. Попробуйте еще раз", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	targets, err := s.broadcastTargets(ctx, bot, b)
+	if err != nil {
+		return fmt.Errorf("s.broadcastTargets: %w", err)
+	}
+	if len(targets) == 0 {
+		e := s.replyErr(api, upd, "Рассылку некому отправить: нет подходящих собеседников. Измените фильтры или "+
+			"напишите "+help+" для отмены")
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	b.ChildBotID = bot.ID
+	b.UserID = bot.OwnerUserID
+	b.ChatID = upd.Message.Chat.ID
+	id, err := s.broadcastRepo.CreateDraft(ctx, b)
+	if err != nil {
+		return fmt.Errorf("s.broadcastRepo.CreateDraft: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	_, err = api.Send(tgbotapi.NewMessage(upd.Message.Chat.ID, b.Text))
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	when := ""
+	count := fmt.Sprintf("Получателей: %d (%s)", len(targets), tplBroadcastFilter(b))
+	if !b.StartAt.IsZero() {
+		when = " в " + b.StartAt.In(s.location).Format(laterTimeLayout)
+		count = fmt.Sprintf("Получателей сейчас: %d (%s), список обновится в момент отправки", len(targets),
+			tplBroadcastFilter(b))
+	}
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, fmt.Sprintf("Так собеседники увидят рассылку. %s. "+
+		"Отправить%s?", count, when))
+	msg.ReplyMarkup = broadcastMarkup(id, broadcastGo, broadcastNo)
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+func (s *service) broadcastTargets(ctx context.Context, bot Bot, b broadcast.Broadcast) ([]broadcast.Target, error) {
+	var since time.Time
+	if b.ActiveDays != 0 {
+		since = time.Now().UTC().AddDate(0, 0, -int(b.ActiveDays))
+	}
+
+	peers, err := s.peerRepo.GetAudience(ctx, bot.ID, b.Source, b.Tag, since)
+	if err != nil {
+		return nil, fmt.Errorf("s.peerRepo.GetAudience: %w", err)
+	}
+
+	res := make([]broadcast.Target, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, broadcast.Target{
+			TgUserID: p.TgUserID,
+			TgChatID: p.TgChatID,
+		})
+	}
+	return res, nil
+}
+
+// handleBroadcastCallback confirms, cancels or stops a broadcast. The audience is collected again on
+// confirmation, or at the start time of a scheduled broadcast, so peers who stopped the bot after the preview
+// are skipped and those who came meanwhile are included
+func (s *service) handleBroadcastCallback(ctx context.Context, api *tgbotapi.BotAPI, cb callbackQuery, bot Bot) error {
+	parts := strings.Split(cb.Data, callbackDelim)
+	if len(parts) != 3 {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	var text string
+	var markup *tgbotapi.InlineKeyboardMarkup
+	switch parts[2] {
+	case broadcastGo:
+		text, markup, err = s.startBroadcast(ctx, bot, id)
+		if err != nil {
+			return fmt.Errorf("s.startBroadcast: %w", err)
+		}
+	case broadcastNo, broadcastStop:
+		ok, e := s.broadcastRepo.Cancel(ctx, bot.ID, id)
+		if e != nil {
+			return fmt.Errorf("s.broadcastRepo.Cancel: %w", e)
+		}
+
+		text = "Рассылка уже завершена"
+		switch {
+		case ok && parts[2] == broadcastNo:
+			text = "Рассылка отменена"
+		case ok:
+			text = "Рассылка остановлена, отчет придет отдельным сообщением"
+		}
+	default:
+		return nil
+	}
+
+	edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, int(cb.Message.MessageID), text)
+	edit.ReplyMarkup = markup
+	_, err = api.Send(edit)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+func (s *service) startBroadcast(
+	ctx context.Context,
+	bot Bot,
+	id primitive.ObjectID,
+) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	_, running, err := s.broadcastRepo.GetRunning(ctx, bot.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.broadcastRepo.GetRunning: %w", err)
+	}
+	if running {
+		return fmt.Sprintf("Уже идет другая рассылка, дождитесь ее завершения: %s", broadcastCmd), nil, nil
+	}
+
+	b, found, err := s.broadcastRepo.GetByID(ctx, bot.ID, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.broadcastRepo.GetByID: %w", err)
+	}
+	if !found || b.Status != broadcast.Draft {
+		return fmt.Sprintf("Рассылка устарела, создайте новую: %s", broadcastCmd), nil, nil
+	}
+
+	markup := broadcastMarkup(id, broadcastStop)
+	if b.StartAt.After(time.Now()) {
+		ok, e := s.broadcastRepo.Start(ctx, id, nil)
+		if e != nil {
+			return "", nil, fmt.Errorf("s.broadcastRepo.Start: %w", e)
+		}
+		if !ok {
+			return fmt.Sprintf("Рассылка устарела, создайте новую: %s", broadcastCmd), nil, nil
+		}
+
+		return fmt.Sprintf("Рассылка запланирована на %s. Получатели (%s) будут выбраны в момент отправки. "+
+			"Отчет придет по завершении", b.StartAt.In(s.location).Format(laterTimeLayout),
+			tplBroadcastFilter(b)), &markup, nil
+	}
+
+	targets, err := s.broadcastTargets(ctx, bot, b)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.broadcastTargets: %w", err)
+	}
+	if len(targets) == 0 {
+		return "Рассылку некому отправить: нет подходящих собеседников", nil, nil
+	}
+
+	ok, err := s.broadcastRepo.Start(ctx, id, targets)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.broadcastRepo.Start: %w", err)
+	}
+	if !ok {
+		return fmt.Sprintf("Рассылка устарела, создайте новую: %s", broadcastCmd), nil, nil
+	}
+
+	return fmt.Sprintf("Рассылка запущена, получателей: %d. Отчет придет по завершении", len(targets)), &markup,
+		nil
+}
+
+// serveBroadcasts runs broadcast jobs one by one. A job is leased, so a job of a stopped instance is taken
+// over after the lease is over. Up to broadcastSaveEvery messages may be sent twice then
+func (s *service) serveBroadcasts(ctx context.Context) {
+	ticker := time.NewTicker(broadcastPoll)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			b, found, err := s.broadcastRepo.Acquire(ctx, broadcastLease)
+			if err != nil {
+				s.logger.Error().Err(err).Send()
+				break
+			}
+			if !found {
+				break
+			}
+
+			s.runBroadcast(ctx, b)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) runBroadcast(ctx context.Context, b broadcast.Broadcast) {
+	logger := s.logger.With().Str("broadcastID", b.ID.Hex()).Logger()
+
+	bot, found, err := s.childBotRepo.GetByIDAnyOwner(ctx, b.ChildBotID)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if !found {
+		err = s.broadcastRepo.Finish(ctx, b, broadcast.Cancelled)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+		return
+	}
+
+	api, err := tgbotapi.NewBotAPI(bot.Token)
+	if err != nil {
+		// the job is retried when the lease is over, the owner may fix the token meanwhile
+		logger.Warn().Err(err).Send()
+		s.markTokenFailed(ctx, bot, err)
+		return
+	}
+
+	status := broadcast.Done
+	if len(b.Targets) == 0 && b.Next == 0 {
+		// a scheduled job, its audience is collected at the start time
+		b.Targets, err = s.broadcastTargets(ctx, bot, b)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		running, e := s.broadcastRepo.SetTargets(ctx, b.ID, b.Targets)
+		if e != nil {
+			logger.Error().Err(e).Send()
+			return
+		}
+		if !running {
+			status = broadcast.Cancelled
+			b.Targets = nil
+		}
+	}
+
+	limiter := time.NewTicker(broadcastRate)
+	defer limiter.Stop()
+
+	for b.Next < len(b.Targets) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-limiter.C:
+		}
+
+		t := b.Targets[b.Next]
+		err = s.sendBroadcast(ctx, api, b, t.TgChatID)
+		if errors.Is(err, errBroadcastStopped) {
+			status = broadcast.Cancelled
+			break
+		}
+
+		var tgErr tgbotapi.Error
+		switch {
+		case err == nil:
+			b.Sent += 1
+		case errors.As(err, &tgErr) && strings.HasPrefix(tgErr.Message, "Forbidden"):
+			b.Blocked += 1
+			e := s.peerRepo.SetStopped(ctx, bot.ID, t.TgUserID, true)
+			if e != nil {
+				logger.Error().Err(e).Send()
+			}
+		default:
+			b.Failed += 1
+			logger.Warn().Err(err).Int64("chatID", t.TgChatID).Send()
+		}
+		b.Next += 1
+
+		if b.Next%broadcastSaveEvery != 0 {
+			continue
+		}
+		running, e := s.broadcastRepo.Progress(ctx, b, broadcastLease)
+		if e != nil {
+			logger.Error().Err(e).Send()
+			return
+		}
+		if !running {
+			status = broadcast.Cancelled
+			break
+		}
+	}
+
+	err = s.broadcastRepo.Finish(ctx, b, status)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = api.Send(tgbotapi.NewMessage(b.ChatID, tplBroadcastReport(b, status)))
+	if err != nil {
+		logger.Warn().Err(err).Send()
+	}
+}
+
+// sendBroadcast waits and retries when Telegram asks to slow down. Progress is saved and the lease is extended
+// before each wait, so the job is not taken over by another instance meanwhile
+func (s *service) sendBroadcast(ctx context.Context, api *tgbotapi.BotAPI, b broadcast.Broadcast, chatID int64) error {
+	for i := 0; ; i++ {
+		_, err := api.Send(tgbotapi.NewMessage(chatID, b.Text))
+		var tgErr tgbotapi.Error
+		if err == nil || !errors.As(err, &tgErr) || tgErr.RetryAfter == 0 || i == broadcastRetries {
+			return err
+		}
+
+		wait := time.Duration(tgErr.RetryAfter) * time.Second
+		running, e := s.broadcastRepo.Progress(ctx, b, broadcastLease+wait)
+		if e != nil {
+			s.logger.Error().Err(e).Str("broadcastID", b.ID.Hex()).Send()
+		}
+		if e == nil && !running {
+			return errBroadcastStopped
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vahter-robot/backend/pkg/broadcast"
+	"testing"
+	"time"
+)
+
+func TestParseBroadcast(t *testing.T) {
+	b, err := parseBroadcast("Источник: ad_1\nактивность: 30\n\nПрайс обновлен\nСмотрите в канале", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "ad_1", b.Source)
+	assert.Equal(t, uint16(30), b.ActiveDays)
+	assert.Equal(t, "Прайс обновлен\nСмотрите в канале", b.Text)
+	assert.Equal(t, "метка ad_1, писали за 30 дн.", tplBroadcastFilter(b))
+
+	b, err = parseBroadcast("Прайс обновлен", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, broadcast.Broadcast{Text: "Прайс обновлен"}, b)
+	assert.Equal(t, "все собеседники", tplBroadcastFilter(b))
+
+	b, err = parseBroadcast("Тег: Клиент\nПрайс обновлен", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "клиент", b.Tag)
+	assert.Equal(t, "тег клиент", tplBroadcastFilter(b))
+
+	_, err = parseBroadcast("тег: два слова\nПрайс", time.Now())
+	assert.Error(t, err)
+
+	_, err = parseBroadcast("активность: 0\nПрайс", time.Now())
+	assert.Error(t, err)
+
+	_, err = parseBroadcast("источник: ad_1", time.Now())
+	assert.Error(t, err)
+}
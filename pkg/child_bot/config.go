@@ -0,0 +1,652 @@
+package child_bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	configFormatYAML = "yaml"
+	configMaxBytes   = 1 << 20
+)
+
+// botConfig is the exchange format of /export_config and config import
+type botConfig struct {
+	Mode         mode            `json:"mode" yaml:"mode"`
+	StartMessage string          `json:"start_message" yaml:"start_message"`
+	StartMedia   *configMedia    `json:"start_media,omitempty" yaml:"start_media,omitempty"`
+	StartButtons []configButton  `json:"start_buttons,omitempty" yaml:"start_buttons,omitempty"`
+	Menu         []configMenu    `json:"menu,omitempty" yaml:"menu,omitempty"`
+	MenuKeyboard bool            `json:"menu_keyboard,omitempty" yaml:"menu_keyboard,omitempty"`
+	StartLinks   []configLink    `json:"start_links,omitempty" yaml:"start_links,omitempty"`
+	Keywords     []configKeyword `json:"keywords" yaml:"keywords"`
+}
+
+type configKeyword struct {
+	In         []string       `json:"in" yaml:"in"`
+	Out        string         `json:"out" yaml:"out"`
+	Variants   []string       `json:"variants,omitempty" yaml:"variants,omitempty"`
+	RoundRobin bool           `json:"round_robin,omitempty" yaml:"round_robin,omitempty"`
+	ParseMode  string         `json:"parse_mode,omitempty" yaml:"parse_mode,omitempty"`
+	NoPreview  bool           `json:"disable_preview,omitempty" yaml:"disable_preview,omitempty"`
+	Media      *configMedia   `json:"media,omitempty" yaml:"media,omitempty"`
+	Buttons    []configButton `json:"buttons,omitempty" yaml:"buttons,omitempty"`
+	Ban        bool           `json:"ban" yaml:"ban"`
+	// Delay is a range of seconds like '2-5', empty is the delay of the bot
+	Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+}
+
+// configMedia is a Telegram file_id, it is valid only for the same bot
+type configMedia struct {
+	Type   string `json:"type" yaml:"type"`
+	FileID string `json:"file_id" yaml:"file_id"`
+}
+
+// configMenu is a menu item, Rule is the number of its rule in keywords, Items are its submenu
+type configMenu struct {
+	Text  string       `json:"text" yaml:"text"`
+	Rule  int          `json:"rule,omitempty" yaml:"rule,omitempty"`
+	Items []configMenu `json:"items,omitempty" yaml:"items,omitempty"`
+}
+
+// configLink is the start message for peers which came by the deep link with the payload
+type configLink struct {
+	Payload string `json:"payload" yaml:"payload"`
+	Text    string `json:"text" yaml:"text"`
+}
+
+type configButton struct {
+	Text string `json:"text" yaml:"text"`
+	URL  string `json:"url,omitempty" yaml:"url,omitempty"`
+	Data string `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+func configMediaOf(m *Media) *configMedia {
+	if m == nil {
+		return nil
+	}
+	return &configMedia{
+		Type:   m.Kind.Name(),
+		FileID: m.FileID,
+	}
+}
+
+// mediaOfConfig converts media of the config, it is validated on import
+func mediaOfConfig(m *configMedia) *Media {
+	if m == nil {
+		return nil
+	}
+	kind, _ := mediaKindByName(m.Type)
+	return &Media{
+		Kind:   kind,
+		FileID: m.FileID,
+	}
+}
+
+func configButtonsOf(in []Button) []configButton {
+	var res []configButton
+	for _, b := range in {
+		res = append(res, configButton(b))
+	}
+	return res
+}
+
+func buttonsOf(in []configButton) []Button {
+	var res []Button
+	for _, b := range in {
+		res = append(res, Button(b))
+	}
+	return res
+}
+
+// configMenuOf is the menu without items of deleted rules, rules are referenced by their numbers
+func configMenuOf(items []MenuItem, bot Bot) []configMenu {
+	var res []configMenu
+	for _, item := range items {
+		var rule int
+		if i, found := findKeyword(bot, item.KeywordID); found {
+			rule = i + 1
+		}
+		res = append(res, configMenu{
+			Text:  item.Text,
+			Rule:  rule,
+			Items: configMenuOf(item.Items, bot),
+		})
+	}
+	return res
+}
+
+// menuOfConfig converts the menu of the config, rules must have IDs. It is validated on import
+func menuOfConfig(items []configMenu, keywords []Keyword) []MenuItem {
+	var res []MenuItem
+	for _, item := range items {
+		m := MenuItem{
+			ID:    primitive.NewObjectID(),
+			Text:  item.Text,
+			Items: menuOfConfig(item.Items, keywords),
+		}
+		if item.Rule >= 1 && item.Rule <= len(keywords) {
+			m.KeywordID = keywords[item.Rule-1].ID
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func configLinksOf(in []StartPayload) []configLink {
+	var res []configLink
+	for _, sp := range in {
+		res = append(res, configLink(sp))
+	}
+	return res
+}
+
+func startPayloadsOf(in []configLink) []StartPayload {
+	var res []StartPayload
+	for _, l := range in {
+		res = append(res, StartPayload(l))
+	}
+	return res
+}
+
+func configDelayOf(d *DelayRange) string {
+	if d == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", d.Min, d.Max)
+}
+
+// delayOf parses the delay of a config rule, it is validated on import
+func delayOf(in string) *DelayRange {
+	if in == "" {
+		return nil
+	}
+	d, err := parseDelay(in)
+	if err != nil {
+		return nil
+	}
+	return &d
+}
+
+func configOf(bot Bot) botConfig {
+	cfg := botConfig{
+		Mode:         bot.Mode,
+		StartMessage: bot.OnPeerStart,
+		StartMedia:   configMediaOf(bot.StartMedia),
+		StartButtons: configButtonsOf(bot.StartButtons),
+		Menu:         configMenuOf(liveMenu(bot), bot),
+		MenuKeyboard: bot.MenuKeyboard,
+		StartLinks:   configLinksOf(bot.StartPayloads),
+		Keywords:     make([]configKeyword, 0, len(bot.Keywords)),
+	}
+	for _, kw := range bot.Keywords {
+		cfg.Keywords = append(cfg.Keywords, configKeyword{
+			In:         kw.In,
+			Out:        kw.Out,
+			Variants:   kw.Variants,
+			RoundRobin: kw.RoundRobin,
+			ParseMode:  kw.ParseMode.Name(),
+			NoPreview:  kw.NoPreview,
+			Media:      configMediaOf(kw.Media),
+			Buttons:    configButtonsOf(kw.Buttons),
+			Ban:        kw.Ban,
+			Delay:      configDelayOf(kw.Delay),
+		})
+	}
+	return cfg
+}
+
+func (s *service) handleOwnerExportConfig(api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	format := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, exportConfig)))
+
+	var (
+		raw  []byte
+		name string
+		err  error
+	)
+	if format == configFormatYAML {
+		raw, err = yaml.Marshal(configOf(bot))
+		if err != nil {
+			return fmt.Errorf("yaml.Marshal: %w", err)
+		}
+		name = "config.yaml"
+	} else {
+		raw, err = json.MarshalIndent(configOf(bot), "", "  ")
+		if err != nil {
+			return fmt.Errorf("json.MarshalIndent: %w", err)
+		}
+		name = "config.json"
+	}
+
+	doc := tgbotapi.NewDocumentUpload(upd.Message.Chat.ID, tgbotapi.FileBytes{
+		Name:  name,
+		Bytes: raw,
+	})
+	doc.Caption = fmt.Sprintf("Настройки @%s. Измените файл и отправьте его боту, чтобы применить", api.Self.UserName)
+	_, err = api.Send(doc)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+// handleOwnerImportConfig validates an uploaded config, shows what would change and waits for confirmation
+func (s *service) handleOwnerImportConfig(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	doc := upd.Message.Document
+	if doc.FileSize > configMaxBytes {
+		err := s.replyErr(api, upd, "Файл слишком большой")
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	raw, err := downloadFile(ctx, api, doc.FileID)
+	if err != nil {
+		return fmt.Errorf("downloadFile: %w", err)
+	}
+
+	cfg, err := unmarshalConfig(raw)
+	if err != nil {
+		e := s.replyErr(api, upd, "Не удалось прочитать файл. Нужен JSON или YAML в формате "+exportConfig)
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	cfg, errs := s.validateConfig(cfg)
+	if len(errs) != 0 {
+		err = s.replyErr(api, upd, "Настройки не применены:\n\n"+strings.Join(errs, "\n"))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	diff := diffConfig(configOf(bot), cfg)
+	if len(diff) == 0 {
+		err = s.replyOK(api, upd, "Настройки в файле совпадают с текущими")
+		if err != nil {
+			return fmt.Errorf("s.replyOK: %w", err)
+		}
+		return nil
+	}
+
+	pending, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	err = s.childStateRepo.SetSceneWithPayload(ctx, owner.ID, bot.ID, child_state.ImportConfig, string(pending))
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf(`Изменения:
+
+%s
+
+Напишите '%s' чтобы применить, или %s для отмены`, strings.Join(diff, "\n"), yes, help))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) onImportConfig(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	payload string,
+) error {
+	err := s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	if strings.ToLower(strings.TrimSpace(upd.Message.Text)) != yes {
+		err = s.replyOK(api, upd, "Импорт отменен")
+		if err != nil {
+			return fmt.Errorf("s.replyOK: %w", err)
+		}
+		return nil
+	}
+
+	var cfg botConfig
+	err = json.Unmarshal([]byte(payload), &cfg)
+	if err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	kws := make([]Keyword, 0, len(cfg.Keywords))
+	for _, kw := range cfg.Keywords {
+		pm, _ := parseModeByName(kw.ParseMode)
+		kws = append(kws, Keyword{
+			In:         kw.In,
+			Out:        kw.Out,
+			Variants:   kw.Variants,
+			RoundRobin: kw.RoundRobin,
+			ParseMode:  pm,
+			NoPreview:  kw.NoPreview,
+			Media:      mediaOfConfig(kw.Media),
+			Buttons:    buttonsOf(kw.Buttons),
+			Ban:        kw.Ban,
+			Delay:      delayOf(kw.Delay),
+		})
+	}
+
+	next := bot
+	next.OnPeerStart = cfg.StartMessage
+	next.StartMedia = mediaOfConfig(cfg.StartMedia)
+	next.StartButtons = buttonsOf(cfg.StartButtons)
+	kws = withKeywordIDs(kws)
+	next.Menu = menuOfConfig(cfg.Menu, kws)
+	next.MenuKeyboard = cfg.MenuKeyboard
+	next.StartPayloads = startPayloadsOf(cfg.StartLinks)
+	next.Keywords = kws
+	next.Mode = cfg.Mode
+	next.SetupDone = true
+	n, err := s.applySettings(ctx, bot, next, upd.Message.From, sourceImport)
+	if err != nil {
+		return fmt.Errorf("s.applySettings: %w", err)
+	}
+
+	err = s.replyOK(api, upd, fmt.Sprintf("Настройки применены, сохранено как v%d. %s", n, versions))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	return nil
+}
+
+// fileClient downloads files sent to the bot, the timeout keeps a stalled download from holding the webhook
+var fileClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+func downloadFile(ctx context.Context, api *tgbotapi.BotAPI, fileID string) (raw []byte, err error) {
+	u, err := api.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("api.GetFileDirectURL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fileClient.Do: %w", err)
+	}
+	defer func() {
+		e := resp.Body.Close()
+		if e != nil && err == nil {
+			err = fmt.Errorf("resp.Body.Close: %w", e)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	raw, err = io.ReadAll(io.LimitReader(resp.Body, configMaxBytes))
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+
+	return raw, nil
+}
+
+// unmarshalConfig accepts JSON and YAML. Unknown fields are rejected so typos are not silently ignored
+func unmarshalConfig(raw []byte) (botConfig, error) {
+	var cfg botConfig
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&cfg)
+		if err != nil {
+			return botConfig{}, fmt.Errorf("dec.Decode: %w", err)
+		}
+		return cfg, nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	err := dec.Decode(&cfg)
+	if err != nil {
+		return botConfig{}, fmt.Errorf("dec.Decode: %w", err)
+	}
+	return cfg, nil
+}
+
+// validateConfig checks the config against the same limits as the text format and normalizes keywords
+func (s *service) validateConfig(cfg botConfig) (botConfig, []string) {
+	var errs []string
+	if cfg.Mode != OnlyFirst && cfg.Mode != Always {
+		errs = append(errs, fmt.Sprintf("mode: должен быть %d или %d", OnlyFirst, Always))
+	}
+	err := checkTemplate(cfg.StartMessage, 0, ParsePlain)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("start_message: %s", err))
+	}
+	if !validConfigMedia(cfg.StartMedia) {
+		errs = append(errs, "start_media: нужны type (photo, document или video) и file_id")
+	}
+	err = checkButtons(buttonsOf(cfg.StartButtons))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("start_buttons: %s", err))
+	}
+	errs = append(errs, checkConfigMenu(cfg.Menu, len(cfg.Keywords), true)...)
+	links, err := checkStartPayloads(startPayloadsOf(cfg.StartLinks))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("start_links: %s", err))
+	}
+	if len(cfg.Keywords) > int(s.keywordsLimitPerBot) {
+		errs = append(errs, fmt.Sprintf("keywords: не более %d правил", s.keywordsLimitPerBot))
+	}
+
+	res := botConfig{
+		Mode:         cfg.Mode,
+		StartMessage: strings.TrimSpace(cfg.StartMessage),
+		StartMedia:   cfg.StartMedia,
+		StartButtons: configButtonsOf(buttonsOf(cfg.StartButtons)),
+		MenuKeyboard: cfg.MenuKeyboard,
+		StartLinks:   configLinksOf(links),
+		Keywords:     make([]configKeyword, 0, len(cfg.Keywords)),
+	}
+	if len(cfg.Menu) != 0 {
+		res.Menu = cfg.Menu
+	}
+	for i, kw := range cfg.Keywords {
+		n := i + 1
+		if len(kw.In) == 0 {
+			errs = append(errs, fmt.Sprintf("правило %d: нет ключевых слов", n))
+		}
+		if len(kw.In) > int(s.inLimitPerKeyword) {
+			errs = append(errs, fmt.Sprintf("правило %d: не более %d ключевых слов", n, s.inLimitPerKeyword))
+		}
+		pm, ok := parseModeByName(kw.ParseMode)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("правило %d: parse_mode должен быть html, markdown или пустым", n))
+		}
+		err = s.checkVariants(append([]string{kw.Out}, kw.Variants...), pm)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("правило %d: %s", n, err))
+		}
+		if !validConfigMedia(kw.Media) {
+			errs = append(errs, fmt.Sprintf("правило %d: у media нужны type (photo, document или video) "+
+				"и file_id", n))
+		}
+		err = checkButtons(buttonsOf(kw.Buttons))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("правило %d: %s", n, err))
+		}
+		if kw.Delay != "" {
+			_, err = parseDelay(kw.Delay)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("правило %d: delay: %s", n, err))
+			}
+		}
+
+		unique := map[string]struct{}{}
+		in := make([]string, 0, len(kw.In))
+		for _, word := range kw.In {
+			k := strings.ToLower(strings.TrimSpace(word))
+			if k == "" || utf8.RuneCountInString(k) > int(s.inLimitChars) {
+				errs = append(errs, fmt.Sprintf("правило %d: ключевое слово '%s' пустое или длиннее %d символов",
+					n, word, s.inLimitChars))
+				continue
+			}
+			if _, ok := unique[k]; ok {
+				continue
+			}
+			unique[k] = struct{}{}
+			in = append(in, k)
+		}
+
+		res.Keywords = append(res.Keywords, configKeyword{
+			In:         in,
+			Out:        kw.Out,
+			Variants:   kw.Variants,
+			RoundRobin: kw.RoundRobin,
+			ParseMode:  pm.Name(),
+			NoPreview:  kw.NoPreview,
+			Media:      kw.Media,
+			Buttons:    configButtonsOf(buttonsOf(kw.Buttons)),
+			Ban:        kw.Ban,
+			Delay:      configDelayOf(delayOf(kw.Delay)),
+		})
+	}
+
+	return res, errs
+}
+
+// checkConfigMenu checks the menu against the same limits as /menu, only top items may have a submenu
+func checkConfigMenu(items []configMenu, rules int, top bool) []string {
+	var errs []string
+	if len(items) > menuItemsLimit {
+		errs = append(errs, fmt.Sprintf("menu: не более %d пунктов в меню и в каждом подменю", menuItemsLimit))
+	}
+	for _, item := range items {
+		if item.Text == "" || utf8.RuneCountInString(item.Text) > buttonTextChars {
+			errs = append(errs, fmt.Sprintf("menu: текст пункта '%s' пустой или длиннее %d символов", item.Text,
+				buttonTextChars))
+		}
+		if item.Rule < 0 || item.Rule > rules {
+			errs = append(errs, fmt.Sprintf("menu: у пункта '%s' нет правила %d", item.Text, item.Rule))
+		}
+		if len(item.Items) == 0 {
+			continue
+		}
+		if !top {
+			errs = append(errs, fmt.Sprintf("menu: у пункта подменю '%s' не может быть своего подменю", item.Text))
+		}
+		if item.Rule != 0 {
+			errs = append(errs, fmt.Sprintf("menu: у пункта '%s' есть подменю, rule ему указывать не нужно",
+				item.Text))
+		}
+		errs = append(errs, checkConfigMenu(item.Items, rules, false)...)
+	}
+	return errs
+}
+
+func validConfigMedia(m *configMedia) bool {
+	if m == nil {
+		return true
+	}
+	_, ok := mediaKindByName(m.Type)
+	return ok && m.FileID != ""
+}
+
+// diffConfig describes changes from a to b, rules are compared by position
+func diffConfig(a, b botConfig) []string {
+	var res []string
+	if a.Mode != b.Mode {
+		res = append(res, fmt.Sprintf("Режим: %d → %d", a.Mode, b.Mode))
+	}
+	if a.StartMessage != b.StartMessage {
+		res = append(res, "Приветственное сообщение изменено")
+	}
+	if !reflect.DeepEqual(a.StartMedia, b.StartMedia) {
+		res = append(res, "Вложение приветственного сообщения изменено")
+	}
+	if !reflect.DeepEqual(a.StartButtons, b.StartButtons) {
+		res = append(res, "Кнопки приветственного сообщения изменены")
+	}
+	if !reflect.DeepEqual(a.Menu, b.Menu) || a.MenuKeyboard != b.MenuKeyboard {
+		res = append(res, "Меню изменено")
+	}
+	if !reflect.DeepEqual(a.StartLinks, b.StartLinks) {
+		res = append(res, "Приветствия по ссылкам изменены")
+	}
+
+	for i := 0; i < len(a.Keywords) || i < len(b.Keywords); i++ {
+		n := i + 1
+		switch {
+		case i >= len(a.Keywords):
+			res = append(res, fmt.Sprintf("+ правило %d: %s", n, strings.Join(b.Keywords[i].In, comma)))
+		case i >= len(b.Keywords):
+			res = append(res, fmt.Sprintf("- правило %d: %s", n, strings.Join(a.Keywords[i].In, comma)))
+		default:
+			var changed []string
+			if strings.Join(a.Keywords[i].In, comma) != strings.Join(b.Keywords[i].In, comma) {
+				changed = append(changed, "ключевые слова")
+			}
+			if a.Keywords[i].Out != b.Keywords[i].Out ||
+				joinVariants(a.Keywords[i].Variants) != joinVariants(b.Keywords[i].Variants) {
+				changed = append(changed, "автоответ")
+			}
+			if a.Keywords[i].RoundRobin != b.Keywords[i].RoundRobin {
+				changed = append(changed, "порядок вариантов")
+			}
+			if a.Keywords[i].ParseMode != b.Keywords[i].ParseMode {
+				changed = append(changed, "формат")
+			}
+			if a.Keywords[i].NoPreview != b.Keywords[i].NoPreview {
+				changed = append(changed, "превью ссылок")
+			}
+			if !reflect.DeepEqual(a.Keywords[i].Media, b.Keywords[i].Media) {
+				changed = append(changed, "вложение")
+			}
+			if !reflect.DeepEqual(a.Keywords[i].Buttons, b.Keywords[i].Buttons) {
+				changed = append(changed, "кнопки")
+			}
+			if a.Keywords[i].Ban != b.Keywords[i].Ban {
+				changed = append(changed, "бан")
+			}
+			if a.Keywords[i].Delay != b.Keywords[i].Delay {
+				changed = append(changed, "задержка")
+			}
+			if len(changed) != 0 {
+				res = append(res, fmt.Sprintf("~ правило %d: %s", n, strings.Join(changed, ", ")))
+			}
+		}
+	}
+
+	return res
+}
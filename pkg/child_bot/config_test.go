@@ -0,0 +1,116 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestImportConfigYAML(t *testing.T) {
+	s := &service{
+		keywordsLimitPerBot: 50,
+		inLimitPerKeyword:   25,
+		inLimitChars:        100,
+		outLimitChars:       1000,
+	}
+
+	cfg, err := unmarshalConfig([]byte(`mode: 2
+start_message: Привет
+keywords:
+  - in: [" Реклама", "реклама", "прайс"]
+    out: Прайс на рекламу
+    ban: false
+  - in: [ваканс]
+    out: Не ищу работу
+    ban: true
+`))
+	assert.NoError(t, err)
+
+	cfg, errs := s.validateConfig(cfg)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"реклама", "прайс"}, cfg.Keywords[0].In)
+
+	old := botConfig{
+		Mode: OnlyFirst,
+		Keywords: []configKeyword{{
+			In:  []string{"реклама", "прайс"},
+			Out: "Прайс",
+		}},
+	}
+	assert.Equal(t, []string{
+		"Режим: 1 → 2",
+		"Приветственное сообщение изменено",
+		"~ правило 1: автоответ",
+		"+ правило 2: ваканс",
+	}, diffConfig(old, cfg))
+}
+
+func TestImportConfigInvalid(t *testing.T) {
+	s := &service{
+		keywordsLimitPerBot: 50,
+		inLimitPerKeyword:   25,
+		inLimitChars:        100,
+		outLimitChars:       1000,
+	}
+
+	_, err := unmarshalConfig([]byte(`{"mode": 1, "keyword": []}`))
+	assert.Error(t, err)
+
+	_, errs := s.validateConfig(botConfig{
+		Mode: OnlyFirst,
+		Menu: []configMenu{{Text: "Реклама", Rule: 2}, {Text: "Другое", Items: []configMenu{{
+			Text:  "Подменю",
+			Items: []configMenu{{Text: "Глубже"}},
+		}}}},
+	})
+	assert.Len(t, errs, 2)
+
+	cfg, errs := s.validateConfig(botConfig{
+		Mode:       OnlyFirst,
+		StartLinks: []configLink{{Payload: " vk ", Text: " Привет из VK "}},
+	})
+	assert.Empty(t, errs)
+	assert.Equal(t, []configLink{{Payload: "vk", Text: "Привет из VK"}}, cfg.StartLinks)
+
+	_, errs = s.validateConfig(botConfig{
+		Mode:       OnlyFirst,
+		StartLinks: []configLink{{Payload: "vk"}, {Payload: "с пробелом", Text: "Привет"}},
+	})
+	assert.Len(t, errs, 1)
+
+	_, errs = s.validateConfig(botConfig{
+		Mode:         OnlyFirst,
+		StartMedia:   &configMedia{Type: "photo"},
+		StartButtons: []configButton{{Text: "Сайт", URL: "ftp://example.com"}},
+	})
+	assert.Len(t, errs, 2)
+
+	_, errs = s.validateConfig(botConfig{
+		Mode: 3,
+		Keywords: []configKeyword{{
+			In: []string{" "},
+		}},
+	})
+	assert.Len(t, errs, 3)
+}
+
+func TestConfigMenu(t *testing.T) {
+	bot := Bot{
+		Keywords: []Keyword{{ID: primitive.NewObjectID()}, {ID: primitive.NewObjectID()}},
+	}
+	bot.Menu = []MenuItem{
+		{Text: "Реклама", KeywordID: bot.Keywords[1].ID},
+		{Text: "Другое", Items: []MenuItem{{Text: "Вопрос"}}},
+	}
+
+	cfg := configMenuOf(bot.Menu, bot)
+	assert.Equal(t, []configMenu{
+		{Text: "Реклама", Rule: 2},
+		{Text: "Другое", Items: []configMenu{{Text: "Вопрос"}}},
+	}, cfg)
+
+	menu := menuOfConfig(cfg, bot.Keywords)
+	assert.Equal(t, bot.Keywords[1].ID, menu[0].KeywordID)
+	assert.True(t, menu[1].Items[0].KeywordID.IsZero())
+	assert.Equal(t, cfg, configMenuOf(menu, bot))
+}
@@ -0,0 +1,230 @@
+package child_bot
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+)
+
+type action uint8
+
+const (
+	// actIgnore leaves the message without a reply and without forwarding
+	actIgnore action = iota
+	// actStart replies with the start message
+	actStart
+	// actForward forwards the message without a reply
+	actForward
+	// actReply replies by the matched rule and forwards the message
+	actReply
+	// actBan replies by the matched rule and bans the peer, the message is not forwarded
+	actBan
+)
+
+// decision is what handlePeer does with a peer message
+type decision struct {
+	action    action
+	rule      int
+	keyword   string
+	keywordID primitive.ObjectID
+	// replies are templates of reply variants, one is sent
+	replies    []string
+	roundRobin bool
+	parseMode  parseMode
+	noPreview  bool
+	media      *Media
+	buttons    []Button
+	menu       []MenuItem
+	// menuKeyboard shows the menu as a keyboard
+	menuKeyboard bool
+	delay        DelayRange
+}
+
+func (d decision) forwards() bool {
+	return d.action == actForward || d.action == actReply
+}
+
+// decide is the side effect free part of handlePeer, so /test shows exactly what a peer would get
+func decide(bot Bot, text string, peerFound, peerMuted bool) decision {
+	if bot.Mode == None || bot.Paused || peerMuted {
+		return decision{action: actIgnore}
+	}
+
+	payload, isStart := parseStart(text)
+	reply := startReply(bot, payload)
+	menu := liveMenu(bot)
+	if isStart && (reply != "" || bot.StartMedia != nil || len(menu) != 0) {
+		if reply == "" && bot.StartMedia == nil {
+			reply = menuDefaultText
+		}
+		return decision{
+			action:       actStart,
+			replies:      []string{reply},
+			media:        bot.StartMedia,
+			buttons:      bot.StartButtons,
+			menu:         menu,
+			menuKeyboard: bot.MenuKeyboard,
+			delay:        bot.ReplyDelay,
+		}
+	}
+
+	if bot.Mode == OnlyFirst && peerFound {
+		return decision{action: actForward}
+	}
+
+	lowText := strings.ToLower(text)
+	for i, kw := range bot.Keywords {
+		for _, in := range kw.In {
+			if strings.Contains(lowText, in) {
+				return ruleDecision(bot, i, in)
+			}
+		}
+	}
+
+	return decision{action: actForward}
+}
+
+// ruleDecision is the decision of the rule i matched by the keyword
+func ruleDecision(bot Bot, i int, keyword string) decision {
+	kw := bot.Keywords[i]
+	act := actReply
+	if kw.Ban {
+		act = actBan
+	}
+	return decision{
+		action:     act,
+		rule:       i + 1,
+		keyword:    keyword,
+		keywordID:  kw.ID,
+		replies:    kw.outs(),
+		roundRobin: kw.RoundRobin,
+		parseMode:  kw.ParseMode,
+		noPreview:  kw.NoPreview,
+		media:      kw.Media,
+		buttons:    kw.Buttons,
+		delay:      ruleDelay(bot, kw),
+	}
+}
+
+func (s *service) handleOwnerTest(api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	text := strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, testRules))
+	if text == "" {
+		err := s.replyErr(api, upd, fmt.Sprintf("Укажите текст сообщения, например: %s сколько стоит реклама?",
+			testRules))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	botName := api.Self.FirstName
+	res := tplTest(bot, text, s.peerVars(botName, upd.Message.From, true), s.peerVars(botName, upd.Message.From,
+		false))
+
+	err := s.reply(api, upd, res)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+// tplTest is the /test report for a new peer and for a peer who has written before. It routes the text the way
+// handlePeer does: the menu keyboard first, then the rules
+func tplTest(bot Bot, text string, newPeer, oldPeer tplVars) string {
+	res := "Новый собеседник:\n" + tplPeerTest(bot, text, false, newPeer)
+	res += "\n\nСобеседник, который уже писал:\n" + tplPeerTest(bot, text, true, oldPeer)
+	if hasFreeTextItem(liveMenu(bot)) {
+		res += "\n\nЕсли собеседник перед этим выбрал пункт меню для свободного вопроса, бот не ответит и " +
+			"перешлет сообщение вам"
+	}
+	if bot.Paused {
+		res += "\n\nБот на паузе"
+	}
+	return res + "\n\nКулдаунов нет: правило отвечает на каждое подходящее сообщение, сколько бы раз собеседник " +
+		"его ни написал"
+}
+
+func tplPeerTest(bot Bot, text string, peerFound bool, v tplVars) string {
+	if !bot.MenuKeyboard {
+		return tplDecision(decide(bot, text, peerFound, false), v)
+	}
+	menu := liveMenu(bot)
+	if len(menu) == 0 {
+		return tplDecision(decide(bot, text, peerFound, false), v)
+	}
+
+	if text == menuBack {
+		return "Кнопка меню, бот покажет главное меню. Правила не проверяются"
+	}
+	item, found := findMenuItemByText(menu, text)
+	if !found {
+		return tplDecision(decide(bot, text, peerFound, false), v)
+	}
+
+	res := fmt.Sprintf("Пункт меню '%s', правила по словам не проверяются. ", item.Text)
+	if len(item.Items) != 0 {
+		return res + fmt.Sprintf("Бот покажет подменю из %d пунктов", len(item.Items))
+	}
+	if i, ok := findKeyword(bot, item.KeywordID); ok {
+		return res + tplDecision(ruleDecision(bot, i, item.Text), v)
+	}
+	return res + "Бот попросит написать вопрос, следующее сообщение будет переслано вам без ответа"
+}
+
+// hasFreeTextItem reports whether the menu has an item which asks the peer to write freely
+func hasFreeTextItem(items []MenuItem) bool {
+	for _, item := range items {
+		if len(item.Items) == 0 && item.KeywordID.IsZero() {
+			return true
+		}
+		if hasFreeTextItem(item.Items) {
+			return true
+		}
+	}
+	return false
+}
+
+func tplDecision(d decision, v tplVars) string {
+	var res string
+	switch d.action {
+	case actStart:
+		res = "Ответ приветствием"
+	case actForward:
+		return "Ни одно правило не сработает. Ответа нет, сообщение будет переслано вам"
+	case actReply:
+		res = fmt.Sprintf("Сработает правило %d по слову '%s', сообщение будет переслано вам", d.rule, d.keyword)
+	case actBan:
+		res = fmt.Sprintf("Сработает правило %d по слову '%s', собеседник будет забанен, вам ничего не придет",
+			d.rule, d.keyword)
+	default:
+		return "Бот не ответит и не перешлет сообщение"
+	}
+
+	if d.parseMode != ParsePlain {
+		res += fmt.Sprintf(", разметка %s", d.parseMode)
+	}
+	if a := tplAttachments(d.media, d.buttons); a != "" {
+		res += ", " + a
+	}
+	if len(d.menu) != 0 {
+		res += fmt.Sprintf(", меню из %d пунктов", len(d.menu))
+	}
+	if d.delay.Max != 0 {
+		res += ", задержка " + d.delay.String()
+	}
+	if len(d.replies) == 1 {
+		return res + ". Ответ:\n\n" + renderTemplate(d.replies[0], v)
+	}
+
+	order := "случайный"
+	if d.roundRobin {
+		order = "по очереди"
+	}
+	res += fmt.Sprintf(". Ответ, один из %d вариантов (%s):", len(d.replies), order)
+	for i, r := range d.replies {
+		res += fmt.Sprintf("\n\n%d) %s", i+1, renderTemplate(r, v))
+	}
+	return res
+}
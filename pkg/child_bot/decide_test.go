@@ -0,0 +1,94 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	bot := Bot{
+		Mode:        OnlyFirst,
+		OnPeerStart: "Привет",
+		Keywords: []Keyword{{
+			In:  []string{"ваканс"},
+			Out: "Не ищу работу",
+			Ban: true,
+		}, {
+			In:  []string{"реклама", "прайс"},
+			Out: "Прайс на рекламу",
+		}},
+	}
+
+	assert.Equal(t, decision{action: actStart, replies: []string{"Привет"}}, decide(bot, start, false, false))
+	assert.Equal(t, decision{action: actBan, rule: 1, keyword: "ваканс", replies: []string{"Не ищу работу"}},
+		decide(bot, "Есть ВАКАНСия", false, false))
+	assert.Equal(t, decision{action: actReply, rule: 2, keyword: "прайс", replies: []string{"Прайс на рекламу"}},
+		decide(bot, "Пришлите прайс", false, false))
+	assert.Equal(t, decision{action: actForward}, decide(bot, "Пришлите прайс", true, false))
+	assert.Equal(t, decision{action: actForward}, decide(bot, "Добрый день", false, false))
+	assert.Equal(t, decision{action: actIgnore}, decide(bot, "Пришлите прайс", false, true))
+
+	bot.Mode = Always
+	assert.Equal(t, actReply, decide(bot, "Пришлите прайс", true, false).action)
+
+	bot.Paused = true
+	assert.Equal(t, actIgnore, decide(bot, "Пришлите прайс", false, false).action)
+}
+
+func TestDecideStartPayload(t *testing.T) {
+	bot := Bot{
+		Mode:        Always,
+		OnPeerStart: "Привет",
+		StartPayloads: []StartPayload{{
+			Payload: "ad_1",
+			Text:    "Привет из рекламы",
+		}},
+	}
+
+	assert.Equal(t, []string{"Привет из рекламы"}, decide(bot, "/start ad_1", false, false).replies)
+	assert.Equal(t, []string{"Привет"}, decide(bot, "/start other", false, false).replies)
+	assert.Equal(t, []string{"Привет"}, decide(bot, start, false, false).replies)
+	assert.NotEqual(t, actStart, decide(bot, "/started", false, false).action)
+
+	assert.True(t, validPayload("ad_channel-1"))
+	assert.False(t, validPayload("ad channel"))
+	assert.False(t, validPayload(invitePrefix+"abc"))
+
+	payloads, err := parseStartPayloads("ad_1\n===\nПривет, {first_name}")
+	assert.NoError(t, err)
+	assert.Equal(t, []StartPayload{{Payload: "ad_1", Text: "Привет, {first_name}"}}, payloads)
+
+	_, err = parseStartPayloads("ad_1\n===\nПривет\n===\nad_1\n===\nЕще")
+	assert.Error(t, err)
+}
+
+func TestTplTest(t *testing.T) {
+	bot := Bot{
+		Mode: OnlyFirst,
+		Keywords: []Keyword{{
+			In:  []string{"прайс"},
+			Out: "Прайс на рекламу",
+		}},
+	}
+
+	res := tplTest(bot, "Пришлите прайс", tplVars{}, tplVars{})
+	assert.Contains(t, res, "Сработает правило 1 по слову 'прайс'")
+	assert.Contains(t, res, "Ни одно правило не сработает")
+	assert.Contains(t, res, "Кулдаунов нет")
+	assert.NotContains(t, res, "свободного вопроса")
+
+	kwID := primitive.NewObjectID()
+	bot.Keywords[0].ID = kwID
+	bot.MenuKeyboard = true
+	bot.Menu = []MenuItem{{Text: "Цены", KeywordID: kwID}, {Text: "Другое"}}
+
+	res = tplTest(bot, "Цены", tplVars{}, tplVars{})
+	assert.Contains(t, res, "Пункт меню 'Цены'")
+	assert.Contains(t, res, "Прайс на рекламу")
+	assert.NotContains(t, res, "Ни одно правило не сработает")
+	assert.Contains(t, res, "свободного вопроса")
+
+	res = tplTest(bot, "Другое", tplVars{}, tplVars{})
+	assert.Contains(t, res, "Бот попросит написать вопрос")
+}
@@ -0,0 +1,225 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	"strings"
+)
+
+// StartPayload overrides the start message for peers which came by the deep link t.me/bot?start=Payload
+type StartPayload struct {
+	Payload string `bson:"p,omitempty"`
+	Text    string `bson:"t,omitempty"`
+}
+
+const (
+	startPayloadChars  = 64
+	startPayloadsLimit = 20
+	sourcesLimit       = 5
+	startLinksNone     = "-"
+)
+
+// parseStart reports whether the text is /start, with the deep link payload if any
+func parseStart(text string) (string, bool) {
+	if text == start {
+		return "", true
+	}
+	if !strings.HasPrefix(text, start+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(text, start)), true
+}
+
+// startReply is the start message for the payload, the common one if the payload has no own
+func startReply(bot Bot, payload string) string {
+	for _, sp := range bot.StartPayloads {
+		if payload != "" && sp.Payload == payload {
+			return sp.Text
+		}
+	}
+	return bot.OnPeerStart
+}
+
+// validPayload follows Telegram: up to 64 characters A-Z, a-z, 0-9, _ and -. Invite links are reserved
+func validPayload(in string) bool {
+	if in == "" || len(in) > startPayloadChars || strings.HasPrefix(in, invitePrefix) {
+		return false
+	}
+	for _, r := range in {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// recordSource stores the deep link payload the peer came by. A user who has not written yet gets a pending
+// source, it moves to the peer on the first message
+func (s *service) recordSource(ctx context.Context, bot Bot, tgUserID int64, payload string, peerFound bool) error {
+	if peerFound {
+		err := s.peerRepo.SetSource(ctx, bot.ID, tgUserID, payload)
+		if err != nil {
+			return fmt.Errorf("s.peerRepo.SetSource: %w", err)
+		}
+		return nil
+	}
+
+	err := s.peerRepo.SetPendingSource(ctx, bot.ID, tgUserID, payload, expireAt(s.peersDays(bot)))
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.SetPendingSource: %w", err)
+	}
+	return nil
+}
+
+// parseStartPayloads parses pairs of a payload and its start message separated by delim. The error is ready to
+// be shown to the user
+func parseStartPayloads(in string) ([]StartPayload, error) {
+	if strings.TrimSpace(in) == startLinksNone {
+		return nil, nil
+	}
+
+	parts := strings.Split(in, delim)
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("нужны пары: метка ссылки и приветствие, разделенные '%s'", strings.TrimSpace(delim))
+	}
+
+	pairs := make([]StartPayload, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		pairs = append(pairs, StartPayload{
+			Payload: parts[i],
+			Text:    parts[i+1],
+		})
+	}
+	return checkStartPayloads(pairs)
+}
+
+// checkStartPayloads validates and trims start messages of deep links, the error is ready to be shown to the user
+func checkStartPayloads(in []StartPayload) ([]StartPayload, error) {
+	if len(in) > startPayloadsLimit {
+		return nil, fmt.Errorf("не более %d ссылок", startPayloadsLimit)
+	}
+
+	var res []StartPayload
+	unique := map[string]struct{}{}
+	for _, sp := range in {
+		payload := strings.TrimSpace(sp.Payload)
+		if !validPayload(payload) {
+			return nil, fmt.Errorf("метка '%s' должна быть до %d символов: латиница, цифры, _ и -", payload,
+				startPayloadChars)
+		}
+		if _, ok := unique[payload]; ok {
+			return nil, fmt.Errorf("метка '%s' указана дважды", payload)
+		}
+		unique[payload] = struct{}{}
+
+		text := strings.TrimSpace(sp.Text)
+		err := checkTemplate(text, 0, ParsePlain)
+		if text == "" || err != nil {
+			return nil, fmt.Errorf("приветствие для '%s' пустое или с ошибкой в шаблоне: %v", payload, err)
+		}
+		res = append(res, StartPayload{
+			Payload: payload,
+			Text:    text,
+		})
+	}
+	return res, nil
+}
+
+func (s *service) handleOwnerStartLinks(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	err := s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.SetStartLinks)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	sources, err := s.peerRepo.CountBySource(ctx, bot.ID, sourcesLimit)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.CountBySource: %w", err)
+	}
+
+	current := no
+	if len(bot.StartPayloads) != 0 {
+		pairs := make([]string, 0, len(bot.StartPayloads))
+		for _, sp := range bot.StartPayloads {
+			pairs = append(pairs, sp.Payload+delim+sp.Text)
+		}
+		current = strings.Join(pairs, delim)
+	}
+
+	stats := no
+	if len(sources) != 0 {
+		lines := make([]string, 0, len(sources))
+		for _, src := range sources {
+			lines = append(lines, fmt.Sprintf("%s — %d", src.Source, src.Count))
+		}
+		stats = strings.Join(lines, "\n")
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf(`Ссылки вида https://t.me/%s?start=метка показывают, откуда пришел собеседник: метка видна в пересланных сообщениях. Для метки можно задать свое приветствие вместо общего.
+
+Собеседников по меткам:
+%s
+
+Приветствия сейчас:
+%s
+
+Напишите пары: метка, затем приветствие, разделенные '%s'. Например:
+
+ad_channel_1
+===
+Привет, {first_name}! Вы из рекламы в канале, вот скидка 10%%
+
+'%s' — убрать все приветствия, %s — отмена`, api.Self.UserName, stats, current, strings.TrimSpace(delim),
+		startLinksNone, help))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) onStartLinks(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	payloads, err := parseStartPayloads(upd.Message.Text)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Не сохранено: %s. Попробуйте еще раз", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	next := bot
+	next.StartPayloads = payloads
+	_, err = s.applySettings(ctx, bot, next, upd.Message.From, sourceLinks)
+	if err != nil {
+		return fmt.Errorf("s.applySettings: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	links := make([]string, 0, len(payloads))
+	for _, sp := range payloads {
+		links = append(links, fmt.Sprintf("https://t.me/%s?start=%s", api.Self.UserName, sp.Payload))
+	}
+	text := "Приветствия по ссылкам убраны"
+	if len(links) != 0 {
+		text = "Приветствия сохранены. Ссылки:\n" + strings.Join(links, "\n")
+	}
+
+	err = s.replyOK(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/random"
+	"github.com/vahter-robot/backend/pkg/scheduled"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	delayMaxSeconds = 120
+	// typingEvery is shorter than the 5 seconds Telegram shows the typing status for
+	typingEvery = 4 * time.Second
+)
+
+// delayPresets are cycled by the rule editor. nil is the delay of the bot, the zero range turns it off
+var delayPresets = []*DelayRange{nil, {Min: 1, Max: 3}, {Min: 3, Max: 7}, {Min: 7, Max: 15}, {}}
+
+func (d DelayRange) String() string {
+	switch {
+	case d.Max == 0:
+		return "нет"
+	case d.Min == d.Max:
+		return fmt.Sprintf("%d с", d.Max)
+	default:
+		return fmt.Sprintf("%d-%d с", d.Min, d.Max)
+	}
+}
+
+// parseDelay parses '3' and '2-5' as seconds, '0' turns the delay off. The error is ready to be shown to the user
+func parseDelay(in string) (DelayRange, error) {
+	lo, hi := in, in
+	if i := strings.Index(in, "-"); i >= 0 {
+		lo, hi = in[:i], in[i+1:]
+	}
+
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return DelayRange{}, fmt.Errorf("'%s' должно быть числом секунд или диапазоном вида 2-5", in)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil {
+		return DelayRange{}, fmt.Errorf("'%s' должно быть числом секунд или диапазоном вида 2-5", in)
+	}
+	if min > max {
+		return DelayRange{}, errors.New("начало диапазона больше конца")
+	}
+	if max > delayMaxSeconds {
+		return DelayRange{}, fmt.Errorf("задержка не больше %d с", delayMaxSeconds)
+	}
+
+	return DelayRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+// ruleDelay returns the delay of the rule if it is set, otherwise the delay of the bot
+func ruleDelay(bot Bot, kw Keyword) DelayRange {
+	if kw.Delay != nil {
+		return *kw.Delay
+	}
+	return bot.ReplyDelay
+}
+
+func nextDelayPreset(cur *DelayRange) *DelayRange {
+	for i, p := range delayPresets {
+		if (p == nil) == (cur == nil) && (p == nil || *p == *cur) {
+			return delayPresets[(i+1)%len(delayPresets)]
+		}
+	}
+	return delayPresets[0]
+}
+
+func tplRuleDelay(kw Keyword) string {
+	if kw.Delay == nil {
+		return "как у бота"
+	}
+	return kw.Delay.String()
+}
+
+func pickDelay(d DelayRange) (time.Duration, error) {
+	if d.Max == 0 {
+		return 0, nil
+	}
+
+	n, err := random.Intn(int(d.Max-d.Min) + 1)
+	if err != nil {
+		return time.Duration(d.Min) * time.Second, fmt.Errorf("random.Intn: %w", err)
+	}
+	return time.Duration(int(d.Min)+n) * time.Second, nil
+}
+
+func (s *service) handleOwnerDelay(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, replyDelay))
+	if arg == "" {
+		err := s.reply(api, upd, fmt.Sprintf(`Задержка автоответа: %s
+
+Перед автоответом бот подождет случайное время из диапазона и покажет, что печатает.
+
+Изменить: %s 2-5, в секундах, не больше %d. Выключить: %s 0. У правила можно задать свою задержку в %s`,
+			bot.ReplyDelay, replyDelay, delayMaxSeconds, replyDelay, editRules))
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	d, err := parseDelay(arg)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Не изменено: %s", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	err = s.childBotRepo.SetReplyDelay(ctx, bot.ID, d)
+	if err != nil {
+		return fmt.Errorf("s.childBotRepo.SetReplyDelay: %w", err)
+	}
+
+	text := "Задержка автоответа: " + d.String()
+	if d.Max == 0 {
+		text = "Бот отвечает без задержки"
+	}
+	err = s.replyOK(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
+// sendReply sends the autoreply now, or shows typing and sends it after the delay of the decision. The delayed
+// reply is stored first, so the webhook returns at once and a restart does not lose it
+func (s *service) sendReply(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	bot Bot,
+	d decision,
+	tgUserID int64,
+	r richReply,
+) error {
+	delay, err := pickDelay(d.delay)
+	if err != nil {
+		s.logger.Warn().Err(err).Send()
+	}
+	if delay == 0 {
+		return s.sendRich(api, r)
+	}
+
+	m := scheduled.Message{
+		ID:               primitive.NewObjectID(),
+		ChildBotID:       bot.ID,
+		UserID:           bot.OwnerUserID,
+		TgUserID:         tgUserID,
+		TgChatID:         r.chatID,
+		ReplyToMessageID: int64(r.replyTo),
+		Text:             r.text,
+		SendAt:           time.Now().UTC().Add(delay),
+		Auto:             true,
+		KeywordID:        d.keywordID,
+		Start:            d.action == actStart,
+	}
+	err = s.scheduledRepo.Create(ctx, m)
+	if err != nil {
+		return fmt.Errorf("s.scheduledRepo.Create: %w", err)
+	}
+
+	go s.deliverDelayed(api, m, r)
+	return nil
+}
+
+// deliverDelayed shows typing until the reply is due and sends it, unless the poller of scheduled messages
+// took it first
+func (s *service) deliverDelayed(api *tgbotapi.BotAPI, m scheduled.Message, r richReply) {
+	logger := s.logger.With().Str("childBotID", m.ChildBotID.Hex()).Logger()
+
+	timer := time.NewTimer(time.Until(m.SendAt))
+	defer timer.Stop()
+	ticker := time.NewTicker(typingEvery)
+	defer ticker.Stop()
+
+	for typing := true; typing; {
+		_, err := api.Send(tgbotapi.NewChatAction(m.TgChatID, tgbotapi.ChatTyping))
+		if err != nil {
+			logger.Warn().Err(err).Send()
+		}
+
+		select {
+		case <-timer.C:
+			typing = false
+		case <-ticker.C:
+		}
+	}
+
+	_, found, err := s.scheduledRepo.TakeByID(context.Background(), m.ID)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if !found {
+		return
+	}
+
+	err = s.sendRich(api, r)
+	if err != nil {
+		logger.Warn().Err(err).Send()
+	}
+}
+
+// autoReply restores the delayed autoreply, media and buttons are current ones of its rule or start message
+func autoReply(bot Bot, m scheduled.Message) richReply {
+	r := richReply{
+		chatID:  m.TgChatID,
+		replyTo: int(m.ReplyToMessageID),
+		text:    m.Text,
+	}
+
+	if m.Start {
+		r.media = bot.StartMedia
+		r.buttons = bot.StartButtons
+		r.menu = liveMenu(bot)
+		r.menuKeyboard = bot.MenuKeyboard
+		return r
+	}
+
+	if i, ok := findKeyword(bot, m.KeywordID); ok {
+		kw := bot.Keywords[i]
+		r.media = kw.Media
+		r.buttons = kw.Buttons
+		r.parseMode = kw.ParseMode
+		r.noPreview = kw.NoPreview
+	}
+	return r
+}
@@ -0,0 +1,46 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	d, err := parseDelay("2-5")
+	assert.NoError(t, err)
+	assert.Equal(t, DelayRange{Min: 2, Max: 5}, d)
+
+	d, err = parseDelay("3")
+	assert.NoError(t, err)
+	assert.Equal(t, DelayRange{Min: 3, Max: 3}, d)
+
+	d, err = parseDelay("0")
+	assert.NoError(t, err)
+	assert.Equal(t, DelayRange{}, d)
+
+	_, err = parseDelay("5-2")
+	assert.Error(t, err)
+	_, err = parseDelay("1-500")
+	assert.Error(t, err)
+	_, err = parseDelay("быстро")
+	assert.Error(t, err)
+}
+
+func TestRuleDelay(t *testing.T) {
+	bot := Bot{ReplyDelay: DelayRange{Min: 1, Max: 2}}
+	assert.Equal(t, bot.ReplyDelay, ruleDelay(bot, Keyword{}))
+	assert.Equal(t, DelayRange{}, ruleDelay(bot, Keyword{Delay: &DelayRange{}}))
+
+	cur := nextDelayPreset(nil)
+	for i := 1; i < len(delayPresets); i++ {
+		cur = nextDelayPreset(cur)
+	}
+	assert.Nil(t, cur)
+
+	for i := 0; i < 20; i++ {
+		delay, err := pickDelay(DelayRange{Min: 2, Max: 4})
+		assert.NoError(t, err)
+		assert.True(t, delay >= 2*time.Second && delay <= 4*time.Second)
+	}
+}
@@ -0,0 +1,214 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/user"
+	"strings"
+)
+
+const editedMark = "✏️ "
+
+// handleEdit handles an edited message. An operator edit of a reply is propagated to the peer, a peer edit is
+// checked against ban rules and updates the forwarded copies
+func (s *service) handleEdit(ctx context.Context, api *tgbotapi.BotAPI, msg message, bot Bot, owner user.User) error {
+	if msg.Chat.Type != chatPrivate {
+		return nil
+	}
+
+	if msg.From.ID == owner.TgUserID {
+		err := s.onOperatorEdit(ctx, api, msg, bot)
+		if err != nil {
+			return fmt.Errorf("s.onOperatorEdit: %w", err)
+		}
+		return nil
+	}
+
+	_, isOperator, err := s.operatorRepo.Get(ctx, bot.ID, msg.From.ID)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.Get: %w", err)
+	}
+	if isOperator {
+		err = s.onOperatorEdit(ctx, api, msg, bot)
+		if err != nil {
+			return fmt.Errorf("s.onOperatorEdit: %w", err)
+		}
+		return nil
+	}
+
+	err = s.onPeerEdit(ctx, api, msg, bot, owner)
+	if err != nil {
+		return fmt.Errorf("s.onPeerEdit: %w", err)
+	}
+	return nil
+}
+
+// onOperatorEdit edits the message which the reply was relayed to. Replies written in forum topics are not
+// tracked, so their edits stay in the topic
+func (s *service) onOperatorEdit(ctx context.Context, api *tgbotapi.BotAPI, msg message, bot Bot) error {
+	repl, relay, found, err := s.replyRepo.GetByRelay(ctx, bot.ID, msg.Chat.ID, msg.MessageID)
+	if err != nil {
+		return fmt.Errorf("s.replyRepo.GetByRelay: %w", err)
+	}
+	if !found {
+		return nil
+	}
+
+	_, err = api.Send(tgbotapi.NewEditMessageText(repl.TgChatID, int(relay.PeerMessageID), msg.Text))
+	if err != nil {
+		s.logger.Warn().Err(err).Str("childBotID", bot.ID.Hex()).Msg("edit of relayed reply failed")
+		e := s.replyErr(api, update{Message: msg}, "Не удалось изменить ответ у собеседника. Возможно он "+
+			"остановил бота или удалил сообщение")
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	s.logMessage(ctx, bot, msglog.Message{
+		ChildBotID: bot.ID,
+		TgUserID:   repl.TgUserID,
+		Author:     msglog.Operator,
+		Text:       editedMark + msg.Text,
+		Name:       tplName(msg.From.FirstName),
+	})
+	return nil
+}
+
+// onPeerEdit bans the peer if the new text matches a ban rule and updates the copies of the forwarded message.
+// Other autoreplies are not sent again
+func (s *service) onPeerEdit(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	msg message,
+	bot Bot,
+	owner user.User,
+) error {
+	p, _, err := s.peerRepo.Get(ctx, bot.ID, msg.From.ID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
+
+	d := decideEdit(bot, msg.Text, p.Muted)
+	if d.action == actIgnore {
+		return nil
+	}
+
+	s.logMessage(ctx, bot, msglog.Message{
+		ChildBotID: bot.ID,
+		TgUserID:   msg.From.ID,
+		Author:     msglog.Peer,
+		Text:       editedMark + msg.Text,
+		Rule:       d.rule,
+		Keyword:    d.keyword,
+	})
+
+	var banned bool
+	if d.action == actBan {
+		err = s.peerRepo.CreateMuted(ctx, bot.ID, msg.From.ID, msg.Chat.ID)
+		if err != nil {
+			return fmt.Errorf("s.peerRepo.CreateMuted: %w", err)
+		}
+		banned = true
+
+		if len(d.replies) != 0 {
+			vars := s.peerVars(api.Self.FirstName, msg.From, false)
+			vars.pm = d.parseMode
+			err = s.sendRich(api, richReply{
+				chatID:    msg.Chat.ID,
+				replyTo:   int(msg.MessageID),
+				text:      renderTemplate(s.pickReply(ctx, bot, d), vars),
+				media:     d.media,
+				buttons:   d.buttons,
+				parseMode: d.parseMode,
+				noPreview: d.noPreview,
+			})
+			if err != nil {
+				return fmt.Errorf("s.sendRich: %w", err)
+			}
+		}
+	}
+
+	repl, found, err := s.replyRepo.GetByMessage(ctx, bot.ID, msg.From.ID, msg.Chat.ID, msg.MessageID)
+	if err != nil {
+		return fmt.Errorf("s.replyRepo.GetByMessage: %w", err)
+	}
+	if !found {
+		return nil
+	}
+
+	text := tplForward(repl.ID, update{Message: msg}, p, "") + tplEdited(d, banned)
+	var edited int
+	for _, c := range repl.Copies {
+		var edit tgbotapi.EditMessageTextConfig
+		if c.TgChatID == bot.ForumChatID {
+			// a copy in the peer topic has no buttons, it is answered in the topic
+			if utf16Len(text+tplTopicHint()) > messageLimit {
+				continue
+			}
+			edit = tgbotapi.NewEditMessageText(c.TgChatID, int(c.TgMessageID), text+tplTopicHint())
+		} else {
+			if utf16Len(text+tplForwardHint()) > messageLimit {
+				continue
+			}
+			edit = tgbotapi.NewEditMessageText(c.TgChatID, int(c.TgMessageID), text+tplForwardHint())
+			markup := forwardMarkup(bot, p.TgUserID)
+			edit.ReplyMarkup = &markup
+		}
+		_, e := api.Send(edit)
+		if e != nil {
+			s.logger.Warn().Err(e).Int64("chatID", c.TgChatID).Msg("edit of forwarded copy failed")
+			continue
+		}
+		edited += 1
+	}
+	if edited != 0 {
+		return nil
+	}
+
+	if p.TgUserID == 0 {
+		p = peer.Peer{
+			ChildBotID: bot.ID,
+			TgUserID:   msg.From.ID,
+			TgChatID:   msg.Chat.ID,
+		}
+	}
+	_, err = s.forward(ctx, api, bot, owner, p, msg.From, text)
+	if err != nil {
+		return fmt.Errorf("s.forward: %w", err)
+	}
+	return nil
+}
+
+// decideEdit is the decision on an edited peer message. Only ban rules are matched, in every mode, as other
+// autoreplies are not sent again
+func decideEdit(bot Bot, text string, peerMuted bool) decision {
+	if bot.Mode == None || bot.Paused || peerMuted {
+		return decision{action: actIgnore}
+	}
+
+	lowText := strings.ToLower(text)
+	for i, kw := range bot.Keywords {
+		if !kw.Ban {
+			continue
+		}
+		for _, in := range kw.In {
+			if strings.Contains(lowText, in) {
+				return ruleDecision(bot, i, in)
+			}
+		}
+	}
+
+	return decision{action: actForward}
+}
+
+func tplEdited(d decision, banned bool) string {
+	if banned {
+		return fmt.Sprintf("\n\n%s(изменено) Сработало правило %d по слову '%s', собеседник забанен", editedMark,
+			d.rule, d.keyword)
+	}
+	return fmt.Sprintf("\n\n%s(изменено)", editedMark)
+}
@@ -0,0 +1,33 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTplEdited(t *testing.T) {
+	assert.Equal(t, "\n\n✏️ (изменено)", tplEdited(decision{action: actForward}, false))
+	assert.Equal(t, "\n\n✏️ (изменено) Сработало правило 2 по слову 'спам', собеседник забанен",
+		tplEdited(decision{action: actBan, rule: 2, keyword: "спам"}, true))
+}
+
+func TestDecideEdit(t *testing.T) {
+	bot := Bot{
+		Mode: OnlyFirst,
+		Keywords: []Keyword{
+			{In: []string{"реклама"}, Out: "Прайс"},
+			{In: []string{"казино"}, Out: "Бан", Ban: true},
+		},
+	}
+
+	d := decideEdit(bot, "Реклама казино", false)
+	assert.Equal(t, actBan, d.action)
+	assert.Equal(t, 2, d.rule)
+	assert.Equal(t, "казино", d.keyword)
+
+	assert.Equal(t, actForward, decideEdit(bot, "Реклама", false).action)
+	assert.Equal(t, actIgnore, decideEdit(bot, "казино", true).action)
+
+	bot.Paused = true
+	assert.Equal(t, actIgnore, decideEdit(bot, "казино", false).action)
+}
@@ -0,0 +1,415 @@
+package child_bot
+
+import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type parseMode uint8
+
+const (
+	ParsePlain parseMode = iota
+	ParseHTML
+	ParseMarkdown
+)
+
+// messageLimit is the Telegram limit of a message length in UTF-16 code units
+const messageLimit = 4096
+
+func (pm parseMode) tg() string {
+	switch pm {
+	case ParseHTML:
+		return tgbotapi.ModeHTML
+	case ParseMarkdown:
+		return "MarkdownV2"
+	default:
+		return ""
+	}
+}
+
+func (pm parseMode) String() string {
+	switch pm {
+	case ParseHTML:
+		return "HTML"
+	case ParseMarkdown:
+		return "Markdown"
+	default:
+		return "текст"
+	}
+}
+
+// Name is the parse mode in the config file
+func (pm parseMode) Name() string {
+	switch pm {
+	case ParseHTML:
+		return "html"
+	case ParseMarkdown:
+		return "markdown"
+	default:
+		return ""
+	}
+}
+
+func parseModeByName(name string) (parseMode, bool) {
+	switch strings.ToLower(name) {
+	case "":
+		return ParsePlain, true
+	case "html":
+		return ParseHTML, true
+	case "markdown":
+		return ParseMarkdown, true
+	default:
+		return ParsePlain, false
+	}
+}
+
+// escape makes a substituted value literal in the parse mode
+func (pm parseMode) escape(in string) string {
+	switch pm {
+	case ParseHTML:
+		return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(in)
+	case ParseMarkdown:
+		var sb strings.Builder
+		for _, r := range in {
+			if strings.ContainsRune(markdownReserved, r) {
+				sb.WriteByte('\\')
+			}
+			sb.WriteRune(r)
+		}
+		return sb.String()
+	default:
+		return in
+	}
+}
+
+// markdownReserved must be escaped with \ in MarkdownV2 outside of entities
+const markdownReserved = "_*[]()~`>#+-=|{}.!\\"
+
+// checkFormat reports broken markup, the error is ready to be shown to the user
+func checkFormat(in string, pm parseMode) error {
+	switch pm {
+	case ParseHTML:
+		return checkHTML(in)
+	case ParseMarkdown:
+		return checkMarkdown(in)
+	default:
+		return nil
+	}
+}
+
+var htmlTags = map[string]struct{}{
+	"b":          {},
+	"strong":     {},
+	"i":          {},
+	"em":         {},
+	"u":          {},
+	"ins":        {},
+	"s":          {},
+	"strike":     {},
+	"del":        {},
+	"a":          {},
+	"code":       {},
+	"pre":        {},
+	"tg-spoiler": {},
+	"span":       {},
+}
+
+var htmlEntities = map[string]struct{}{
+	"lt":   {},
+	"gt":   {},
+	"amp":  {},
+	"quot": {},
+}
+
+// checkHTML validates the subset of HTML supported by Telegram
+func checkHTML(in string) error {
+	var stack []string
+	for i := 0; i < len(in); i++ {
+		switch in[i] {
+		case '&':
+			j := strings.IndexByte(in[i:], ';')
+			if j < 0 {
+				return errors.New("символ & нужно писать как &amp;")
+			}
+			name := in[i+1 : i+j]
+			_, known := htmlEntities[name]
+			if !known && !isNumericEntity(name) {
+				return fmt.Errorf("неизвестная сущность &%s;, символ & нужно писать как &amp;", name)
+			}
+			i += j
+		case '>':
+			return errors.New("символ > нужно писать как &gt;")
+		case '<':
+			j := strings.IndexByte(in[i:], '>')
+			if j < 0 {
+				return errors.New("символ < нужно писать как &lt;")
+			}
+			tag := in[i+1 : i+j]
+			i += j
+
+			if strings.HasPrefix(tag, "/") {
+				name := strings.ToLower(strings.TrimSpace(tag[1:]))
+				if len(stack) == 0 || stack[len(stack)-1] != name {
+					return fmt.Errorf("лишний или не по порядку закрытый тег </%s>", name)
+				}
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			fields := strings.Fields(tag)
+			if len(fields) == 0 {
+				return errors.New("пустой тег <>")
+			}
+			name := strings.ToLower(fields[0])
+			if _, ok := htmlTags[name]; !ok {
+				return fmt.Errorf("тег <%s> не поддерживается Telegram", name)
+			}
+			if name == "a" && !strings.Contains(tag, "href=") {
+				return errors.New("у ссылки <a> нет href")
+			}
+			if name == "span" && !strings.Contains(tag, "tg-spoiler") {
+				return errors.New("тег <span> поддерживается только с class=\"tg-spoiler\"")
+			}
+			stack = append(stack, name)
+		}
+	}
+
+	if len(stack) != 0 {
+		return fmt.Errorf("не закрыт тег <%s>", stack[len(stack)-1])
+	}
+	return nil
+}
+
+func isNumericEntity(name string) bool {
+	if !strings.HasPrefix(name, "#") || len(name) < 2 {
+		return false
+	}
+
+	digits := name[1:]
+	hex := strings.HasPrefix(digits, "x")
+	if hex {
+		digits = digits[1:]
+	}
+	if digits == "" {
+		return false
+	}
+	for _, r := range strings.ToLower(digits) {
+		if !(r >= '0' && r <= '9' || hex && r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMarkdown validates MarkdownV2: entities are balanced and other reserved characters are escaped
+func checkMarkdown(in string) error {
+	var stack []string
+	push := func(m string) error {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i] != m {
+				continue
+			}
+			if i != len(stack)-1 {
+				return fmt.Errorf("разметка %s закрыта не по порядку", m)
+			}
+			stack = stack[:i]
+			return nil
+		}
+		stack = append(stack, m)
+		return nil
+	}
+
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(in) {
+				return errors.New("символ \\ в конце текста")
+			}
+			_, size := utf8.DecodeRuneInString(in[i+1:])
+			i += size
+		case strings.HasPrefix(in[i:], "```"):
+			j := strings.Index(in[i+3:], "```")
+			if j < 0 {
+				return errors.New("не закрыт блок ```")
+			}
+			i += j + 5
+		case c == '`':
+			j := strings.IndexByte(in[i+1:], '`')
+			if j < 0 {
+				return errors.New("не закрыт код `")
+			}
+			i += j + 1
+		case strings.HasPrefix(in[i:], "__"), strings.HasPrefix(in[i:], "||"):
+			err := push(in[i : i+2])
+			if err != nil {
+				return err
+			}
+			i++
+		case c == '*' || c == '_' || c == '~':
+			err := push(string(c))
+			if err != nil {
+				return err
+			}
+		case c == '[':
+			stack = append(stack, "[")
+		case c == ']':
+			if len(stack) == 0 || stack[len(stack)-1] != "[" {
+				return errors.New("лишняя скобка ], ее нужно экранировать \\]")
+			}
+			stack = stack[:len(stack)-1]
+			if i+1 >= len(in) || in[i+1] != '(' {
+				return errors.New("после [текста] ссылки нужен (адрес)")
+			}
+			j := strings.IndexByte(in[i+1:], ')')
+			if j < 0 {
+				return errors.New("не закрыт (адрес) ссылки")
+			}
+			i += j + 1
+		case strings.IndexByte(markdownReserved, c) >= 0:
+			return fmt.Errorf("символ %c нужно экранировать: \\%c", c, c)
+		}
+	}
+
+	if len(stack) != 0 {
+		return fmt.Errorf("не закрыта разметка %s", stack[len(stack)-1])
+	}
+	return nil
+}
+
+func utf16Len(in string) int {
+	var n int
+	for _, r := range in {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// splitText splits a text longer than limit UTF-16 code units by paragraphs, then by lines, then by characters
+func splitText(in string, limit int) []string {
+	if utf16Len(in) <= limit {
+		return []string{in}
+	}
+
+	var (
+		res []string
+		cur string
+	)
+	add := func(part, sep string) {
+		if cur == "" {
+			cur = part
+			return
+		}
+		if utf16Len(cur)+utf16Len(sep)+utf16Len(part) <= limit {
+			cur += sep + part
+			return
+		}
+		res = append(res, cur)
+		cur = part
+	}
+
+	for _, para := range strings.Split(in, "\n\n") {
+		if utf16Len(para) <= limit {
+			add(para, "\n\n")
+			continue
+		}
+
+		for _, line := range strings.Split(para, "\n") {
+			if utf16Len(line) <= limit {
+				add(line, "\n")
+				continue
+			}
+
+			var n int
+			var sb strings.Builder
+			for _, r := range line {
+				if n+utf16.RuneLen(r) > limit {
+					add(sb.String(), "")
+					sb.Reset()
+					n = 0
+				}
+				sb.WriteRune(r)
+				n += utf16.RuneLen(r)
+			}
+			add(sb.String(), "")
+		}
+	}
+	if cur != "" {
+		res = append(res, cur)
+	}
+	return res
+}
+
+// sendFormatted sends a formatted reply split into parts if it is too long. A part whose markup the split cut, or
+// which Telegram rejects, e.g. a substituted value broke it, is sent as is, so parts already sent are not repeated
+func (s *service) sendFormatted(api *tgbotapi.BotAPI, msg tgbotapi.MessageConfig, pm parseMode) error {
+	parts := splitText(msg.Text, messageLimit)
+	for i := range parts {
+		m := partOf(msg, parts, i)
+		if pm != ParsePlain && checkFormat(m.Text, pm) == nil {
+			m.ParseMode = pm.tg()
+			_, err := api.Send(m)
+			if err == nil {
+				continue
+			}
+
+			s.logger.Warn().Err(err).Msg("formatted reply rejected, sending as is")
+			m.ParseMode = ""
+		}
+
+		_, err := api.Send(m)
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+	}
+	return nil
+}
+
+// sendText sends the message split into parts if it is too long
+func sendText(api *tgbotapi.BotAPI, msg tgbotapi.MessageConfig) error {
+	parts := splitText(msg.Text, messageLimit)
+	for i := range parts {
+		_, err := api.Send(partOf(msg, parts, i))
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+	}
+	return nil
+}
+
+// partOf is the i-th part of the message, only the first part replies to a message and only the last one has
+// the keyboard
+func partOf(msg tgbotapi.MessageConfig, parts []string, i int) tgbotapi.MessageConfig {
+	msg.Text = parts[i]
+	if i != 0 {
+		msg.ReplyToMessageID = 0
+	}
+	if i != len(parts)-1 {
+		msg.ReplyMarkup = nil
+	}
+	return msg
+}
+
+// splitForward keeps the first line of a forward, which identifies the dialog, on every part so any part can be
+// replied to
+func splitForward(text string) []string {
+	if utf16Len(text) <= messageLimit {
+		return []string{text}
+	}
+
+	header := text
+	body := ""
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		header, body = text[:i], text[i+1:]
+	}
+
+	parts := splitText(body, messageLimit-utf16Len(header)-1)
+	for i := range parts {
+		parts[i] = header + "\n" + parts[i]
+	}
+	return parts
+}
@@ -0,0 +1,81 @@
+package child_bot
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCheckFormat(t *testing.T) {
+	assert.NoError(t, checkFormat(`<b>Прайс</b>: 100 &lt;руб&gt; <a href="https://t.me">канал</a>`, ParseHTML))
+	assert.Error(t, checkFormat("<b>Прайс", ParseHTML))
+	assert.Error(t, checkFormat("<b><i>Прайс</b></i>", ParseHTML))
+	assert.Error(t, checkFormat("<div>Прайс</div>", ParseHTML))
+	assert.Error(t, checkFormat("1 < 2", ParseHTML))
+	assert.Error(t, checkFormat("A & B", ParseHTML))
+
+	assert.NoError(t, checkFormat("*Прайс*: 100 руб\\. [канал](https://t.me/x) `a.b`", ParseMarkdown))
+	assert.Error(t, checkFormat("*Прайс", ParseMarkdown))
+	assert.Error(t, checkFormat("100 руб.", ParseMarkdown))
+	assert.Error(t, checkFormat("*_Прайс*_", ParseMarkdown))
+	assert.Error(t, checkFormat("[канал]", ParseMarkdown))
+
+	assert.NoError(t, checkFormat("1 < 2.", ParsePlain))
+}
+
+func TestTemplateEscape(t *testing.T) {
+	v := tplVars{
+		firstName: "<Аня>",
+		pm:        ParseHTML,
+	}
+	assert.Equal(t, "<b>&lt;Аня&gt;</b>", renderTemplate("<b>{first_name}</b>", v))
+
+	v.firstName = "a.b"
+	v.pm = ParseMarkdown
+	assert.Equal(t, "*a\\.b*", renderTemplate("*{first_name}*", v))
+
+	assert.Error(t, checkTemplate("<b>{first_name}", 0, ParseHTML))
+	assert.NoError(t, checkTemplate("{if new}<b>Привет</b>{else}Снова{end}", 0, ParseHTML))
+}
+
+func TestSplitText(t *testing.T) {
+	para := strings.Repeat("а", 30)
+	text := strings.Join([]string{para, para, para}, "\n\n")
+
+	parts := splitText(text, 70)
+	assert.Equal(t, []string{para + "\n\n" + para, para}, parts)
+
+	parts = splitText(strings.Repeat("😀", 50), 40)
+	assert.Len(t, parts, 3)
+	for _, p := range parts {
+		assert.LessOrEqual(t, utf16Len(p), 40)
+	}
+
+	assert.Equal(t, []string{"short"}, splitText("short", 70))
+}
+
+func TestPartOf(t *testing.T) {
+	msg := tgbotapi.NewMessage(1, "")
+	msg.ReplyToMessageID = 2
+	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+	parts := []string{"a", "b"}
+
+	first := partOf(msg, parts, 0)
+	assert.Equal(t, "a", first.Text)
+	assert.Equal(t, 2, first.ReplyToMessageID)
+	assert.Nil(t, first.ReplyMarkup)
+
+	last := partOf(msg, parts, 1)
+	assert.Equal(t, "b", last.Text)
+	assert.Zero(t, last.ReplyToMessageID)
+	assert.NotNil(t, last.ReplyMarkup)
+}
+
+func TestSplitForward(t *testing.T) {
+	text := messageForward + "id\n" + strings.Repeat(strings.Repeat("б", 1000)+"\n\n", 6)
+	for _, p := range splitForward(text) {
+		assert.True(t, strings.HasPrefix(p, messageForward+"id\n"))
+		assert.LessOrEqual(t, utf16Len(p), messageLimit)
+	}
+}
@@ -0,0 +1,264 @@
+package child_bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/reply"
+	"github.com/vahter-robot/backend/pkg/user"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const topicNameLimitChars = 128
+
+// handleGroup handles messages in groups. The owner attaches a forum with /attach_group, after that
+// messages of the owner and operators in a peer topic are relayed to the peer
+func (s *service) handleGroup(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	if upd.Message.From.IsBot || upd.Message.Text == "" {
+		return nil
+	}
+
+	text := strings.TrimSuffix(upd.Message.Text, "@"+api.Self.UserName)
+	switch text {
+	case attachGroup:
+		if upd.Message.From.ID != owner.TgUserID {
+			return nil
+		}
+
+		if !upd.Message.Chat.IsForum {
+			err := s.replyErr(api, upd, "В группе не включены темы. Включите их в настройках группы и "+
+				"повторите команду")
+			if err != nil {
+				return fmt.Errorf("s.replyErr: %w", err)
+			}
+			return nil
+		}
+
+		err := s.childBotRepo.SetForumChatID(ctx, bot.ID, upd.Message.Chat.ID)
+		if err != nil {
+			return fmt.Errorf("s.childBotRepo.SetForumChatID: %w", err)
+		}
+
+		err = s.peerRepo.UnsetTopicIDs(ctx, bot.ID)
+		if err != nil {
+			return fmt.Errorf("s.peerRepo.UnsetTopicIDs: %w", err)
+		}
+
+		err = s.replyOK(api, upd, "Группа подключена. Для каждого собеседника бот создаст тему, всё что вы "+
+			"напишете в ней, бот отправит собеседнику. Бот должен быть администратором с правом управлять темами")
+		if err != nil {
+			return fmt.Errorf("s.replyOK: %w", err)
+		}
+		return nil
+	case detachGroup:
+		if upd.Message.From.ID != owner.TgUserID || upd.Message.Chat.ID != bot.ForumChatID {
+			return nil
+		}
+
+		err := s.childBotRepo.SetForumChatID(ctx, bot.ID, 0)
+		if err != nil {
+			return fmt.Errorf("s.childBotRepo.SetForumChatID: %w", err)
+		}
+
+		err = s.replyOK(api, upd, "Группа отключена, сообщения снова пересылаются в личные сообщения")
+		if err != nil {
+			return fmt.Errorf("s.replyOK: %w", err)
+		}
+		return nil
+	}
+
+	if upd.Message.Chat.ID != bot.ForumChatID || !upd.Message.IsTopicMessage || upd.Message.MessageThreadID == 0 {
+		return nil
+	}
+
+	// other members of the group do not reply to peers
+	if upd.Message.From.ID != owner.TgUserID {
+		_, isOperator, err := s.operatorRepo.Get(ctx, bot.ID, upd.Message.From.ID)
+		if err != nil {
+			return fmt.Errorf("s.operatorRepo.Get: %w", err)
+		}
+		if !isOperator {
+			return nil
+		}
+	}
+
+	p, found, err := s.peerRepo.GetByTopicID(ctx, bot.ID, upd.Message.MessageThreadID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.GetByTopicID: %w", err)
+	}
+	if !found {
+		return nil
+	}
+
+	switch text {
+	case mute:
+		e := s.peerRepo.CreateMuted(ctx, bot.ID, p.TgUserID, p.TgChatID)
+		if e != nil {
+			return fmt.Errorf("s.peerRepo.CreateMuted: %w", e)
+		}
+
+		e = s.replyOK(api, upd, "Заблокирован")
+		if e != nil {
+			return fmt.Errorf("s.replyOK: %w", e)
+		}
+		return nil
+	case unmute:
+		e := s.peerRepo.CreateUnMuted(ctx, bot.ID, p.TgUserID, p.TgChatID, expireAt(s.peersDays(bot)))
+		if e != nil {
+			return fmt.Errorf("s.peerRepo.CreateUnMuted: %w", e)
+		}
+
+		e = s.replyOK(api, upd, "Разблокирован")
+		if e != nil {
+			return fmt.Errorf("s.replyOK: %w", e)
+		}
+		return nil
+	}
+
+	if isLater(upd.Message.Text) {
+		err = s.scheduleReply(ctx, api, upd, bot, p.TgUserID, p.TgChatID, 0)
+		if err != nil {
+			return fmt.Errorf("s.scheduleReply: %w", err)
+		}
+		return nil
+	}
+
+	text, ok, err := s.expandSnippet(api, upd, bot, upd.Message.Text, p.TgChatID)
+	if err != nil {
+		return fmt.Errorf("s.expandSnippet: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	_, err = api.Send(tgbotapi.NewMessage(p.TgChatID, text))
+	if err != nil {
+		e := s.replyErr(api, upd, tplSendFailed(p))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	s.logMessage(ctx, bot, msglog.Message{
+		ChildBotID: bot.ID,
+		TgUserID:   p.TgUserID,
+		Author:     msglog.Operator,
+		Text:       text,
+		Name:       tplName(upd.Message.From.FirstName),
+	})
+
+	return nil
+}
+
+// forwardToTopic posts the text into the peer topic, creating the topic on first use or when it was deleted. A
+// text sent as one message is returned as a copy, so an edit of the peer message updates it
+func (s *service) forwardToTopic(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	bot Bot,
+	p peer.Peer,
+	f from,
+	text string,
+) ([]reply.Copy, error) {
+	topicID := p.TopicID
+	for attempt := 0; attempt < 2; attempt++ {
+		if topicID == 0 {
+			id, err := createTopic(api, bot.ForumChatID, tplTopicName(f))
+			if err != nil {
+				return nil, fmt.Errorf("createTopic: %w", err)
+			}
+
+			err = s.peerRepo.SetTopicID(ctx, bot.ID, p.TgUserID, id)
+			if err != nil {
+				return nil, fmt.Errorf("s.peerRepo.SetTopicID: %w", err)
+			}
+			topicID = id
+		}
+
+		msgIDs, err := sendToTopic(api, bot.ForumChatID, topicID, text)
+		if err == nil {
+			if len(msgIDs) != 1 {
+				return nil, nil
+			}
+			return []reply.Copy{{
+				TgChatID:    bot.ForumChatID,
+				TgMessageID: msgIDs[0],
+			}}, nil
+		}
+		if !isTopicGone(err) {
+			return nil, fmt.Errorf("sendToTopic: %w", err)
+		}
+		topicID = 0
+	}
+
+	return nil, fmt.Errorf("topic of peer %d is not available", p.TgUserID)
+}
+
+func createTopic(api *tgbotapi.BotAPI, chatID int64, name string) (int64, error) {
+	resp, err := api.MakeRequest("createForumTopic", url.Values{
+		"chat_id": {strconv.FormatInt(chatID, 10)},
+		"name":    {name},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("api.MakeRequest: %w", err)
+	}
+
+	var topic struct {
+		MessageThreadID int64 `json:"message_thread_id"`
+	}
+	err = json.Unmarshal(resp.Result, &topic)
+	if err != nil {
+		return 0, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	return topic.MessageThreadID, nil
+}
+
+// sendToTopic returns IDs of the sent messages, one per part of the text
+func sendToTopic(api *tgbotapi.BotAPI, chatID, topicID int64, text string) ([]int64, error) {
+	var res []int64
+	for _, part := range splitText(text, messageLimit) {
+		resp, err := api.MakeRequest("sendMessage", url.Values{
+			"chat_id":           {strconv.FormatInt(chatID, 10)},
+			"message_thread_id": {strconv.FormatInt(topicID, 10)},
+			"text":              {part},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("api.MakeRequest: %w", err)
+		}
+
+		var msg tgbotapi.Message
+		err = json.Unmarshal(resp.Result, &msg)
+		if err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		res = append(res, int64(msg.MessageID))
+	}
+
+	return res, nil
+}
+
+func isTopicGone(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "thread not found") || strings.Contains(msg, "topic_deleted") ||
+		strings.Contains(msg, "topic_closed")
+}
+
+func tplTopicName(f from) string {
+	name := tplName(f.FirstName)
+	if f.Username != "" {
+		name += " (@" + f.Username + ")"
+	}
+
+	if utf8.RuneCountInString(name) > topicNameLimitChars {
+		name = string([]rune(name)[:topicNameLimitChars])
+	}
+	return name
+}
@@ -0,0 +1,326 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/user"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	historyPageSize    = 10
+	searchLimit        = 20
+	logPreviewChars    = 300
+	historyCallbackTag = "h"
+	callbackDelim      = "|"
+)
+
+// logMessage records a message of the conversation. The log is auxiliary, so errors are only logged
+func (s *service) logMessage(ctx context.Context, bot Bot, msg msglog.Message) {
+	msg.ExpireAt = expireAt(s.messagesDays(bot))
+	err := s.msglogRepo.Create(ctx, msg)
+	if err != nil {
+		s.logger.Error().Err(err).Str("childBotID", msg.ChildBotID.Hex()).Send()
+	}
+}
+
+func (s *service) handleOwnerHistory(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	tgUserID int64,
+) error {
+	text, markup, err := s.historyPage(ctx, bot, tgUserID, 0)
+	if err != nil {
+		return fmt.Errorf("s.historyPage: %w", err)
+	}
+
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, text)
+	msg.ReplyToMessageID = int(upd.Message.MessageID)
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerSearch(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	query := strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, search))
+	if query == "" {
+		err := s.replyErr(api, upd, fmt.Sprintf("Укажите текст для поиска, например: %s реклама", search))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	msgs, err := s.msglogRepo.Search(ctx, bot.ID, query, searchLimit)
+	if err != nil {
+		return fmt.Errorf("s.msglogRepo.Search: %w", err)
+	}
+
+	if len(msgs) == 0 {
+		err = s.reply(api, upd, "Ничего не найдено")
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	text := fmt.Sprintf("Найдено сообщений: %d. Время UTC. Историю переписки покажет команда %s ID_собеседника",
+		len(msgs), history)
+	for _, msg := range msgs {
+		text += fmt.Sprintf(`
+
+Собеседник %d
+%s`, msg.TgUserID, tplLogMessage(msg))
+	}
+
+	err = s.reply(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+// handleCallback handles inline buttons of owner and operators messages and buttons under autoreplies
+func (s *service) handleCallback(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	cb := upd.CallbackQuery
+
+	usr := owner
+	role := operator.Admin
+	allowed := cb.From.ID == owner.TgUserID
+	if !allowed {
+		op, isOperator, err := s.operatorRepo.Get(ctx, bot.ID, cb.From.ID)
+		if err != nil {
+			return fmt.Errorf("s.operatorRepo.Get: %w", err)
+		}
+		allowed = isOperator
+		role = op.Role
+	}
+
+	_, err := api.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, ""))
+	if err != nil {
+		s.logger.Warn().Err(err).Send()
+	}
+	if strings.HasPrefix(cb.Data, peerCallbackTag+callbackDelim) {
+		if allowed {
+			return nil
+		}
+
+		// a button under an autoreply works as if the peer wrote its text
+		err = s.handlePeer(ctx, api, update{
+			Message: message{
+				MessageID: cb.Message.MessageID,
+				Chat:      cb.Message.Chat,
+				From:      cb.From,
+				Text:      strings.TrimPrefix(cb.Data, peerCallbackTag+callbackDelim),
+			},
+		}, bot, owner)
+		if err != nil {
+			return fmt.Errorf("s.handlePeer: %w", err)
+		}
+		return nil
+	}
+	if strings.HasPrefix(cb.Data, menuCallbackTag+callbackDelim) {
+		if allowed {
+			return nil
+		}
+
+		err = s.handleMenuCallback(ctx, api, cb, bot, owner)
+		if err != nil {
+			return fmt.Errorf("s.handleMenuCallback: %w", err)
+		}
+		return nil
+	}
+	if !allowed {
+		return nil
+	}
+
+	if strings.HasPrefix(cb.Data, broadcastCallbackTag+callbackDelim) {
+		if role != operator.Admin {
+			return nil
+		}
+
+		err = s.handleBroadcastCallback(ctx, api, cb, bot)
+		if err != nil {
+			return fmt.Errorf("s.handleBroadcastCallback: %w", err)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(cb.Data, laterCallbackTag+callbackDelim) {
+		err = s.handleLaterCallback(ctx, api, cb, bot, role)
+		if err != nil {
+			return fmt.Errorf("s.handleLaterCallback: %w", err)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(cb.Data, cardCallbackTag+callbackDelim) {
+		err = s.handleCardCallback(ctx, api, cb, bot)
+		if err != nil {
+			return fmt.Errorf("s.handleCardCallback: %w", err)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(cb.Data, snippetsCallbackTag+callbackDelim) {
+		if cb.From.ID != owner.TgUserID {
+			usr, err = s.userRepo.Create(ctx, cb.From.ID, cb.Message.Chat.ID)
+			if err != nil {
+				return fmt.Errorf("s.userRepo.Create: %w", err)
+			}
+		}
+
+		err = s.handleSnippetCallback(ctx, api, cb, bot, usr, role)
+		if err != nil {
+			return fmt.Errorf("s.handleSnippetCallback: %w", err)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(cb.Data, rulesCallbackTag+callbackDelim) {
+		if role != operator.Admin {
+			return nil
+		}
+
+		if cb.From.ID != owner.TgUserID {
+			usr, err = s.userRepo.Create(ctx, cb.From.ID, cb.Message.Chat.ID)
+			if err != nil {
+				return fmt.Errorf("s.userRepo.Create: %w", err)
+			}
+		}
+
+		err = s.handleRulesCallback(ctx, api, cb, bot, usr)
+		if err != nil {
+			return fmt.Errorf("s.handleRulesCallback: %w", err)
+		}
+		return nil
+	}
+
+	tgUserID, page, ok := parseHistoryCallback(cb.Data)
+	if !ok {
+		return nil
+	}
+
+	text, markup, err := s.historyPage(ctx, bot, tgUserID, page)
+	if err != nil {
+		return fmt.Errorf("s.historyPage: %w", err)
+	}
+
+	edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, int(cb.Message.MessageID), text)
+	edit.ReplyMarkup = markup
+	_, err = api.Send(edit)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) historyPage(
+	ctx context.Context,
+	bot Bot,
+	tgUserID int64,
+	page int64,
+) (
+	string,
+	*tgbotapi.InlineKeyboardMarkup,
+	error,
+) {
+	msgs, more, err := s.msglogRepo.GetByPeer(ctx, bot.ID, tgUserID, page*historyPageSize, historyPageSize)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.msglogRepo.GetByPeer: %w", err)
+	}
+
+	text := fmt.Sprintf("История переписки с собеседником %d, страница %d. Время UTC", tgUserID, page+1)
+	if len(msgs) == 0 {
+		text += "\n\nСообщений нет"
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		text += "\n\n" + tplLogMessage(msgs[i])
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	if more {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("⬅️ Раньше", historyCallback(tgUserID, page+1)))
+	}
+	if page > 0 {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("Позже ➡️", historyCallback(tgUserID, page-1)))
+	}
+	if len(row) == 0 {
+		return text, nil, nil
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(row)
+	return text, &markup, nil
+}
+
+func historyCallback(tgUserID, page int64) string {
+	return strings.Join([]string{
+		historyCallbackTag,
+		strconv.FormatInt(tgUserID, 10),
+		strconv.FormatInt(page, 10),
+	}, callbackDelim)
+}
+
+func parseHistoryCallback(data string) (int64, int64, bool) {
+	parts := strings.Split(data, callbackDelim)
+	if len(parts) != 3 || parts[0] != historyCallbackTag {
+		return 0, 0, false
+	}
+
+	tgUserID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	page, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || page < 0 {
+		return 0, 0, false
+	}
+
+	return tgUserID, page, true
+}
+
+func tplLogMessage(msg msglog.Message) string {
+	var author string
+	switch msg.Author {
+	case msglog.Peer:
+		author = "Собеседник"
+	case msglog.Bot:
+		author = "Бот"
+		if msg.Rule != 0 {
+			author += fmt.Sprintf(" (правило %d, '%s')", msg.Rule, msg.Keyword)
+		}
+	case msglog.Operator:
+		author = "Ответ " + tplName(msg.Name)
+	}
+
+	text := msg.Text
+	if utf8.RuneCountInString(text) > logPreviewChars {
+		text = string([]rune(text)[:logPreviewChars]) + "…"
+	}
+
+	return fmt.Sprintf(`%s %s:
+%s`, msg.CreatedAt.UTC().Format("02.01.2006 15:04"), author, text)
+}
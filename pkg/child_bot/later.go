@@ -0,0 +1,364 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/broadcast"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/scheduled"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	laterCallbackTag  = "l"
+	laterListLimit    = 20
+	laterLeaderTask   = "scheduled"
+	laterLease        = time.Minute
+	laterPoll         = 15 * time.Second
+	laterTimeLayout   = "02.01 15:04"
+	laterPreviewChars = 50
+)
+
+// isLater reports whether the owner reply is a /later command
+func isLater(text string) bool {
+	return text == later || strings.HasPrefix(text, later+" ") || strings.HasPrefix(text, later+"\n")
+}
+
+// cutToken splits off the first word of the text, keeping line breaks of the rest
+func cutToken(in string) (string, string) {
+	in = strings.TrimLeft(in, " \n")
+	i := strings.IndexAny(in, " \n")
+	if i < 0 {
+		return in, ""
+	}
+	return in[:i], strings.TrimSpace(in[i:])
+}
+
+// parseWhen parses '9:00' as the nearest such time and '25.12 9:00' as the nearest such date, both in the
+// location of now. It returns the rest of the text. The error is ready to be shown to the user
+func parseWhen(in string, now time.Time) (time.Time, string, error) {
+	tok, rest := cutToken(in)
+
+	var day time.Time
+	if strings.Contains(tok, ".") {
+		d, err := time.ParseInLocation("2.1", tok, now.Location())
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("дата '%s' должна быть вида 25.12", tok)
+		}
+		day = time.Date(now.Year(), d.Month(), d.Day(), 0, 0, 0, 0, now.Location())
+		if d.Day() != day.Day() {
+			return time.Time{}, "", fmt.Errorf("нет такой даты '%s'", tok)
+		}
+		tok, rest = cutToken(rest)
+	}
+
+	t, err := time.ParseInLocation("15:04", tok, now.Location())
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("время '%s' должно быть вида 9:00", tok)
+	}
+
+	if day.IsZero() {
+		at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, rest, nil
+	}
+
+	at := day.Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+	if !at.After(now) {
+		at = at.AddDate(1, 0, 0)
+	}
+	return at, rest, nil
+}
+
+// scheduleReply stores the /later reply to the peer, a single #Name is sent as the snippet
+func (s *service) scheduleReply(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	tgUserID,
+	tgChatID,
+	replyTo int64,
+) error {
+	at, text, err := parseWhen(strings.TrimPrefix(upd.Message.Text, later), time.Now().In(s.location))
+	if err == nil && text == "" {
+		err = errors.New("нет текста ответа")
+	}
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Не запланировано: %s. Например: %s 9:00 текст ответа или %s "+
+			"25.12 9:00 текст ответа", err, later, later))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	text, ok, err := s.expandSnippet(api, upd, bot, text, tgChatID)
+	if err != nil {
+		return fmt.Errorf("s.expandSnippet: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	err = s.scheduledRepo.Create(ctx, scheduled.Message{
+		ChildBotID:       bot.ID,
+		UserID:           bot.OwnerUserID,
+		AuthorID:         upd.Message.From.ID,
+		AuthorChatID:     upd.Message.Chat.ID,
+		AuthorName:       tplName(upd.Message.From.FirstName),
+		TgUserID:         tgUserID,
+		TgChatID:         tgChatID,
+		ReplyToMessageID: replyTo,
+		Text:             text,
+		SendAt:           at.UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("s.scheduledRepo.Create: %w", err)
+	}
+
+	err = s.replyOK(api, upd, fmt.Sprintf("Ответ будет отправлен %s. Отменить: %s", at.Format(laterTimeLayout),
+		scheduledList))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
+// handleOwnerScheduled lists what is scheduled in the bot, or only replies of the agent
+func (s *service) handleOwnerScheduled(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	role operator.Role,
+) error {
+	text, markup, err := s.scheduledPage(ctx, bot, scheduledAuthor(role, upd.Message.From.ID))
+	if err != nil {
+		return fmt.Errorf("s.scheduledPage: %w", err)
+	}
+
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, text)
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+// scheduledAuthor is the author whose replies the operator may see and cancel, zero for all
+func scheduledAuthor(role operator.Role, tgUserID int64) int64 {
+	if role == operator.Agent {
+		return tgUserID
+	}
+	return 0
+}
+
+// scheduledPage lists pending replies and a scheduled broadcast, each with a cancel button. If authorID is not
+// zero, only replies of the author are listed
+func (s *service) scheduledPage(
+	ctx context.Context,
+	bot Bot,
+	authorID int64,
+) (
+	string,
+	*tgbotapi.InlineKeyboardMarkup,
+	error,
+) {
+	msgs, err := s.scheduledRepo.GetByChildBotID(ctx, bot.ID, authorID, laterListLimit)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.scheduledRepo.GetByChildBotID: %w", err)
+	}
+
+	var b broadcast.Broadcast
+	var found bool
+	if authorID == 0 {
+		b, found, err = s.broadcastRepo.GetRunning(ctx, bot.ID)
+		if err != nil {
+			return "", nil, fmt.Errorf("s.broadcastRepo.GetRunning: %w", err)
+		}
+	}
+
+	var lines []string
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if found && b.StartAt.After(time.Now()) {
+		lines = append(lines, fmt.Sprintf("Рассылка %s (%s): %s", b.StartAt.In(s.location).Format(laterTimeLayout),
+			tplBroadcastFilter(b), preview(b.Text)))
+		rows = append(rows, broadcastMarkup(b.ID, broadcastStop).InlineKeyboard...)
+	}
+	for i, m := range msgs {
+		lines = append(lines, fmt.Sprintf("%d. %s, собеседнику %d, от %s: %s", i+1,
+			m.SendAt.In(s.location).Format(laterTimeLayout), m.TgUserID, m.AuthorName, preview(m.Text)))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("❌ %d", i+1), laterCallbackTag+callbackDelim+m.ID.Hex())))
+	}
+
+	if len(lines) == 0 {
+		return fmt.Sprintf("Запланированных сообщений нет. Чтобы отправить ответ позже, 'ответьте' на пересланное "+
+			"сообщение: %s 9:00 текст ответа", later), nil, nil
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return "Запланировано:\n\n" + strings.Join(lines, "\n"), &markup, nil
+}
+
+func preview(in string) string {
+	in = strings.ReplaceAll(in, "\n", " ")
+	if utf8.RuneCountInString(in) <= laterPreviewChars {
+		return in
+	}
+	return string([]rune(in)[:laterPreviewChars]) + "…"
+}
+
+// handleLaterCallback cancels the reply, an agent cancels only own replies
+func (s *service) handleLaterCallback(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	cb callbackQuery,
+	bot Bot,
+	role operator.Role,
+) error {
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(cb.Data, laterCallbackTag+callbackDelim))
+	if err != nil {
+		return nil
+	}
+
+	authorID := scheduledAuthor(role, cb.From.ID)
+	_, err = s.scheduledRepo.Delete(ctx, bot.ID, authorID, id)
+	if err != nil {
+		return fmt.Errorf("s.scheduledRepo.Delete: %w", err)
+	}
+
+	text, markup, err := s.scheduledPage(ctx, bot, authorID)
+	if err != nil {
+		return fmt.Errorf("s.scheduledPage: %w", err)
+	}
+
+	edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, int(cb.Message.MessageID), text)
+	edit.ReplyMarkup = markup
+	_, err = api.Send(edit)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+// serveScheduled sends due replies. Only the elected instance polls, the others wait for its lease to end
+func (s *service) serveScheduled(ctx context.Context) {
+	ticker := time.NewTicker(laterPoll)
+	defer ticker.Stop()
+
+	for {
+		leader, err := s.leaderRepo.Acquire(ctx, laterLeaderTask, s.instanceID, laterLease)
+		if err != nil {
+			s.logger.Error().Err(err).Send()
+		}
+
+		for leader && ctx.Err() == nil {
+			m, found, e := s.scheduledRepo.TakeDue(ctx)
+			if e != nil {
+				s.logger.Error().Err(e).Send()
+				break
+			}
+			if !found {
+				break
+			}
+
+			s.sendScheduled(ctx, m)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) sendScheduled(ctx context.Context, m scheduled.Message) {
+	logger := s.logger.With().Str("childBotID", m.ChildBotID.Hex()).Logger()
+
+	bot, found, err := s.childBotRepo.GetByIDAnyOwner(ctx, m.ChildBotID)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if !found {
+		s.notifyUnsent(m, "бот удален")
+		return
+	}
+
+	api, err := tgbotapi.NewBotAPI(bot.Token)
+	if err != nil {
+		logger.Warn().Err(err).Send()
+		s.markTokenFailed(ctx, bot, err)
+		s.notifyUnsent(m, "токен бота недействителен")
+		return
+	}
+
+	if m.Auto {
+		// the delayed autoreply was taken over after a restart, it is already logged
+		err = s.sendRich(api, autoReply(bot, m))
+		if err != nil {
+			logger.Warn().Err(err).Send()
+		}
+		return
+	}
+
+	_, err = api.Send(tgbotapi.MessageConfig{
+		BaseChat: tgbotapi.BaseChat{
+			ChatID:           m.TgChatID,
+			ReplyToMessageID: int(m.ReplyToMessageID),
+		},
+		Text: m.Text,
+	})
+	if err != nil {
+		logger.Warn().Err(err).Send()
+
+		p, _, e := s.peerRepo.Get(ctx, bot.ID, m.TgUserID)
+		if e != nil {
+			logger.Error().Err(e).Send()
+			p = peer.Peer{}
+		}
+		_, e = api.Send(tgbotapi.NewMessage(m.AuthorChatID, fmt.Sprintf("Отложенный ответ собеседнику %d: %s\n\n%s",
+			m.TgUserID, tplSendFailed(p), m.Text)))
+		if e != nil {
+			logger.Warn().Err(e).Send()
+		}
+		return
+	}
+
+	s.logMessage(ctx, bot, msglog.Message{
+		ChildBotID: bot.ID,
+		TgUserID:   m.TgUserID,
+		Author:     msglog.Operator,
+		Text:       m.Text,
+		Name:       m.AuthorName,
+	})
+}
+
+// notifyUnsent tells the author through the parent bot that the taken reply is dropped, as the child bot can not
+// send it. Delayed autoreplies have no author
+func (s *service) notifyUnsent(m scheduled.Message, reason string) {
+	if m.Auto || m.AuthorChatID == 0 {
+		return
+	}
+
+	_, err := s.parentBot.Send(tgbotapi.NewMessage(m.AuthorChatID, fmt.Sprintf(
+		"Отложенный ответ собеседнику %d не отправлен: %s\n\n%s", m.TgUserID, reason, m.Text)))
+	if err != nil {
+		s.logger.Warn().Err(err).Str("childBotID", m.ChildBotID.Hex()).Send()
+	}
+}
@@ -0,0 +1,41 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"testing"
+	"time"
+)
+
+func TestParseWhen(t *testing.T) {
+	loc := time.FixedZone("MSK", 3*60*60)
+	now := time.Date(2024, 12, 20, 10, 30, 0, 0, loc)
+
+	at, rest, err := parseWhen(" 9:00 Доброе утро!\nЦены ниже", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 12, 21, 9, 0, 0, 0, loc), at)
+	assert.Equal(t, "Доброе утро!\nЦены ниже", rest)
+
+	at, _, err = parseWhen("18:15 текст", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 12, 20, 18, 15, 0, 0, loc), at)
+
+	at, rest, err = parseWhen("5.01 9:00", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 1, 5, 9, 0, 0, 0, loc), at)
+	assert.Equal(t, "", rest)
+
+	_, _, err = parseWhen("31.02 9:00 текст", now)
+	assert.Error(t, err)
+
+	_, _, err = parseWhen("завтра текст", now)
+	assert.Error(t, err)
+
+	assert.True(t, isLater(later+" 9:00 текст"))
+	assert.False(t, isLater(later+"x"))
+}
+
+func TestScheduledAuthor(t *testing.T) {
+	assert.Equal(t, int64(0), scheduledAuthor(operator.Admin, 42))
+	assert.Equal(t, int64(42), scheduledAuthor(operator.Agent, 42))
+}
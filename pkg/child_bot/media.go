@@ -0,0 +1,400 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	"strings"
+	"unicode/utf8"
+)
+
+type mediaKind uint8
+
+const (
+	MediaPhoto mediaKind = iota + 1
+	MediaDocument
+	MediaVideo
+)
+
+// Media is a file already uploaded to Telegram, it is sent by file_id
+type Media struct {
+	Kind   mediaKind `bson:"k,omitempty"`
+	FileID string    `bson:"f,omitempty"`
+}
+
+// Button is an inline button under a reply. A button without URL sends Data through the rules as if the peer
+// wrote it
+type Button struct {
+	Text string `bson:"t,omitempty"`
+	URL  string `bson:"u,omitempty"`
+	Data string `bson:"d,omitempty"`
+}
+
+const (
+	// captionLimit is the Telegram limit of a media caption in UTF-16 code units
+	captionLimit = 1024
+
+	buttonsLimit     = 10
+	buttonTextChars  = 40
+	buttonsDelim     = "|"
+	buttonsNone      = "-"
+	peerCallbackTag  = "p"
+	callbackMaxBytes = 64
+)
+
+// buttonsHelp describes the buttons format to owners
+var buttonsHelp = fmt.Sprintf("Напишите кнопки, по одной в строке: 'Текст %s https://адрес' — ссылка, "+
+	"'Текст %s текст' — бот ответит так, будто собеседник написал этот текст. Не более %d кнопок. '%s' — убрать "+
+	"кнопки", buttonsDelim, buttonsDelim, buttonsLimit, buttonsNone)
+
+func (k mediaKind) String() string {
+	switch k {
+	case MediaPhoto:
+		return "фото"
+	case MediaDocument:
+		return "документ"
+	case MediaVideo:
+		return "видео"
+	default:
+		return "нет"
+	}
+}
+
+// Name is the media kind in the config file
+func (k mediaKind) Name() string {
+	switch k {
+	case MediaPhoto:
+		return "photo"
+	case MediaDocument:
+		return "document"
+	case MediaVideo:
+		return "video"
+	default:
+		return ""
+	}
+}
+
+func mediaKindByName(name string) (mediaKind, bool) {
+	for _, k := range []mediaKind{MediaPhoto, MediaDocument, MediaVideo} {
+		if strings.ToLower(name) == k.Name() {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// mediaOf returns the photo, document or video of a message, the largest photo size is taken
+func mediaOf(msg message) (*Media, bool) {
+	switch {
+	case len(msg.Photo) != 0:
+		return &Media{
+			Kind:   MediaPhoto,
+			FileID: msg.Photo[len(msg.Photo)-1].FileID,
+		}, true
+	case msg.Video.FileID != "":
+		return &Media{
+			Kind:   MediaVideo,
+			FileID: msg.Video.FileID,
+		}, true
+	case msg.Document.FileID != "":
+		return &Media{
+			Kind:   MediaDocument,
+			FileID: msg.Document.FileID,
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+func mediaKindOf(m *Media) mediaKind {
+	if m == nil {
+		return 0
+	}
+	return m.Kind
+}
+
+// handleOwnerMedia handles a photo, document or video from the owner: it is the start message or a rule
+// attachment when the bot asked for it, otherwise a document is a config to import
+func (s *service) handleOwnerMedia(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	media *Media,
+) error {
+	st, err := s.childStateRepo.Get(ctx, owner.ID, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.Get: %w", err)
+	}
+
+	switch {
+	case st.Scene == child_state.SetStart:
+		err = s.onStartMessage(ctx, api, upd, bot, owner, upd.Message.Caption, media)
+		if err != nil {
+			return fmt.Errorf("s.onStartMessage: %w", err)
+		}
+	case st.Scene == child_state.EditRuleMedia:
+		err = s.onRuleText(ctx, api, upd, bot, owner, st, media)
+		if err != nil {
+			return fmt.Errorf("s.onRuleText: %w", err)
+		}
+	case media.Kind == MediaDocument:
+		err = s.handleOwnerImportConfig(ctx, api, upd, bot, owner)
+		if err != nil {
+			return fmt.Errorf("s.handleOwnerImportConfig: %w", err)
+		}
+	default:
+		err = s.replyErr(api, upd, fmt.Sprintf("Фото и видео можно прикрепить к автоответу через %s или к "+
+			"приветствию через %s", editRules, setStart))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseButtons parses one button per line: 'Текст | https://адрес' for a link or 'Текст | текст' for a button
+// which sends the text through the rules. The error is ready to be shown to the user
+func parseButtons(in string) ([]Button, error) {
+	if strings.TrimSpace(in) == buttonsNone {
+		return nil, nil
+	}
+
+	var res []Button
+	for _, line := range strings.Split(in, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, buttonsDelim, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("в строке '%s' нет разделителя %s", line, buttonsDelim)
+		}
+
+		b := Button{Text: strings.TrimSpace(parts[0])}
+		value := strings.TrimSpace(parts[1])
+		if isButtonURL(value) {
+			b.URL = value
+		} else {
+			b.Data = value
+		}
+		res = append(res, b)
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("нет ни одной кнопки")
+	}
+	err := checkButtons(res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkButtons validates buttons against Telegram limits, the error is ready to be shown to the user
+func checkButtons(in []Button) error {
+	if len(in) > buttonsLimit {
+		return fmt.Errorf("не более %d кнопок", buttonsLimit)
+	}
+	for _, b := range in {
+		if b.Text == "" {
+			return errors.New("у кнопки нет текста")
+		}
+		if utf8.RuneCountInString(b.Text) > buttonTextChars {
+			return fmt.Errorf("текст кнопки '%s' длиннее %d символов", b.Text, buttonTextChars)
+		}
+		if (b.URL == "") == (b.Data == "") {
+			return fmt.Errorf("у кнопки '%s' должна быть либо ссылка, либо текст для правил", b.Text)
+		}
+		if b.URL != "" && !isButtonURL(b.URL) {
+			return fmt.Errorf("ссылка кнопки '%s' должна начинаться с %s", b.Text,
+				strings.Join(buttonURLPrefixes, ", "))
+		}
+		if len(peerCallback(b.Data)) > callbackMaxBytes {
+			return fmt.Errorf("текст для правил у кнопки '%s' слишком длинный", b.Text)
+		}
+	}
+	return nil
+}
+
+// buttonURLPrefixes are the link schemes Telegram accepts in a button
+var buttonURLPrefixes = []string{"https://", "http://", "tg://"}
+
+func isButtonURL(in string) bool {
+	for _, prefix := range buttonURLPrefixes {
+		if strings.HasPrefix(strings.ToLower(in), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tplButtons is the inverse of parseButtons
+func tplButtons(in []Button) string {
+	if len(in) == 0 {
+		return no
+	}
+
+	lines := make([]string, 0, len(in))
+	for _, b := range in {
+		value := b.URL
+		if value == "" {
+			value = b.Data
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", b.Text, buttonsDelim, value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func peerCallback(data string) string {
+	return peerCallbackTag + callbackDelim + data
+}
+
+// buttonsMarkup puts menu items above buttons. It is nil without both, so no empty keyboard is sent
+func buttonsMarkup(in []Button, menu []MenuItem) interface{} {
+	if len(in) == 0 && len(menu) == 0 {
+		return nil
+	}
+
+	rows := menuRows(menu)
+	for _, b := range in {
+		btn := tgbotapi.NewInlineKeyboardButtonData(b.Text, peerCallback(b.Data))
+		if b.URL != "" {
+			btn = tgbotapi.NewInlineKeyboardButtonURL(b.Text, b.URL)
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// richReply is an autoreply with optional media and buttons
+type richReply struct {
+	chatID  int64
+	replyTo int
+	text    string
+	media   *Media
+	buttons []Button
+	menu    []MenuItem
+	// menuKeyboard shows the menu as a keyboard
+	menuKeyboard bool
+	parseMode    parseMode
+	noPreview    bool
+}
+
+// sendRich sends the reply with its buttons, or with the menu keyboard. With both the keyboard follows in its
+// own message, as a message has only one markup
+func (s *service) sendRich(api *tgbotapi.BotAPI, r richReply) error {
+	if !r.menuKeyboard || len(r.menu) == 0 {
+		return s.sendRichMarkup(api, r, buttonsMarkup(r.buttons, r.menu))
+	}
+	if len(r.buttons) == 0 {
+		return s.sendRichMarkup(api, r, menuKeyboard(r.menu, false))
+	}
+
+	err := s.sendRichMarkup(api, r, buttonsMarkup(r.buttons, nil))
+	if err != nil {
+		return fmt.Errorf("s.sendRichMarkup: %w", err)
+	}
+
+	msg := tgbotapi.NewMessage(r.chatID, menuDefaultText)
+	msg.ReplyMarkup = menuKeyboard(r.menu, false)
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+// sendRichMarkup sends the text as the media caption when it fits, otherwise the media goes first and the text
+// follows. The markup is attached to the last message
+func (s *service) sendRichMarkup(api *tgbotapi.BotAPI, r richReply, markup interface{}) error {
+	msg := tgbotapi.MessageConfig{
+		BaseChat: tgbotapi.BaseChat{
+			ChatID:           r.chatID,
+			ReplyToMessageID: r.replyTo,
+			ReplyMarkup:      markup,
+		},
+		Text:                  r.text,
+		DisableWebPagePreview: r.noPreview,
+	}
+	if r.media == nil {
+		return s.sendFormatted(api, msg, r.parseMode)
+	}
+
+	if utf16Len(r.text) <= captionLimit {
+		_, err := api.Send(mediaConfig(msg.BaseChat, *r.media, r.text, r.parseMode))
+		if err == nil || r.parseMode == ParsePlain {
+			if err != nil {
+				return fmt.Errorf("api.Send: %w", err)
+			}
+			return nil
+		}
+
+		s.logger.Warn().Err(err).Msg("formatted caption rejected, sending as is")
+		_, err = api.Send(mediaConfig(msg.BaseChat, *r.media, r.text, ParsePlain))
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+		return nil
+	}
+
+	base := msg.BaseChat
+	base.ReplyMarkup = nil
+	_, err := api.Send(mediaConfig(base, *r.media, "", ParsePlain))
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	msg.ReplyToMessageID = 0
+	return s.sendFormatted(api, msg, r.parseMode)
+}
+
+func mediaConfig(base tgbotapi.BaseChat, m Media, caption string, pm parseMode) tgbotapi.Chattable {
+	file := tgbotapi.BaseFile{
+		BaseChat:    base,
+		FileID:      m.FileID,
+		UseExisting: true,
+	}
+
+	switch m.Kind {
+	case MediaDocument:
+		return tgbotapi.DocumentConfig{
+			BaseFile:  file,
+			Caption:   caption,
+			ParseMode: pm.tg(),
+		}
+	case MediaVideo:
+		return tgbotapi.VideoConfig{
+			BaseFile:  file,
+			Caption:   caption,
+			ParseMode: pm.tg(),
+		}
+	default:
+		return tgbotapi.PhotoConfig{
+			BaseFile:  file,
+			Caption:   caption,
+			ParseMode: pm.tg(),
+		}
+	}
+}
+
+// tplAttachments describes media and buttons of a reply for the owner
+func tplAttachments(m *Media, buttons []Button) string {
+	var res []string
+	if m != nil {
+		res = append(res, "вложение: "+m.Kind.String())
+	}
+	if len(buttons) != 0 {
+		names := make([]string, 0, len(buttons))
+		for _, b := range buttons {
+			names = append(names, "["+b.Text+"]")
+		}
+		res = append(res, "кнопки: "+strings.Join(names, " "))
+	}
+	return strings.Join(res, ", ")
+}
@@ -0,0 +1,47 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseButtons(t *testing.T) {
+	buttons, err := parseButtons("Написать менеджеру | https://t.me/manager\n\nПрайс | прайс")
+	assert.NoError(t, err)
+	assert.Equal(t, []Button{{
+		Text: "Написать менеджеру",
+		URL:  "https://t.me/manager",
+	}, {
+		Text: "Прайс",
+		Data: "прайс",
+	}}, buttons)
+
+	again, err := parseButtons(tplButtons(buttons))
+	assert.NoError(t, err)
+	assert.Equal(t, buttons, again)
+
+	buttons, err = parseButtons(buttonsNone)
+	assert.NoError(t, err)
+	assert.Nil(t, buttons)
+
+	_, err = parseButtons("Прайс")
+	assert.Error(t, err)
+
+	_, err = parseButtons("Прайс | " + strings.Repeat("я", 32))
+	assert.Error(t, err)
+
+	_, err = parseButtons(strings.Repeat("a | b\n", buttonsLimit+1))
+	assert.Error(t, err)
+}
+
+func TestMediaOf(t *testing.T) {
+	m, ok := mediaOf(message{
+		Photo: []photoSize{{FileID: "small"}, {FileID: "large"}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, &Media{Kind: MediaPhoto, FileID: "large"}, m)
+
+	_, ok = mediaOf(message{Text: "текст"})
+	assert.False(t, ok)
+}
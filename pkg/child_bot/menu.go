@@ -0,0 +1,435 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MenuItem is a button of the menu under the start message. It replies by the rule KeywordID, opens Items as
+// a submenu, or without both asks the peer to write freely and forwards the next message as is. An item of
+// a deleted rule is not shown
+type MenuItem struct {
+	ID        primitive.ObjectID `bson:"id,omitempty"`
+	Text      string             `bson:"t,omitempty"`
+	KeywordID primitive.ObjectID `bson:"kid,omitempty"`
+	Items     []MenuItem         `bson:"it,omitempty"`
+}
+
+const (
+	menuCallbackTag = "m"
+	menuItemsLimit  = 10
+	menuChildPrefix = "-"
+	menuRuleDelim   = "="
+	menuNone        = "-"
+	menuBack        = "⬅️ Назад"
+	menuDefaultText = "Выберите тему"
+	menuFreePrompt  = "Напишите ваш вопрос одним сообщением, я передам его"
+	menuPickPrefix  = "📋 "
+	menuKeyboardOn  = "клавиатура"
+)
+
+var menuHelp = fmt.Sprintf(`Меню — кнопки под приветственным сообщением, собеседник выбирает тему вместо того, чтобы писать. Напишите пункты меню, по одному в строке:
+
+Реклама %s 1 — пункт отвечает автоответом правила 1 из %s
+Сотрудничество — пункт с подменю, его пункты ниже начинаются с '%s'
+%s Партнерство %s 2
+%s Другое — пункт без правила: бот попросит написать вопрос и перешлет его вам
+
+Первой строкой можно написать '%s', тогда меню будет клавиатурой вместо кнопок под сообщением. Не более %d пунктов в меню и в каждом подменю. Пункты удаленных правил не показываются. '%s' — убрать меню`,
+	menuRuleDelim, editRules, menuChildPrefix, menuChildPrefix, menuRuleDelim, menuChildPrefix, menuKeyboardOn,
+	menuItemsLimit, menuNone)
+
+func (s *service) handleOwnerMenu(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	bot, err := s.ensureKeywordIDs(ctx, bot)
+	if err != nil {
+		return fmt.Errorf("s.ensureKeywordIDs: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.SetMenu)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	current := no
+	if len(bot.Menu) != 0 {
+		current = tplMenu(bot)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf("Сейчас:\n%s\n\n%s\n\n%s — отмена", current, menuHelp, help))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) onMenu(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	menu, keyboard, err := parseMenu(upd.Message.Text, bot)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Меню не сохранено: %s. Попробуйте еще раз", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	next := bot
+	next.Menu = menu
+	next.MenuKeyboard = keyboard
+	_, err = s.applySettings(ctx, bot, next, upd.Message.From, sourceMenu)
+	if err != nil {
+		return fmt.Errorf("s.applySettings: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	text := "Меню убрано"
+	if len(menu) != 0 {
+		text = fmt.Sprintf("Меню сохранено, собеседники увидят его на %s", start)
+	}
+	err = s.replyOK(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
+// parseMenu parses the menu and whether it is a keyboard, rules are referenced by their current numbers and
+// stored by IDs. The error is ready to be shown to the user
+func parseMenu(in string, bot Bot) ([]MenuItem, bool, error) {
+	if strings.TrimSpace(in) == menuNone {
+		return nil, false, nil
+	}
+
+	var (
+		res      []MenuItem
+		keyboard bool
+	)
+	for _, line := range strings.Split(in, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(res) == 0 && !keyboard && strings.ToLower(line) == menuKeyboardOn {
+			keyboard = true
+			continue
+		}
+
+		child := strings.HasPrefix(line, menuChildPrefix)
+		if child {
+			line = strings.TrimSpace(strings.TrimPrefix(line, menuChildPrefix))
+		}
+
+		item, err := parseMenuItem(line, bot)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !child {
+			res = append(res, item)
+			continue
+		}
+
+		if len(res) == 0 {
+			return nil, false, fmt.Errorf("пункт подменю '%s' без пункта над ним", item.Text)
+		}
+		parent := &res[len(res)-1]
+		if !parent.KeywordID.IsZero() {
+			return nil, false, fmt.Errorf("у пункта '%s' есть подменю, правило ему указывать не нужно",
+				parent.Text)
+		}
+		parent.Items = append(parent.Items, item)
+		if len(parent.Items) > menuItemsLimit {
+			return nil, false, fmt.Errorf("в подменю '%s' более %d пунктов", parent.Text, menuItemsLimit)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, false, errors.New("нет ни одного пункта")
+	}
+	if len(res) > menuItemsLimit {
+		return nil, false, fmt.Errorf("более %d пунктов", menuItemsLimit)
+	}
+	return res, keyboard, nil
+}
+
+func parseMenuItem(line string, bot Bot) (MenuItem, error) {
+	item := MenuItem{
+		ID:   primitive.NewObjectID(),
+		Text: line,
+	}
+
+	if i := strings.LastIndex(line, menuRuleDelim); i >= 0 {
+		item.Text = strings.TrimSpace(line[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil || n < 1 || n > len(bot.Keywords) {
+			return MenuItem{}, fmt.Errorf("у пункта '%s' нет правила с таким номером, правил %d", item.Text,
+				len(bot.Keywords))
+		}
+		item.KeywordID = bot.Keywords[n-1].ID
+	}
+
+	if item.Text == "" {
+		return MenuItem{}, fmt.Errorf("пустой текст пункта в строке '%s'", line)
+	}
+	if utf8.RuneCountInString(item.Text) > buttonTextChars {
+		return MenuItem{}, fmt.Errorf("текст пункта '%s' длиннее %d символов", item.Text, buttonTextChars)
+	}
+	return item, nil
+}
+
+// tplMenu is the inverse of parseMenu. An item of a deleted rule is marked, it is not shown to peers
+func tplMenu(bot Bot) string {
+	var lines []string
+	if bot.MenuKeyboard {
+		lines = append(lines, menuKeyboardOn)
+	}
+	var add func(items []MenuItem, prefix string)
+	add = func(items []MenuItem, prefix string) {
+		for _, item := range items {
+			line := prefix + item.Text
+			if i, found := findKeyword(bot, item.KeywordID); found {
+				line += fmt.Sprintf(" %s %d", menuRuleDelim, i+1)
+			} else if !item.KeywordID.IsZero() {
+				line += " (правило удалено, пункт скрыт)"
+			}
+			lines = append(lines, line)
+			add(item.Items, menuChildPrefix+" ")
+		}
+	}
+	add(bot.Menu, "")
+	return strings.Join(lines, "\n")
+}
+
+// liveMenu is the menu without items of deleted rules and submenus left without items
+func liveMenu(bot Bot) []MenuItem {
+	var live func(items []MenuItem) []MenuItem
+	live = func(items []MenuItem) []MenuItem {
+		var res []MenuItem
+		for _, item := range items {
+			if _, found := findKeyword(bot, item.KeywordID); !found && !item.KeywordID.IsZero() {
+				continue
+			}
+			if len(item.Items) != 0 {
+				item.Items = live(item.Items)
+				if len(item.Items) == 0 {
+					continue
+				}
+			}
+			res = append(res, item)
+		}
+		return res
+	}
+	return live(bot.Menu)
+}
+
+// menuKeyboard is the menu as a keyboard, a submenu has the back button
+func menuKeyboard(items []MenuItem, back bool) tgbotapi.ReplyKeyboardMarkup {
+	rows := make([][]tgbotapi.KeyboardButton, 0, len(items)+1)
+	for _, item := range items {
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(item.Text)))
+	}
+	if back {
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(menuBack)))
+	}
+
+	kb := tgbotapi.NewReplyKeyboard(rows...)
+	kb.ResizeKeyboard = true
+	return kb
+}
+
+func menuRows(items []MenuItem) [][]tgbotapi.InlineKeyboardButton {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(items))
+	for _, item := range items {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(item.Text, menuCallback(item.ID)),
+		))
+	}
+	return rows
+}
+
+func menuCallback(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return menuCallbackTag + callbackDelim
+	}
+	return menuCallbackTag + callbackDelim + id.Hex()
+}
+
+func findMenuItem(items []MenuItem, id primitive.ObjectID) (MenuItem, bool) {
+	for _, item := range items {
+		if item.ID == id {
+			return item, true
+		}
+		if res, found := findMenuItem(item.Items, id); found {
+			return res, true
+		}
+	}
+	return MenuItem{}, false
+}
+
+func findMenuItemByText(items []MenuItem, text string) (MenuItem, bool) {
+	for _, item := range items {
+		if item.Text == text {
+			return item, true
+		}
+		if res, found := findMenuItemByText(item.Items, text); found {
+			return res, true
+		}
+	}
+	return MenuItem{}, false
+}
+
+// handleMenuCallback handles a menu button pressed by a peer: a submenu replaces the keyboard, a rule item
+// works as if the peer wrote a keyword of the rule
+func (s *service) handleMenuCallback(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	cb callbackQuery,
+	bot Bot,
+	owner user.User,
+) error {
+	if bot.Mode == None || bot.Paused {
+		return nil
+	}
+
+	menu := liveMenu(bot)
+	id, _ := primitive.ObjectIDFromHex(strings.TrimPrefix(cb.Data, menuCallbackTag+callbackDelim))
+	item, found := findMenuItem(menu, id)
+	if !found || len(item.Items) != 0 {
+		markup := buttonsMarkup(bot.StartButtons, menu)
+		if found {
+			rows := append(menuRows(item.Items), tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(menuBack, menuCallback(primitive.NilObjectID)),
+			))
+			markup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		}
+
+		kb, ok := markup.(tgbotapi.InlineKeyboardMarkup)
+		if !ok {
+			return nil
+		}
+		_, err := api.Send(tgbotapi.NewEditMessageReplyMarkup(cb.Message.Chat.ID, int(cb.Message.MessageID), kb))
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+		return nil
+	}
+
+	peerUser, peerFound, err := s.peerRepo.Get(ctx, bot.ID, cb.From.ID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
+	if peerUser.Muted {
+		return nil
+	}
+
+	err = s.pickMenuItem(ctx, api, update{
+		Message: message{
+			MessageID: cb.Message.MessageID,
+			Chat:      cb.Message.Chat,
+			From:      cb.From,
+			Text:      menuPickPrefix + item.Text,
+		},
+	}, bot, owner, item, peerUser, peerFound)
+	if err != nil {
+		return fmt.Errorf("s.pickMenuItem: %w", err)
+	}
+	return nil
+}
+
+// handleMenuText handles a keyboard menu button pressed by a peer, it reports false if the text is not one
+func (s *service) handleMenuText(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	peerUser peer.Peer,
+	peerFound bool,
+) (bool, error) {
+	menu := liveMenu(bot)
+	if len(menu) == 0 {
+		return false, nil
+	}
+
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, menuDefaultText)
+	if upd.Message.Text == menuBack {
+		msg.ReplyMarkup = menuKeyboard(menu, false)
+		_, err := api.Send(msg)
+		if err != nil {
+			return false, fmt.Errorf("api.Send: %w", err)
+		}
+		return true, nil
+	}
+
+	item, found := findMenuItemByText(menu, upd.Message.Text)
+	if !found {
+		return false, nil
+	}
+
+	if len(item.Items) != 0 {
+		msg.ReplyMarkup = menuKeyboard(item.Items, true)
+		_, err := api.Send(msg)
+		if err != nil {
+			return false, fmt.Errorf("api.Send: %w", err)
+		}
+		return true, nil
+	}
+
+	err := s.pickMenuItem(ctx, api, upd, bot, owner, item, peerUser, peerFound)
+	if err != nil {
+		return false, fmt.Errorf("s.pickMenuItem: %w", err)
+	}
+	return true, nil
+}
+
+// pickMenuItem replies by the rule of the item, or asks the peer to write freely
+func (s *service) pickMenuItem(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	item MenuItem,
+	peerUser peer.Peer,
+	peerFound bool,
+) error {
+	i, found := findKeyword(bot, item.KeywordID)
+	if found {
+		err := s.act(ctx, api, upd, bot, owner, ruleDecision(bot, i, item.Text), peerUser, peerFound)
+		if err != nil {
+			return fmt.Errorf("s.act: %w", err)
+		}
+		return nil
+	}
+
+	err := s.peerRepo.SetFreeText(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID,
+		expireAt(s.peersDays(bot)))
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.SetFreeText: %w", err)
+	}
+
+	_, err = api.Send(tgbotapi.NewMessage(upd.Message.Chat.ID, menuFreePrompt))
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestParseMenu(t *testing.T) {
+	bot := Bot{
+		Keywords: []Keyword{{
+			ID: primitive.NewObjectID(),
+			In: []string{"реклама"},
+		}, {
+			ID: primitive.NewObjectID(),
+			In: []string{"партнер"},
+		}},
+	}
+
+	in := "Реклама = 1\nСотрудничество\n- Партнерство = 2\n- Другое"
+	menu, keyboard, err := parseMenu(in, bot)
+	assert.NoError(t, err)
+	assert.False(t, keyboard)
+	assert.Len(t, menu, 2)
+	assert.Equal(t, bot.Keywords[0].ID, menu[0].KeywordID)
+	assert.Len(t, menu[1].Items, 2)
+	assert.Equal(t, bot.Keywords[1].ID, menu[1].Items[0].KeywordID)
+	assert.True(t, menu[1].Items[1].KeywordID.IsZero())
+	bot.Menu = menu
+	assert.Equal(t, in, tplMenu(bot))
+
+	_, keyboard, err = parseMenu("Клавиатура\n"+in, bot)
+	assert.NoError(t, err)
+	assert.True(t, keyboard)
+
+	item, found := findMenuItem(menu, menu[1].Items[1].ID)
+	assert.True(t, found)
+	assert.Equal(t, "Другое", item.Text)
+
+	none, _, err := parseMenu(menuNone, bot)
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+
+	_, _, err = parseMenu("Реклама = 3", bot)
+	assert.Error(t, err)
+
+	_, _, err = parseMenu("- Партнерство", bot)
+	assert.Error(t, err)
+
+	_, _, err = parseMenu("Реклама = 1\n- Партнерство = 2", bot)
+	assert.Error(t, err)
+
+	bot.Mode = Always
+	d := decide(bot, start, false, false)
+	assert.Equal(t, actStart, d.action)
+	assert.Equal(t, []string{menuDefaultText}, d.replies)
+}
+
+func TestLiveMenu(t *testing.T) {
+	bot := Bot{
+		Keywords: []Keyword{{ID: primitive.NewObjectID()}},
+		Menu: []MenuItem{
+			{Text: "Реклама"},
+			{Text: "Удалено", KeywordID: primitive.NewObjectID()},
+			{Text: "Подменю", Items: []MenuItem{{Text: "Удалено", KeywordID: primitive.NewObjectID()}}},
+		},
+	}
+	bot.Menu[0].KeywordID = bot.Keywords[0].ID
+
+	live := liveMenu(bot)
+	assert.Len(t, live, 1)
+	assert.Equal(t, "Реклама", live[0].Text)
+	assert.Contains(t, tplMenu(bot), "Удалено (правило удалено, пункт скрыт)")
+
+	kb := menuKeyboard(live, true)
+	assert.Len(t, kb.Keyboard, 2)
+	assert.Equal(t, menuBack, kb.Keyboard[1][0].Text)
+
+	_, found := findMenuItemByText(live, "Удалено")
+	assert.False(t, found)
+}
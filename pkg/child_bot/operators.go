@@ -0,0 +1,214 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/random"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"time"
+)
+
+func (s *service) handleInvite(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	code := strings.TrimPrefix(upd.Message.Text, start+" "+invitePrefix)
+
+	inv, found, err := s.inviteRepo.Redeem(ctx, bot.ID, code)
+	if err != nil {
+		return fmt.Errorf("s.inviteRepo.Redeem: %w", err)
+	}
+	if !found {
+		err = s.replyErr(api, upd, "Приглашение не найдено или истекло. Попросите владельца бота прислать новое")
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	name := tplName(upd.Message.From.FirstName)
+	err = s.operatorRepo.Create(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID, name, inv.Role)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.Create: %w", err)
+	}
+
+	err = s.replyOK(api, upd, fmt.Sprintf("Вы %s этого бота. Пересланные сообщения собеседников будут приходить "+
+		"сюда. %s", roleToRU(inv.Role), help))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	if bot.OwnerUserChatID != 0 {
+		_, err = api.Send(tgbotapi.NewMessage(bot.OwnerUserChatID, fmt.Sprintf("%s / %s теперь %s бота. %s",
+			tplUsername(upd.Message.From.Username), name, roleToRU(inv.Role), operators)))
+		if err != nil {
+			s.logger.Warn().Err(err).Send()
+		}
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerOperators(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	ops, err := s.operatorRepo.GetByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.GetByChildBotID: %w", err)
+	}
+
+	mode := "всем операторам"
+	if bot.ForwardMode == ForwardRoundRobin {
+		mode = "по очереди"
+	}
+
+	text := fmt.Sprintf(`Операторы бота. Режим пересылки: %s, сменить %s
+
+Пригласить: %s, %s`, mode, setForwardMode, inviteAdmin, inviteAgent)
+
+	if len(ops) == 0 {
+		err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+		}
+
+		err = s.reply(api, upd, text+"\n\nОператоров пока нет")
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.RemoveOperator)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	text += fmt.Sprintf("\n\nКликните на ID чтобы удалить оператора. Нажмите %s чтобы выйти в меню", help)
+	for _, op := range ops {
+		text += fmt.Sprintf(`
+
+ID /%s
+%s — %s`, op.ID.Hex(), op.Name, roleToRU(op.Role))
+	}
+
+	err = s.reply(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerRemoveOperator(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	id, err := primitive.ObjectIDFromHex(strings.Replace(upd.Message.Text, "/", "", 1))
+	if err != nil {
+		err = s.replyErr(api, upd, "Некорректный ID оператора")
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	op, found, err := s.operatorRepo.Delete(ctx, bot.ID, id)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.Delete: %w", err)
+	}
+	if !found {
+		err = s.replyErr(api, upd, "Оператор не найден")
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	err = s.peerRepo.UnclaimByOperator(ctx, bot.ID, op.TgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.UnclaimByOperator: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	_, err = api.Send(tgbotapi.NewMessage(op.TgChatID, "Вы больше не оператор этого бота"))
+	if err != nil {
+		s.logger.Warn().Err(err).Send()
+	}
+
+	err = s.replyOK(api, upd, fmt.Sprintf("Оператор %s удален. %s", op.Name, help))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerInvite(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	role operator.Role,
+) error {
+	code, err := random.Code(inviteCodeLen)
+	if err != nil {
+		return fmt.Errorf("random.Code: %w", err)
+	}
+
+	err = s.inviteRepo.Create(ctx, bot.ID, code, role, time.Now().UTC().Add(inviteTTL))
+	if err != nil {
+		return fmt.Errorf("s.inviteRepo.Create: %w", err)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf(`Ссылка-приглашение, %s. Она одноразовая и действует %d ч.:
+
+https://t.me/%s?start=%s%s`, roleToRU(role), int(inviteTTL.Hours()), api.Self.UserName, invitePrefix, code))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerForwardMode(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	fm := ForwardRoundRobin
+	text := "Сообщения собеседников пересылаются операторам по очереди. Собеседник, за которым закреплен " +
+		"оператор, попадает к нему"
+	if bot.ForwardMode == ForwardRoundRobin {
+		fm = ForwardAll
+		text = "Сообщения собеседников пересылаются вам и всем операторам"
+	}
+
+	err := s.childBotRepo.SetForwardMode(ctx, bot.ID, fm)
+	if err != nil {
+		return fmt.Errorf("s.childBotRepo.SetForwardMode: %w", err)
+	}
+
+	err = s.replyOK(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	return nil
+}
+
+func roleToRU(r operator.Role) string {
+	if r == operator.Admin {
+		return "админ"
+	}
+	return "агент"
+}
@@ -0,0 +1,365 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	cardCallbackTag = "c"
+	peerTagsLimit   = 10
+	peerNoteChars   = 500
+	peersListLimit  = 50
+	cardTagsLimit   = 20
+	cardTagsPerRow  = 3
+	noteNone        = "-"
+)
+
+// tplPeerLabels is tags of the peer for the forward header
+func tplPeerLabels(p peer.Peer) string {
+	if len(p.Tags) == 0 {
+		return ""
+	}
+	return "теги: " + strings.Join(p.Tags, ", ")
+}
+
+func tplPeerCard(p peer.Peer) string {
+	lines := []string{fmt.Sprintf("Собеседник %d", p.TgUserID)}
+	if p.Source != "" {
+		lines = append(lines, "Источник: "+p.Source)
+	}
+	if status := tplPeerStatus(p); status != "" {
+		lines = append(lines, "Статус: "+status)
+	}
+	if p.Muted {
+		lines = append(lines, "Забанен")
+	}
+	if p.ClaimedByName != "" {
+		lines = append(lines, "Отвечает: "+p.ClaimedByName)
+	}
+
+	tags := no
+	if len(p.Tags) != 0 {
+		tags = strings.Join(p.Tags, ", ")
+	}
+	note := no
+	if p.Note != "" {
+		note = p.Note
+	}
+	lines = append(lines, "Теги: "+tags, "Заметка: "+note)
+
+	return strings.Join(lines, "\n") + fmt.Sprintf(`
+
+Кнопки ниже ставят и снимают теги. Новый тег: 'ответьте' '%s клиент' на пересланное сообщение, снять: '%s клиент'. Заметка: '%s текст', удалить: '%s %s'`,
+		tagCmd, untagCmd, noteCmd, noteCmd, noteNone)
+}
+
+// tplPeerLine is the peer in the /peers list
+func tplPeerLine(p peer.Peer) string {
+	line := strconv.FormatInt(p.TgUserID, 10)
+	if status := tplPeerStatus(p); status != "" {
+		line += " (" + status + ")"
+	}
+	if len(p.Tags) != 0 {
+		line += " [" + strings.Join(p.Tags, ", ") + "]"
+	}
+	if p.Note != "" {
+		line += " — " + preview(p.Note)
+	}
+	return line
+}
+
+func cardCallback(tgUserID int64, tag string) string {
+	parts := []string{cardCallbackTag, strconv.FormatInt(tgUserID, 10)}
+	if tag != "" {
+		parts = append(parts, tag)
+	}
+	return strings.Join(parts, callbackDelim)
+}
+
+// forwardMarkup is snippet buttons and the contact card button under a forward
+func forwardMarkup(bot Bot, tgUserID int64) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if markup := snippetsMarkup(bot); markup != nil {
+		rows = markup.InlineKeyboard
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("👤 Карточка", cardCallback(tgUserID, "")),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// peerCard is the card of the peer with a toggle button for every tag used in the bot
+func (s *service) peerCard(
+	ctx context.Context,
+	bot Bot,
+	tgUserID int64,
+) (
+	string,
+	*tgbotapi.InlineKeyboardMarkup,
+	error,
+) {
+	p, found, err := s.peerRepo.Get(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
+	if !found {
+		return fmt.Sprintf("Собеседник %d не найден. Данные собеседников хранятся %d дн.", tgUserID,
+			s.peersDays(bot)), nil, nil
+	}
+
+	tags, err := s.peerRepo.GetTags(ctx, bot.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("s.peerRepo.GetTags: %w", err)
+	}
+	sort.Strings(tags)
+	if len(tags) > cardTagsLimit {
+		tags = tags[:cardTagsLimit]
+	}
+
+	has := map[string]bool{}
+	for _, t := range p.Tags {
+		has[t] = true
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, t := range tags {
+		label := t
+		if has[t] {
+			label = "✅ " + t
+		}
+		btn := tgbotapi.NewInlineKeyboardButtonData(label, cardCallback(tgUserID, t))
+		if i%cardTagsPerRow == 0 {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+			continue
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], btn)
+	}
+	if len(rows) == 0 {
+		return tplPeerCard(p), nil, nil
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return tplPeerCard(p), &markup, nil
+}
+
+// handleCardCallback shows the card of the peer under a forward, or toggles a tag on the card
+func (s *service) handleCardCallback(ctx context.Context, api *tgbotapi.BotAPI, cb callbackQuery, bot Bot) error {
+	parts := strings.Split(cb.Data, callbackDelim)
+	if len(parts) < 2 {
+		return nil
+	}
+	tgUserID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	if len(parts) == 3 {
+		p, _, e := s.peerRepo.Get(ctx, bot.ID, tgUserID)
+		if e != nil {
+			return fmt.Errorf("s.peerRepo.Get: %w", e)
+		}
+
+		e = s.toggleTag(ctx, bot, p, parts[2])
+		if e != nil {
+			return fmt.Errorf("s.toggleTag: %w", e)
+		}
+	}
+
+	text, markup, err := s.peerCard(ctx, bot, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerCard: %w", err)
+	}
+
+	if len(parts) == 3 {
+		edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, int(cb.Message.MessageID), text)
+		edit.ReplyMarkup = markup
+		_, err = api.Send(edit)
+		if err != nil {
+			return fmt.Errorf("api.Send: %w", err)
+		}
+		return nil
+	}
+
+	msg := tgbotapi.NewMessage(cb.Message.Chat.ID, text)
+	msg.ReplyToMessageID = int(cb.Message.MessageID)
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+func (s *service) toggleTag(ctx context.Context, bot Bot, p peer.Peer, tag string) error {
+	for _, t := range p.Tags {
+		if t == tag {
+			err := s.peerRepo.RemoveTag(ctx, bot.ID, p.TgUserID, tag)
+			if err != nil {
+				return fmt.Errorf("s.peerRepo.RemoveTag: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if len(p.Tags) >= peerTagsLimit {
+		return nil
+	}
+	_, err := s.peerRepo.AddTag(ctx, bot.ID, p.TgUserID, tag)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.AddTag: %w", err)
+	}
+	return nil
+}
+
+// handlePeerLabel handles tag, untag and note commands 'replied' to a forward. A bare tag shows the card
+func (s *service) handlePeerLabel(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	tgUserID int64,
+	cmd,
+	arg string,
+) error {
+	p, found, err := s.peerRepo.Get(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
+	if !found || (cmd == tagCmd && arg == "") {
+		text, markup, e := s.peerCard(ctx, bot, tgUserID)
+		if e != nil {
+			return fmt.Errorf("s.peerCard: %w", e)
+		}
+
+		msg := tgbotapi.NewMessage(upd.Message.Chat.ID, text)
+		msg.ReplyToMessageID = int(upd.Message.MessageID)
+		if markup != nil {
+			msg.ReplyMarkup = *markup
+		}
+		_, e = api.Send(msg)
+		if e != nil {
+			return fmt.Errorf("api.Send: %w", e)
+		}
+		return nil
+	}
+
+	var done string
+	switch cmd {
+	case tagCmd, untagCmd:
+		tag := strings.ToLower(arg)
+		if !validLabel(tag) {
+			e := s.replyErr(api, upd, fmt.Sprintf("Тег должен быть одним словом до %d символов: буквы, цифры и _",
+				labelChars))
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+
+		if cmd == untagCmd {
+			err = s.peerRepo.RemoveTag(ctx, bot.ID, tgUserID, tag)
+			if err != nil {
+				return fmt.Errorf("s.peerRepo.RemoveTag: %w", err)
+			}
+			done = "Тег снят: " + tag
+			break
+		}
+
+		if len(p.Tags) >= peerTagsLimit {
+			e := s.replyErr(api, upd, fmt.Sprintf("У собеседника не более %d тегов", peerTagsLimit))
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+		_, err = s.peerRepo.AddTag(ctx, bot.ID, tgUserID, tag)
+		if err != nil {
+			return fmt.Errorf("s.peerRepo.AddTag: %w", err)
+		}
+		done = "Тег добавлен: " + tag
+	default:
+		note := arg
+		if note == noteNone {
+			note = ""
+		}
+		if utf8.RuneCountInString(note) > peerNoteChars {
+			e := s.replyErr(api, upd, fmt.Sprintf("Заметка не длиннее %d символов", peerNoteChars))
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+
+		err = s.peerRepo.SetNote(ctx, bot.ID, tgUserID, note)
+		if err != nil {
+			return fmt.Errorf("s.peerRepo.SetNote: %w", err)
+		}
+		done = "Заметка сохранена"
+		if note == "" {
+			done = "Заметка удалена"
+		}
+	}
+
+	err = s.replyOK(api, upd, done)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
+// handleOwnerPeers lists recently active peers with tags and notes, '/peers tag' shows only peers with the tag
+func (s *service) handleOwnerPeers(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	tag := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, peersCmd)))
+	if tag != "" && !validLabel(tag) {
+		err := s.replyErr(api, upd, fmt.Sprintf("Укажите один тег, например: %s клиент", peersCmd))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	peers, err := s.peerRepo.List(ctx, bot.ID, tag, peersListLimit)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.List: %w", err)
+	}
+
+	tags, err := s.peerRepo.GetTags(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.GetTags: %w", err)
+	}
+	sort.Strings(tags)
+
+	title := fmt.Sprintf("Последние %d собеседников", peersListLimit)
+	if tag != "" {
+		title = fmt.Sprintf("Собеседники с тегом %s, последние %d", tag, peersListLimit)
+	}
+	lines := []string{title}
+	if len(peers) == 0 {
+		lines = append(lines, "Никого нет")
+	}
+	for _, p := range peers {
+		lines = append(lines, tplPeerLine(p))
+	}
+
+	all := no
+	if len(tags) != 0 {
+		all = strings.Join(tags, ", ")
+	}
+	lines = append(lines, "", fmt.Sprintf("Теги: %s. Отбор по тегу: %s тег. История переписки: %s ID", all,
+		peersCmd, history))
+
+	err = s.reply(api, upd, strings.Join(lines, "\n"))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTplForwardLabels(t *testing.T) {
+	upd := update{Message: message{From: from{FirstName: "Иван"}, Text: "Сколько стоит?"}}
+	p := peer.Peer{Tags: []string{"клиент", "рекламодатель"}, Note: "Просит скидку"}
+
+	text := tplForward(primitive.NewObjectID(), upd, p, "")
+	lines := strings.Split(text, "\n")
+	assert.True(t, strings.HasSuffix(lines[1], "(теги: клиент, рекламодатель):"))
+	assert.Contains(t, text, "Заметка: Просит скидку")
+
+	text = tplForward(primitive.NewObjectID(), upd, peer.Peer{}, "")
+	assert.NotContains(t, text, "теги:")
+	assert.NotContains(t, text, "Заметка:")
+}
+
+func TestForwardMarkup(t *testing.T) {
+	markup := forwardMarkup(Bot{}, 42)
+	assert.Len(t, markup.InlineKeyboard, 1)
+	assert.Equal(t, "c|42", *markup.InlineKeyboard[0][0].CallbackData)
+
+	markup = forwardMarkup(Bot{Snippets: []Snippet{{Name: "цены"}}}, 42)
+	assert.Len(t, markup.InlineKeyboard, 2)
+	assert.Equal(t, "#цены", markup.InlineKeyboard[0][0].Text)
+}
+
+func TestTplPeerLine(t *testing.T) {
+	assert.Equal(t, "42 [клиент] — Просит скидку", tplPeerLine(peer.Peer{
+		TgUserID: 42,
+		Tags:     []string{"клиент"},
+		Note:     "Просит скидку",
+	}))
+	assert.Equal(t, "42 (остановил бота 01.02.2024)", tplPeerLine(peer.Peer{
+		TgUserID:  42,
+		Stopped:   true,
+		StoppedAt: time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC),
+	}))
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"time"
 )
 
@@ -16,25 +18,73 @@ type Bot struct {
 	OwnerUserID     primitive.ObjectID `bson:"ui,omitempty"`
 	OwnerUserChatID int64              `bson:"uci,omitempty"`
 	Token           string             `bson:"t,omitempty"`
+	Username        string             `bson:"un,omitempty"`
+	TokenFailedAt   time.Time          `bson:"tfa,omitempty"`
 	SetupDone       bool               `bson:"sd,omitempty"`
 	OnPeerStart     string             `bson:"ops,omitempty"`
-	Keywords        []Keyword          `bson:"k,omitempty"`
-	WebhookAt       time.Time          `bson:"wa,omitempty"`
-	Mode            mode               `bson:"m,omitempty"`
+	StartMedia      *Media             `bson:"opm,omitempty"`
+	StartButtons    []Button           `bson:"opb,omitempty"`
+	Menu            []MenuItem         `bson:"mn,omitempty"`
+	// MenuKeyboard shows the menu as a keyboard instead of buttons under the start message
+	MenuKeyboard  bool           `bson:"mk,omitempty"`
+	StartPayloads []StartPayload `bson:"sp,omitempty"`
+	Keywords      []Keyword      `bson:"k,omitempty"`
+	WebhookAt     time.Time      `bson:"wa,omitempty"`
+	Mode          mode           `bson:"m,omitempty"`
+	Paused        bool           `bson:"p,omitempty"`
+	DeletedAt     time.Time      `bson:"da,omitempty"`
+	ForwardMode   forwardMode    `bson:"fm,omitempty"`
+	RoundRobin    uint64         `bson:"rr,omitempty"`
+	ForumChatID   int64          `bson:"fci,omitempty"`
+	Retention     Retention      `bson:"rt,omitempty"`
+	ReplyDelay    DelayRange     `bson:"dl,omitempty"`
+	Snippets      []Snippet      `bson:"sn,omitempty"`
+	// Counters are reply counters of round robin rules by rule ID, kept apart so rule edits and rollbacks keep them
+	Counters map[string]uint64 `bson:"kc,omitempty"`
 }
 
 type Keyword struct {
-	In  []string `bson:"i,omitempty"`
-	Out string   `bson:"o,omitempty"`
-	Ban bool     `bson:"b,omitempty"`
+	ID         primitive.ObjectID `bson:"id,omitempty"`
+	In         []string           `bson:"i,omitempty"`
+	Out        string             `bson:"o,omitempty"`
+	Variants   []string           `bson:"vs,omitempty"`
+	RoundRobin bool               `bson:"rr,omitempty"`
+	ParseMode  parseMode          `bson:"pm,omitempty"`
+	NoPreview  bool               `bson:"np,omitempty"`
+	Media      *Media             `bson:"md,omitempty"`
+	Buttons    []Button           `bson:"bt,omitempty"`
+	Ban        bool               `bson:"b,omitempty"`
+	// Delay overrides the reply delay of the bot, a zero range turns it off for the rule
+	Delay *DelayRange `bson:"dl,omitempty"`
 }
 
+// DelayRange is the range of the reply delay in seconds, the bot shows typing meanwhile
+type DelayRange struct {
+	Min uint16 `bson:"mi,omitempty"`
+	Max uint16 `bson:"ma,omitempty"`
+}
+
+type forwardMode uint8
+
+const (
+	// ForwardAll delivers forwards to the owner and every operator
+	ForwardAll forwardMode = iota
+	// ForwardRoundRobin delivers each forward to one of them in turn
+	ForwardRoundRobin
+)
+
 type Repo struct {
-	coll *mongo.Collection
+	coll    *mongo.Collection
+	primary *mongo.Collection
 }
 
 type mode uint8
 
+// notDeleted matches bots which are not soft deleted
+var notDeleted = bson.M{
+	"$exists": false,
+}
+
 const (
 	None mode = iota
 	OnlyFirst
@@ -43,7 +93,8 @@ const (
 
 func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
 	r := &Repo{
-		coll: db.Collection("child_bots"),
+		coll:    db.Collection("child_bots"),
+		primary: db.Collection("child_bots", options.Collection().SetReadPreference(readpref.Primary())),
 	}
 
 	err := r.createIndex(ctx)
@@ -54,6 +105,14 @@ func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
 	return r, nil
 }
 
+// Primary returns the repo reading from the primary, for reads right after writes
+func (r *Repo) Primary() *Repo {
+	return &Repo{
+		coll:    r.primary,
+		primary: r.primary,
+	}
+}
+
 func (r *Repo) createIndex(ctx context.Context) error {
 	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
 		Keys: bson.M{
@@ -64,6 +123,11 @@ func (r *Repo) createIndex(ctx context.Context) error {
 			"t": 1,
 		},
 		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.M{
+			"da": 1,
+		},
+		Options: options.Index().SetSparse(true),
 	}})
 	if err != nil {
 		return fmt.Errorf("r.coll.Indexes().CreateOne: %w", err)
@@ -78,6 +142,7 @@ func (r *Repo) CountByUserID(c context.Context, userID primitive.ObjectID) (int6
 
 	count, err := r.coll.CountDocuments(ctx, bson.M{
 		"ui": userID,
+		"da": notDeleted,
 	})
 	if err != nil {
 		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
@@ -86,13 +151,14 @@ func (r *Repo) CountByUserID(c context.Context, userID primitive.ObjectID) (int6
 	return count, nil
 }
 
-func (r *Repo) Create(c context.Context, userID primitive.ObjectID, token string) error {
+func (r *Repo) Create(c context.Context, userID primitive.ObjectID, token, username string) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
 	_, err := r.coll.InsertOne(ctx, Bot{
 		OwnerUserID: userID,
 		Token:       token,
+		Username:    username,
 		SetupDone:   false,
 		WebhookAt:   time.Now().UTC(),
 	})
@@ -118,12 +184,176 @@ func (r *Repo) Delete(c context.Context, userID, id primitive.ObjectID) error {
 	return nil
 }
 
+func (r *Repo) SoftDelete(c context.Context, userID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"ui":  userID,
+		"da":  notDeleted,
+	}, bson.M{
+		"$set": bson.M{
+			"da": time.Now().UTC(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Restore(c context.Context, userID, id primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"ui":  userID,
+		"da": bson.M{
+			"$exists": true,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"wa": time.Now().UTC(),
+		},
+		"$unset": bson.M{
+			"da": "",
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.ModifiedCount != 0, nil
+}
+
+func (r *Repo) GetDeletedByUserID(c context.Context, userID primitive.ObjectID) ([]Bot, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"ui": userID,
+		"da": bson.M{
+			"$exists": true,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Bot
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *Repo) GetDeletedBefore(c context.Context, before time.Time, limit int64) ([]Bot, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"da": bson.M{
+			"$lt": before,
+		},
+	}, options.Find().SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Bot
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *Repo) GetByID(c context.Context, userID, id primitive.ObjectID) (Bot, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var bot Bot
+	err := r.coll.FindOne(ctx, bson.M{
+		"_id": id,
+		"ui":  userID,
+		"da":  notDeleted,
+	}).Decode(&bot)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Bot{}, false, nil
+		}
+
+		return Bot{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return bot, true, nil
+}
+
+// GetByIDAnyOwner gets a not deleted bot whoever owns it now, jobs stored before a transfer keep the former owner
+func (r *Repo) GetByIDAnyOwner(c context.Context, id primitive.ObjectID) (Bot, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var bot Bot
+	err := r.coll.FindOne(ctx, bson.M{
+		"_id": id,
+		"da":  notDeleted,
+	}).Decode(&bot)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Bot{}, false, nil
+		}
+
+		return Bot{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return bot, true, nil
+}
+
+// GetExistingIDs returns those of ids which belong to bots, including soft deleted ones. It reads from the
+// primary, so a bot created right before is not taken for a missing one
+func (r *Repo) GetExistingIDs(c context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]struct{}, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	cur, err := r.primary.Find(ctx, bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	}, options.Find().SetProjection(bson.M{
+		"_id": 1,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("r.primary.Find: %w", err)
+	}
+
+	var docs []m.Doc
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	res := make(map[primitive.ObjectID]struct{}, len(docs))
+	for _, doc := range docs {
+		res[doc.ID] = struct{}{}
+	}
+
+	return res, nil
+}
+
 func (r *Repo) GetByUserID(c context.Context, userID primitive.ObjectID) ([]Bot, error) {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
 	cur, err := r.coll.Find(ctx, bson.M{
 		"ui": userID,
+		"da": notDeleted,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("r.coll.Find: %w", err)
@@ -151,7 +381,9 @@ func (r *Repo) Get(c context.Context) chan Item {
 		defer cancel()
 		defer close(res)
 
-		cur, err := r.coll.Find(ctx, bson.M{})
+		cur, err := r.coll.Find(ctx, bson.M{
+			"da": notDeleted,
+		})
 		if err != nil {
 			res <- Item{
 				Err: fmt.Errorf("r.coll.Find: %w", err),
@@ -187,7 +419,8 @@ func (r *Repo) GetByToken(c context.Context, token string) (Bot, bool, error) {
 
 	var bot Bot
 	err := r.coll.FindOne(ctx, bson.M{
-		"t": token,
+		"t":  token,
+		"da": notDeleted,
 	}).Decode(&bot)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -236,7 +469,7 @@ func (r *Repo) SetUserChatID(c context.Context, id primitive.ObjectID, userChatI
 	return nil
 }
 
-func (r *Repo) SetOnPeerStart(c context.Context, id primitive.ObjectID, onPeerStart string) error {
+func (r *Repo) SetSnippets(c context.Context, id primitive.ObjectID, snippets []Snippet) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
@@ -244,7 +477,7 @@ func (r *Repo) SetOnPeerStart(c context.Context, id primitive.ObjectID, onPeerSt
 		"_id": id,
 	}, bson.M{
 		"$set": bson.M{
-			"ops": onPeerStart,
+			"sn": snippets,
 		},
 	})
 	if err != nil {
@@ -254,7 +487,218 @@ func (r *Repo) SetOnPeerStart(c context.Context, id primitive.ObjectID, onPeerSt
 	return nil
 }
 
-func (r *Repo) SetSetupDoneTrue(c context.Context, id primitive.ObjectID) error {
+// settingsOf is the versioned settings of the bot as fields of its document
+func settingsOf(bot Bot) bson.M {
+	return bson.M{
+		"m":   bot.Mode,
+		"ops": bot.OnPeerStart,
+		"opm": bot.StartMedia,
+		"opb": bot.StartButtons,
+		"mn":  bot.Menu,
+		"mk":  bot.MenuKeyboard,
+		"sp":  bot.StartPayloads,
+		"k":   bot.Keywords,
+	}
+}
+
+// SetSettings replaces the versioned settings of the bot, and marks its setup done if the bot says so. Counters
+// of the bot's rules which are gone are removed
+func (r *Repo) SetSettings(c context.Context, id primitive.ObjectID, bot Bot) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	bot.Keywords = withKeywordIDs(bot.Keywords)
+	set := settingsOf(bot)
+	if bot.SetupDone {
+		set["sd"] = true
+	}
+	upd := bson.M{
+		"$set": set,
+	}
+	if stale := staleCounters(bot); len(stale) != 0 {
+		upd["$unset"] = stale
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func staleCounters(bot Bot) bson.M {
+	res := bson.M{}
+	for key := range bot.Counters {
+		id, err := primitive.ObjectIDFromHex(key)
+		if err == nil {
+			if _, found := findKeyword(bot, id); found {
+				continue
+			}
+		}
+		res["kc."+key] = ""
+	}
+	return res
+}
+
+// withKeywordIDs assigns IDs to new rules, so the rule editor can change them one by one
+func withKeywordIDs(keywords []Keyword) []Keyword {
+	res := make([]Keyword, len(keywords))
+	for i, kw := range keywords {
+		if kw.ID.IsZero() {
+			kw.ID = primitive.NewObjectID()
+		}
+		res[i] = kw
+	}
+	return res
+}
+
+// SetKeywordIDs assigns IDs to rules created before the rule editor, ids are keyed by rule index
+func (r *Repo) SetKeywordIDs(c context.Context, id primitive.ObjectID, ids map[int]primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": id,
+	}
+	set := bson.M{}
+	for i, kwID := range ids {
+		key := fmt.Sprintf("k.%d.id", i)
+		filter[key] = bson.M{
+			"$exists": false,
+		}
+		set[key] = kwID
+	}
+
+	_, err := r.coll.UpdateOne(ctx, filter, bson.M{
+		"$set": set,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// AddKeyword appends the rule unless the bot already has limit rules
+func (r *Repo) AddKeyword(c context.Context, id primitive.ObjectID, kw Keyword, limit uint16) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		fmt.Sprintf("k.%d", limit-1): bson.M{
+			"$exists": false,
+		},
+	}, bson.M{
+		"$push": bson.M{
+			"k": kw,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return res.MatchedCount != 0, nil
+}
+
+func (r *Repo) UpdateKeyword(c context.Context, id primitive.ObjectID, kw Keyword) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id":  id,
+		"k.id": kw.ID,
+	}, bson.M{
+		"$set": bson.M{
+			"k.$": kw,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return res.MatchedCount != 0, nil
+}
+
+func (r *Repo) DeleteKeyword(c context.Context, id, keywordID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id":  id,
+		"k.id": keywordID,
+	}, bson.M{
+		"$pull": bson.M{
+			"k": bson.M{
+				"id": keywordID,
+			},
+		},
+		"$unset": bson.M{
+			"kc." + keywordID.Hex(): "",
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return res.MatchedCount != 0, nil
+}
+
+// SwapKeywords swaps rules a at index i and b at index j if they are still there
+func (r *Repo) SwapKeywords(c context.Context, id primitive.ObjectID, i, j int, a, b Keyword) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	res, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id":                     id,
+		fmt.Sprintf("k.%d.id", i): a.ID,
+		fmt.Sprintf("k.%d.id", j): b.ID,
+	}, bson.M{
+		"$set": bson.M{
+			fmt.Sprintf("k.%d", i): b,
+			fmt.Sprintf("k.%d", j): a,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return res.MatchedCount != 0, nil
+}
+
+// NextKeywordCounter increments the reply counter of the rule and returns its previous value
+func (r *Repo) NextKeywordCounter(c context.Context, id, keywordID primitive.ObjectID) (uint64, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	key := "kc." + keywordID.Hex()
+	var bot Bot
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{
+		"_id":  id,
+		"k.id": keywordID,
+	}, bson.M{
+		"$inc": bson.M{
+			key: 1,
+		},
+	}, options.FindOneAndUpdate().SetProjection(bson.M{
+		key: 1,
+	})).Decode(&bot)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, false, nil
+		}
+
+		return 0, false, fmt.Errorf("r.coll.FindOneAndUpdate: %w", err)
+	}
+
+	return bot.Counters[keywordID.Hex()], true, nil
+}
+
+// SetMode sets how the rules are applied and marks the setup done
+func (r *Repo) SetMode(c context.Context, id primitive.ObjectID, m mode) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
@@ -262,6 +706,7 @@ func (r *Repo) SetSetupDoneTrue(c context.Context, id primitive.ObjectID) error
 		"_id": id,
 	}, bson.M{
 		"$set": bson.M{
+			"m":  m,
 			"sd": true,
 		},
 	})
@@ -272,7 +717,119 @@ func (r *Repo) SetSetupDoneTrue(c context.Context, id primitive.ObjectID) error
 	return nil
 }
 
-func (r *Repo) SetKeywordsAndMode(c context.Context, id primitive.ObjectID, keywords []Keyword, mode mode) error {
+func (r *Repo) SetPaused(c context.Context, userID, id primitive.ObjectID, paused bool) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"ui":  userID,
+	}, bson.M{
+		"$set": bson.M{
+			"p": paused,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) SetToken(c context.Context, userID, id primitive.ObjectID, token, username string) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"ui":  userID,
+	}, bson.M{
+		"$set": bson.M{
+			"t":  token,
+			"un": username,
+			"wa": time.Now().UTC(),
+		},
+		"$unset": bson.M{
+			"tfa": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetTokenFailed marks the token as rejected by Telegram, or clears the mark once it works again
+func (r *Repo) SetTokenFailed(c context.Context, id primitive.ObjectID, failed bool) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	upd := bson.M{
+		"$unset": bson.M{
+			"tfa": "",
+		},
+	}
+	if failed {
+		upd = bson.M{
+			"$set": bson.M{
+				"tfa": time.Now().UTC(),
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetUsername stores the username of the bot, so cards do not call Telegram
+func (r *Repo) SetUsername(c context.Context, id primitive.ObjectID, username string) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$set": bson.M{
+			"un": username,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetOwner moves the bot to another user. Forwards go to the private chat of the new owner
+func (r *Repo) SetOwner(c context.Context, fromUserID, id, toUserID primitive.ObjectID, toChatID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"ui":  fromUserID,
+		"da":  notDeleted,
+	}, bson.M{
+		"$set": bson.M{
+			"ui":  toUserID,
+			"uci": toChatID,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.ModifiedCount != 0, nil
+}
+
+func (r *Repo) SetForwardMode(c context.Context, id primitive.ObjectID, fm forwardMode) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
@@ -280,8 +837,7 @@ func (r *Repo) SetKeywordsAndMode(c context.Context, id primitive.ObjectID, keyw
 		"_id": id,
 	}, bson.M{
 		"$set": bson.M{
-			"k": keywords,
-			"m": mode,
+			"fm": fm,
 		},
 	})
 	if err != nil {
@@ -290,3 +846,130 @@ func (r *Repo) SetKeywordsAndMode(c context.Context, id primitive.ObjectID, keyw
 
 	return nil
 }
+
+// NextRoundRobin increments the round robin counter and returns its previous value
+func (r *Repo) NextRoundRobin(c context.Context, id primitive.ObjectID) (uint64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var bot Bot
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$inc": bson.M{
+			"rr": 1,
+		},
+	}, options.FindOneAndUpdate().SetProjection(bson.M{
+		"rr": 1,
+	})).Decode(&bot)
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.FindOneAndUpdate: %w", err)
+	}
+
+	return bot.RoundRobin, nil
+}
+
+// SetForumChatID attaches a forum supergroup for forwards, zero detaches it
+func (r *Repo) SetForumChatID(c context.Context, id primitive.ObjectID, chatID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	upd := bson.M{
+		"$set": bson.M{
+			"fci": chatID,
+		},
+	}
+	if chatID == 0 {
+		upd = bson.M{
+			"$unset": bson.M{
+				"fci": "",
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetReplyDelay sets the default reply delay of the bot, a zero range turns it off
+func (r *Repo) SetReplyDelay(c context.Context, id primitive.ObjectID, d DelayRange) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	upd := bson.M{
+		"$set": bson.M{
+			"dl": d,
+		},
+	}
+	if d.Max == 0 {
+		upd = bson.M{
+			"$unset": bson.M{
+				"dl": "",
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetRetention overrides retention of the bot data per kind
+func (r *Repo) SetRetention(c context.Context, id primitive.ObjectID, ret Retention) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	upd := bson.M{
+		"$set": bson.M{
+			"rt": ret,
+		},
+	}
+	if ret == (Retention{}) {
+		upd = bson.M{
+			"$unset": bson.M{
+				"rt": "",
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetAllByUserID returns bots of the user including soft deleted ones
+func (r *Repo) GetAllByUserID(c context.Context, userID primitive.ObjectID) ([]Bot, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"ui": userID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Bot
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,186 @@
+package child_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention overrides the number of days each kind of the bot data is kept, zero is the default
+type Retention struct {
+	Messages uint16 `bson:"m,omitempty"`
+	Replies  uint16 `bson:"r,omitempty"`
+	Peers    uint16 `bson:"p,omitempty"`
+}
+
+const (
+	retentionMessages = "история"
+	retentionReplies  = "ответы"
+	retentionPeers    = "собеседники"
+
+	backfillLeaderTask = "backfill_expiry"
+	// backfillLease keeps other instances starting meanwhile from repeating the backfill
+	backfillLease = 24 * time.Hour
+)
+
+// pickDays returns the override of the kind, or the default
+func pickDays(days, def uint16) uint16 {
+	if days != 0 {
+		return days
+	}
+	return def
+}
+
+func (s *service) messagesDays(bot Bot) uint16 {
+	return pickDays(bot.Retention.Messages, s.messagesRetention)
+}
+
+func (s *service) repliesDays(bot Bot) uint16 {
+	return pickDays(bot.Retention.Replies, s.repliesRetention)
+}
+
+func (s *service) peersDays(bot Bot) uint16 {
+	return pickDays(bot.Retention.Peers, s.peersRetention)
+}
+
+func expireAt(days uint16) time.Time {
+	return time.Now().UTC().Add(time.Duration(days) * 24 * time.Hour)
+}
+
+// parseRetention applies 'N' to every kind or 'kind N' to one kind. The error is ready to be shown to the user
+func parseRetention(in string, bot Bot) (Retention, error) {
+	res := bot.Retention
+
+	fields := strings.Fields(strings.ToLower(in))
+	if len(fields) == 0 || len(fields) > 2 {
+		return Retention{}, errors.New("укажите число дней, или что хранить и число дней")
+	}
+
+	days, err := strconv.ParseUint(fields[len(fields)-1], 10, 16)
+	if err != nil || days > retentionMaxDays {
+		return Retention{}, fmt.Errorf("укажите число дней от 1 до %d, или 0 для значения по умолчанию",
+			retentionMaxDays)
+	}
+
+	if len(fields) == 1 {
+		return Retention{
+			Messages: uint16(days),
+			Replies:  uint16(days),
+			Peers:    uint16(days),
+		}, nil
+	}
+
+	switch fields[0] {
+	case retentionMessages:
+		res.Messages = uint16(days)
+	case retentionReplies:
+		res.Replies = uint16(days)
+	case retentionPeers:
+		res.Peers = uint16(days)
+	default:
+		return Retention{}, fmt.Errorf("'%s' — что хранить: %s, %s или %s", fields[0], retentionMessages,
+			retentionReplies, retentionPeers)
+	}
+	return res, nil
+}
+
+func (s *service) handleOwnerRetention(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(upd.Message.Text, retention))
+	if arg == "" {
+		err := s.reply(api, upd, fmt.Sprintf(`Сколько дней хранятся данные бота:
+
+История сообщений (%s) — %d дн.
+Ответить через пересланное сообщение (%s) можно %d дн.
+Собеседники без новых сообщений (%s) — %d дн. Забаненные хранятся всегда
+
+Изменить срок для всех данных бота: %s N, где N — число дней от 1 до %d. Для одного вида данных: %s %s N. Вернуть значение по умолчанию: 0 вместо N`,
+			retentionMessages,
+			s.messagesDays(bot),
+			retentionReplies,
+			s.repliesDays(bot),
+			retentionPeers,
+			s.peersDays(bot),
+			retention,
+			retentionMaxDays,
+			retention,
+			retentionMessages,
+		))
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	ret, err := parseRetention(arg, bot)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Не изменено: %s", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	err = s.childBotRepo.SetRetention(ctx, bot.ID, ret)
+	if err != nil {
+		return fmt.Errorf("s.childBotRepo.SetRetention: %w", err)
+	}
+
+	bot.Retention = ret
+	err = s.replyOK(api, upd, fmt.Sprintf("История хранится %d дн., ответить можно %d дн., собеседники хранятся "+
+		"%d дн. Сроки применяются к новым сообщениям", s.messagesDays(bot), s.repliesDays(bot), s.peersDays(bot)))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	return nil
+}
+
+// backfillExpireAt sets expiry on peers, replies and logged messages stored before retention existed, counting
+// the retention of each bot from now. Documents with expiry are not touched, so repeated runs are harmless
+func (s *service) backfillExpireAt(ctx context.Context) {
+	leader, err := s.leaderRepo.Acquire(ctx, backfillLeaderTask, s.instanceID, backfillLease)
+	if err != nil {
+		s.logger.Error().Err(err).Send()
+		return
+	}
+	if !leader {
+		return
+	}
+
+	var total int64
+	for item := range s.childBotRepo.Get(ctx) {
+		if item.Err != nil {
+			s.logger.Error().Err(item.Err).Send()
+			return
+		}
+		bot := item.Doc
+
+		peers, err := s.peerRepo.BackfillExpireAt(ctx, bot.ID, expireAt(s.peersDays(bot)))
+		if err != nil {
+			s.logger.Error().Err(err).Str("childBotID", bot.ID.Hex()).Send()
+			continue
+		}
+
+		replies, err := s.replyRepo.BackfillExpireAt(ctx, bot.ID, expireAt(s.repliesDays(bot)))
+		if err != nil {
+			s.logger.Error().Err(err).Str("childBotID", bot.ID.Hex()).Send()
+			continue
+		}
+
+		messages, err := s.msglogRepo.BackfillExpireAt(ctx, bot.ID, expireAt(s.messagesDays(bot)))
+		if err != nil {
+			s.logger.Error().Err(err).Str("childBotID", bot.ID.Hex()).Send()
+			continue
+		}
+
+		total += peers + replies + messages
+	}
+
+	if total != 0 {
+		s.logger.Info().Int64("documents", total).Msg("expiry backfilled")
+	}
+}
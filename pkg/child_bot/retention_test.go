@@ -0,0 +1,32 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRetention(t *testing.T) {
+	ret, err := parseRetention("30", Bot{})
+	assert.NoError(t, err)
+	assert.Equal(t, Retention{Messages: 30, Replies: 30, Peers: 30}, ret)
+
+	ret, err = parseRetention("Ответы 7", Bot{Retention: Retention{Messages: 60, Replies: 60, Peers: 60}})
+	assert.NoError(t, err)
+	assert.Equal(t, Retention{Messages: 60, Replies: 7, Peers: 60}, ret)
+
+	ret, err = parseRetention("собеседники 0", Bot{Retention: Retention{Peers: 10, Messages: 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, Retention{Messages: 5}, ret)
+
+	_, err = parseRetention("файлы 7", Bot{})
+	assert.Error(t, err)
+	_, err = parseRetention("история", Bot{})
+	assert.Error(t, err)
+	_, err = parseRetention("99999", Bot{})
+	assert.Error(t, err)
+}
+
+func TestPickDays(t *testing.T) {
+	assert.Equal(t, uint16(5), pickDays(5, 90))
+	assert.Equal(t, uint16(90), pickDays(0, 90))
+}
@@ -0,0 +1,645 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	rulesCallbackTag = "r"
+	ruleButtonChars  = 40
+	sourceEditor     = "редактор правил"
+
+	ruleOpList   = "l"
+	ruleOpView   = "v"
+	ruleOpAdd    = "a"
+	ruleOpMode   = "m"
+	ruleOpIn     = "k"
+	ruleOpOut    = "o"
+	ruleOpBan    = "b"
+	ruleOpUp     = "u"
+	ruleOpDown   = "d"
+	ruleOpDelete = "x"
+	ruleOpOrder  = "r"
+	ruleOpFormat = "f"
+	ruleOpLinks  = "p"
+	ruleOpMedia  = "i"
+	ruleOpButton = "n"
+	ruleOpDelay  = "t"
+)
+
+func (s *service) handleOwnerRules(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	bot, err := s.ensureKeywordIDs(ctx, bot)
+	if err != nil {
+		return fmt.Errorf("s.ensureKeywordIDs: %w", err)
+	}
+
+	text, markup := s.rulesList(bot)
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, text)
+	msg.ReplyMarkup = markup
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+// ensureKeywordIDs assigns IDs to rules saved before the editor existed
+func (s *service) ensureKeywordIDs(ctx context.Context, bot Bot) (Bot, error) {
+	ids := map[int]primitive.ObjectID{}
+	for i, kw := range bot.Keywords {
+		if kw.ID.IsZero() {
+			ids[i] = primitive.NewObjectID()
+		}
+	}
+	if len(ids) == 0 {
+		return bot, nil
+	}
+
+	err := s.childBotRepo.SetKeywordIDs(ctx, bot.ID, ids)
+	if err != nil {
+		return Bot{}, fmt.Errorf("s.childBotRepo.SetKeywordIDs: %w", err)
+	}
+
+	return s.reloadBot(ctx, bot)
+}
+
+// reloadBot reads the bot from the primary, so a change written just before is seen
+func (s *service) reloadBot(ctx context.Context, bot Bot) (Bot, error) {
+	res, found, err := s.childBotRepo.Primary().GetByToken(ctx, bot.Token)
+	if err != nil {
+		return Bot{}, fmt.Errorf("s.childBotRepo.GetByToken: %w", err)
+	}
+	if !found {
+		return bot, nil
+	}
+	return res, nil
+}
+
+// handleRulesCallback handles buttons of the rule editor. Every change is stored per rule, a rule which was
+// changed meanwhile by someone else is left as is and the fresh state is shown
+func (s *service) handleRulesCallback(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	cb callbackQuery,
+	bot Bot,
+	usr user.User,
+) error {
+	op, kwID, ok := parseRulesCallback(cb.Data)
+	if !ok {
+		return nil
+	}
+
+	switch op {
+	case ruleOpList:
+		return s.editRulesMessage(api, cb, bot, primitive.NilObjectID)
+	case ruleOpAdd:
+		if len(bot.Keywords) >= int(s.keywordsLimitPerBot) {
+			return s.editRulesMessage(api, cb, bot, primitive.NilObjectID)
+		}
+
+		err := s.childStateRepo.SetScene(ctx, usr.ID, bot.ID, child_state.AddRuleIn)
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+		}
+
+		return s.sendRulePrompt(api, cb, fmt.Sprintf("Напишите через запятую ключевые слова нового правила, "+
+			"не более %d. Например: реклама, прайс", s.inLimitPerKeyword))
+	case ruleOpMode:
+		m := OnlyFirst
+		if bot.Mode == OnlyFirst {
+			m = Always
+		}
+
+		next, _, err := s.applyChange(ctx, bot, cb.From, sourceEditor, func(tc context.Context) (bool, error) {
+			e := s.childBotRepo.SetMode(tc, bot.ID, m)
+			if e != nil {
+				return false, fmt.Errorf("s.childBotRepo.SetMode: %w", e)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("s.applyChange: %w", err)
+		}
+
+		return s.editRulesMessage(api, cb, next, primitive.NilObjectID)
+	}
+
+	i, found := findKeyword(bot, kwID)
+	if !found {
+		return s.editRulesMessage(api, cb, bot, primitive.NilObjectID)
+	}
+	kw := bot.Keywords[i]
+
+	var (
+		change func(context.Context) (bool, error)
+		err    error
+	)
+	switch op {
+	case ruleOpView:
+		return s.editRulesMessage(api, cb, bot, kwID)
+	case ruleOpIn:
+		err = s.childStateRepo.SetSceneWithPayload(ctx, usr.ID, bot.ID, child_state.EditRuleIn, kwID.Hex())
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+		}
+
+		return s.sendRulePrompt(api, cb, fmt.Sprintf("Сейчас: %s\n\nНапишите через запятую новые ключевые слова "+
+			"правила %d, не более %d", strings.Join(kw.In, comma), i+1, s.inLimitPerKeyword))
+	case ruleOpOut:
+		err = s.childStateRepo.SetSceneWithPayload(ctx, usr.ID, bot.ID, child_state.EditRuleOut, kwID.Hex())
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+		}
+
+		return s.sendRulePrompt(api, cb, fmt.Sprintf("Напишите новый автоответ правила %d, не более %d символов. "+
+			"Несколько вариантов ответа разделите строкой '%s'. Можно использовать %s", i+1, s.outLimitChars,
+			variantsDelim, tplHelp))
+	case ruleOpMedia:
+		err = s.childStateRepo.SetSceneWithPayload(ctx, usr.ID, bot.ID, child_state.EditRuleMedia, kwID.Hex())
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+		}
+
+		return s.sendRulePrompt(api, cb, fmt.Sprintf("Отправьте фото, документ или видео, бот приложит его к "+
+			"автоответу правила %d. '%s' — убрать вложение", i+1, buttonsNone))
+	case ruleOpButton:
+		err = s.childStateRepo.SetSceneWithPayload(ctx, usr.ID, bot.ID, child_state.EditRuleButton, kwID.Hex())
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+		}
+
+		return s.sendRulePrompt(api, cb, fmt.Sprintf("Кнопки правила %d сейчас:\n%s\n\n%s", i+1,
+			tplButtons(kw.Buttons), buttonsHelp))
+	case ruleOpFormat:
+		kw.ParseMode = (kw.ParseMode + 1) % (ParseMarkdown + 1)
+		e := s.checkVariants(kw.outs(), kw.ParseMode)
+		if e != nil {
+			_, err = api.Send(tgbotapi.NewMessage(cb.Message.Chat.ID, fmt.Sprintf("Ошибка. Автоответ правила %d "+
+				"не подходит для разметки %s: %s. Сначала исправьте автоответ", i+1, kw.ParseMode, e)))
+			if err != nil {
+				return fmt.Errorf("api.Send: %w", err)
+			}
+			return nil
+		}
+
+		change = func(tc context.Context) (bool, error) {
+			return s.childBotRepo.UpdateKeyword(tc, bot.ID, kw)
+		}
+	case ruleOpBan, ruleOpOrder, ruleOpLinks, ruleOpDelay:
+		switch op {
+		case ruleOpBan:
+			kw.Ban = !kw.Ban
+		case ruleOpOrder:
+			kw.RoundRobin = !kw.RoundRobin
+		case ruleOpDelay:
+			kw.Delay = nextDelayPreset(kw.Delay)
+		default:
+			kw.NoPreview = !kw.NoPreview
+		}
+
+		change = func(tc context.Context) (bool, error) {
+			return s.childBotRepo.UpdateKeyword(tc, bot.ID, kw)
+		}
+	case ruleOpUp, ruleOpDown:
+		j := i - 1
+		if op == ruleOpDown {
+			j = i + 1
+		}
+		if j < 0 || j >= len(bot.Keywords) {
+			return nil
+		}
+
+		other := bot.Keywords[j]
+		change = func(tc context.Context) (bool, error) {
+			return s.childBotRepo.SwapKeywords(tc, bot.ID, i, j, kw, other)
+		}
+	case ruleOpDelete:
+		change = func(tc context.Context) (bool, error) {
+			return s.childBotRepo.DeleteKeyword(tc, bot.ID, kw.ID)
+		}
+		kwID = primitive.NilObjectID
+	default:
+		return nil
+	}
+
+	// the rule is shown, or the list for zero kwID
+	next, _, err := s.applyChange(ctx, bot, cb.From, sourceEditor, change)
+	if err != nil {
+		return fmt.Errorf("s.applyChange: %w", err)
+	}
+	return s.editRulesMessage(api, cb, next, kwID)
+}
+
+func (s *service) editRulesMessage(api *tgbotapi.BotAPI, cb callbackQuery, bot Bot, kwID primitive.ObjectID) error {
+	text, markup := s.rulesList(bot)
+	if i, found := findKeyword(bot, kwID); found {
+		text, markup = s.ruleView(bot, i)
+	}
+
+	edit := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, int(cb.Message.MessageID), text)
+	edit.ReplyMarkup = &markup
+	_, err := api.Send(edit)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) sendRulePrompt(api *tgbotapi.BotAPI, cb callbackQuery, text string) error {
+	_, err := api.Send(tgbotapi.NewMessage(cb.Message.Chat.ID, fmt.Sprintf("%s\n\n%s — отмена", text, help)))
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+	return nil
+}
+
+// onRuleText handles the text or media asked by the rule editor
+func (s *service) onRuleText(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	usr user.User,
+	st child_state.State,
+	media *Media,
+) error {
+	text := upd.Message.Text
+
+	var (
+		in      []string
+		outs    []string
+		buttons []Button
+	)
+	switch st.Scene {
+	case child_state.EditRuleMedia:
+		if media == nil && strings.TrimSpace(text) != buttonsNone {
+			err := s.replyErr(api, upd, fmt.Sprintf("Отправьте фото, документ или видео, или '%s' чтобы убрать "+
+				"вложение", buttonsNone))
+			if err != nil {
+				return fmt.Errorf("s.replyErr: %w", err)
+			}
+			return nil
+		}
+	case child_state.EditRuleButton:
+		res, err := parseButtons(text)
+		if err != nil {
+			e := s.replyErr(api, upd, fmt.Sprintf("Кнопки не сохранены: %s. Попробуйте еще раз", err))
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+		buttons = res
+	case child_state.AddRuleIn, child_state.EditRuleIn:
+		res, ok := s.parseIn(text)
+		if !ok {
+			err := s.replyErr(api, upd, fmt.Sprintf("Нужны ключевые слова через запятую, не более %d, каждое "+
+				"не длиннее %d символов. Попробуйте еще раз", s.inLimitPerKeyword, s.inLimitChars))
+			if err != nil {
+				return fmt.Errorf("s.replyErr: %w", err)
+			}
+			return nil
+		}
+		in = res
+	default:
+		pm := ParsePlain
+		if st.Scene == child_state.EditRuleOut {
+			kwID, e := primitive.ObjectIDFromHex(st.Payload)
+			if e != nil {
+				return fmt.Errorf("primitive.ObjectIDFromHex: %w", e)
+			}
+			if i, found := findKeyword(bot, kwID); found {
+				pm = bot.Keywords[i].ParseMode
+			}
+		}
+
+		outs = splitVariants(text)
+		err := s.checkVariants(outs, pm)
+		if err != nil {
+			e := s.replyErr(api, upd, fmt.Sprintf("Автоответ не сохранен: %s. Попробуйте еще раз", err))
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+	}
+
+	if st.Scene == child_state.AddRuleIn {
+		err := s.childStateRepo.SetSceneWithPayload(ctx, usr.ID, bot.ID, child_state.AddRuleOut,
+			strings.Join(in, comma))
+		if err != nil {
+			return fmt.Errorf("s.childStateRepo.SetSceneWithPayload: %w", err)
+		}
+
+		err = s.reply(api, upd, fmt.Sprintf("Теперь напишите автоответ, не более %d символов. Несколько "+
+			"вариантов ответа разделите строкой '%s'. Можно использовать %s. Бан можно будет включить кнопкой",
+			s.outLimitChars, variantsDelim, tplHelp))
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	err := s.childStateRepo.SetScene(ctx, usr.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	var (
+		kw      Keyword
+		change  func(context.Context) (bool, error)
+		failure string
+	)
+	if st.Scene == child_state.AddRuleOut {
+		kw = Keyword{
+			ID: primitive.NewObjectID(),
+			In: strings.Split(st.Payload, comma),
+		}
+		kw.setOuts(outs)
+		change = func(tc context.Context) (bool, error) {
+			return s.childBotRepo.AddKeyword(tc, bot.ID, kw, s.keywordsLimitPerBot)
+		}
+		failure = fmt.Sprintf("Правил уже %d, больше добавить нельзя", s.keywordsLimitPerBot)
+	} else {
+		kwID, e := primitive.ObjectIDFromHex(st.Payload)
+		if e != nil {
+			return fmt.Errorf("primitive.ObjectIDFromHex: %w", e)
+		}
+
+		i, found := findKeyword(bot, kwID)
+		if found {
+			kw = bot.Keywords[i]
+			switch st.Scene {
+			case child_state.EditRuleIn:
+				kw.In = in
+			case child_state.EditRuleMedia:
+				kw.Media = media
+			case child_state.EditRuleButton:
+				kw.Buttons = buttons
+			default:
+				kw.setOuts(outs)
+			}
+		}
+		change = func(tc context.Context) (bool, error) {
+			if !found {
+				return false, nil
+			}
+			return s.childBotRepo.UpdateKeyword(tc, bot.ID, kw)
+		}
+		failure = "Правило уже удалено"
+	}
+
+	next, changed, err := s.applyChange(ctx, bot, upd.Message.From, sourceEditor, change)
+	if err != nil {
+		return fmt.Errorf("s.applyChange: %w", err)
+	}
+	if !changed {
+		err = s.replyErr(api, upd, failure)
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	text, markup := s.rulesList(next)
+	if i, found := findKeyword(next, kw.ID); found {
+		text, markup = s.ruleView(next, i)
+	}
+
+	msg := tgbotapi.NewMessage(upd.Message.Chat.ID, "OK. "+text)
+	msg.ReplyMarkup = markup
+	_, err = api.Send(msg)
+	if err != nil {
+		return fmt.Errorf("api.Send: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) rulesList(bot Bot) (string, tgbotapi.InlineKeyboardMarkup) {
+	text := fmt.Sprintf("Правила автоответов (%d/%d). Режим: %s", len(bot.Keywords), s.keywordsLimitPerBot,
+		tplMode(bot.Mode))
+	if bot.Mode == None {
+		text += ". Пока режим не выбран, бот не отвечает"
+	}
+	text += "\n\nПравила проверяются сверху вниз, срабатывает первое подходящее. Нажмите на правило, чтобы " +
+		"изменить его"
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, kw := range bot.Keywords {
+		label := fmt.Sprintf("%d. %s", i+1, strings.Join(kw.In, comma))
+		if kw.Ban {
+			label = "⛔️ " + label
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncate(label, ruleButtonChars), rulesCallback(ruleOpView, kw.ID)),
+		))
+	}
+
+	var last []tgbotapi.InlineKeyboardButton
+	if len(bot.Keywords) < int(s.keywordsLimitPerBot) {
+		last = append(last, tgbotapi.NewInlineKeyboardButtonData("➕ Добавить",
+			rulesCallback(ruleOpAdd, primitive.NilObjectID)))
+	}
+	last = append(last, tgbotapi.NewInlineKeyboardButtonData("Сменить режим",
+		rulesCallback(ruleOpMode, primitive.NilObjectID)))
+	rows = append(rows, last)
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func (s *service) ruleView(bot Bot, i int) (string, tgbotapi.InlineKeyboardMarkup) {
+	kw := bot.Keywords[i]
+	text := fmt.Sprintf(`Правило %d из %d
+
+Ключевые слова: %s
+Бан: %s
+Разметка: %s, превью ссылок: %s
+Вложение: %s, кнопок: %d
+Задержка: %s
+
+Автоответ:
+%s`, i+1, len(bot.Keywords), strings.Join(kw.In, comma), boolToRU(kw.Ban), kw.ParseMode, boolToRU(!kw.NoPreview),
+		mediaKindOf(kw.Media), len(kw.Buttons), tplRuleDelay(kw), joinVariants(kw.outs()))
+
+	ban := "Включить бан"
+	if kw.Ban {
+		ban = "Выключить бан"
+	}
+
+	var move []tgbotapi.InlineKeyboardButton
+	if i > 0 {
+		move = append(move, tgbotapi.NewInlineKeyboardButtonData("⬆️ Выше", rulesCallback(ruleOpUp, kw.ID)))
+	}
+	if i < len(bot.Keywords)-1 {
+		move = append(move, tgbotapi.NewInlineKeyboardButtonData("⬇️ Ниже", rulesCallback(ruleOpDown, kw.ID)))
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Ключевые слова", rulesCallback(ruleOpIn, kw.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Автоответ", rulesCallback(ruleOpOut, kw.ID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(ban, rulesCallback(ruleOpBan, kw.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Удалить", rulesCallback(ruleOpDelete, kw.ID)),
+		),
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Разметка: "+kw.ParseMode.String(), rulesCallback(ruleOpFormat, kw.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("Превью: "+boolToRU(!kw.NoPreview), rulesCallback(ruleOpLinks, kw.ID)),
+	))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("📎 Вложение", rulesCallback(ruleOpMedia, kw.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("🔘 Кнопки", rulesCallback(ruleOpButton, kw.ID)),
+	))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⏳ Задержка: "+tplRuleDelay(kw), rulesCallback(ruleOpDelay, kw.ID)),
+	))
+	if len(kw.Variants) != 0 {
+		order := "Варианты: случайно"
+		if kw.RoundRobin {
+			order = "Варианты: по очереди"
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(order, rulesCallback(ruleOpOrder, kw.ID)),
+		))
+	}
+	if len(move) != 0 {
+		rows = append(rows, move)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ К списку", rulesCallback(ruleOpList, primitive.NilObjectID)),
+	))
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func findKeyword(bot Bot, kwID primitive.ObjectID) (int, bool) {
+	if kwID.IsZero() {
+		return 0, false
+	}
+	for i, kw := range bot.Keywords {
+		if kw.ID == kwID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// keepRuleSettings carries the ID, and with it the round robin counter, and the settings /set_keywords has no
+// format for over to the new rules with the same keywords. It also returns how many old rules with such settings
+// found no pair, their settings are lost
+func keepRuleSettings(prev, next []Keyword) ([]Keyword, int) {
+	used := make([]bool, len(prev))
+	res := make([]Keyword, len(next))
+	for i, kw := range next {
+		for j, p := range prev {
+			if used[j] || !sameIn(p.In, kw.In) {
+				continue
+			}
+			used[j] = true
+
+			kw.ID = p.ID
+			kw.RoundRobin = p.RoundRobin
+			kw.NoPreview = p.NoPreview
+			kw.Media = p.Media
+			kw.Buttons = p.Buttons
+			kw.Delay = p.Delay
+			if formatFits(kw.outs(), p.ParseMode) {
+				kw.ParseMode = p.ParseMode
+			}
+			break
+		}
+		res[i] = kw
+	}
+
+	var lost int
+	for j, p := range prev {
+		if !used[j] && hasRuleSettings(p) {
+			lost++
+		}
+	}
+	return res, lost
+}
+
+func sameIn(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]struct{}, len(a))
+	for _, in := range a {
+		set[in] = struct{}{}
+	}
+	for _, in := range b {
+		if _, ok := set[in]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func formatFits(outs []string, pm parseMode) bool {
+	for _, out := range outs {
+		if checkFormat(out, pm) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func hasRuleSettings(kw Keyword) bool {
+	return kw.RoundRobin || kw.ParseMode != ParsePlain || kw.NoPreview || kw.Media != nil || len(kw.Buttons) != 0 ||
+		kw.Delay != nil
+}
+
+func rulesCallback(op string, kwID primitive.ObjectID) string {
+	parts := []string{rulesCallbackTag, op}
+	if !kwID.IsZero() {
+		parts = append(parts, kwID.Hex())
+	}
+	return strings.Join(parts, callbackDelim)
+}
+
+func parseRulesCallback(data string) (string, primitive.ObjectID, bool) {
+	parts := strings.Split(data, callbackDelim)
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != rulesCallbackTag {
+		return "", primitive.NilObjectID, false
+	}
+	if len(parts) == 2 {
+		return parts[1], primitive.NilObjectID, true
+	}
+
+	kwID, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		return "", primitive.NilObjectID, false
+	}
+	return parts[1], kwID, true
+}
+
+func tplMode(m mode) string {
+	switch m {
+	case OnlyFirst:
+		return "только первое сообщение собеседника"
+	case Always:
+		return "все сообщения собеседника"
+	default:
+		return "не выбран"
+	}
+}
+
+func truncate(in string, chars int) string {
+	if utf8.RuneCountInString(in) <= chars {
+		return in
+	}
+	return string([]rune(in)[:chars-1]) + "…"
+}
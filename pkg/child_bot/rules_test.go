@@ -0,0 +1,74 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestRulesCallback(t *testing.T) {
+	kwID := primitive.NewObjectID()
+
+	data := rulesCallback(ruleOpBan, kwID)
+	assert.LessOrEqual(t, len(data), 64)
+
+	op, id, ok := parseRulesCallback(data)
+	assert.True(t, ok)
+	assert.Equal(t, ruleOpBan, op)
+	assert.Equal(t, kwID, id)
+
+	op, id, ok = parseRulesCallback(rulesCallback(ruleOpList, primitive.NilObjectID))
+	assert.True(t, ok)
+	assert.Equal(t, ruleOpList, op)
+	assert.True(t, id.IsZero())
+
+	_, _, ok = parseRulesCallback(historyCallback(1, 0))
+	assert.False(t, ok)
+}
+
+func TestKeepRuleSettings(t *testing.T) {
+	kwID := primitive.NewObjectID()
+	prev := []Keyword{{
+		ID:        kwID,
+		In:        []string{"реклама", "прайс"},
+		Out:       "<b>Прайс</b>",
+		ParseMode: ParseHTML,
+		Buttons:   []Button{{Text: "Сайт", URL: "https://example.com"}},
+	}, {
+		ID:    primitive.NewObjectID(),
+		In:    []string{"ваканс"},
+		Media: &Media{FileID: "f"},
+	}}
+
+	res, lost := keepRuleSettings(prev, []Keyword{
+		{In: []string{"прайс", "реклама"}, Out: "<i>Новый прайс</i>"},
+		{In: []string{"привет"}, Out: "Привет"},
+	})
+	assert.Equal(t, 1, lost)
+	assert.Equal(t, kwID, res[0].ID)
+	assert.Equal(t, "<i>Новый прайс</i>", res[0].Out)
+	assert.Equal(t, ParseHTML, res[0].ParseMode)
+	assert.Equal(t, prev[0].Buttons, res[0].Buttons)
+	assert.True(t, res[1].ID.IsZero())
+	assert.Nil(t, res[1].Media)
+
+	res, _ = keepRuleSettings(prev, []Keyword{{In: []string{"прайс", "реклама"}, Out: "<b>Прайс"}})
+	assert.Equal(t, ParsePlain, res[0].ParseMode)
+}
+
+func TestParseIn(t *testing.T) {
+	s := &service{
+		inLimitPerKeyword: 3,
+		inLimitChars:      10,
+	}
+
+	in, ok := s.parseIn(" Реклама, прайс,реклама")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"реклама", "прайс"}, in)
+
+	_, ok = s.parseIn("реклама,,прайс")
+	assert.False(t, ok)
+
+	_, ok = s.parseIn("a,b,c,d")
+	assert.False(t, ok)
+}
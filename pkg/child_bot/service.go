@@ -7,11 +7,19 @@ import (
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/rs/zerolog"
+	"github.com/vahter-robot/backend/pkg/broadcast"
 	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/invite"
+	"github.com/vahter-robot/backend/pkg/leader"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
 	"github.com/vahter-robot/backend/pkg/peer"
 	"github.com/vahter-robot/backend/pkg/reply"
+	"github.com/vahter-robot/backend/pkg/scheduled"
 	"github.com/vahter-robot/backend/pkg/user"
+	"github.com/vahter-robot/backend/pkg/version"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"net"
@@ -23,6 +31,7 @@ import (
 )
 
 type service struct {
+	client               *mongo.Client
 	childBotHost         string
 	childBotPort         string
 	childTokenPathPrefix string
@@ -31,11 +40,23 @@ type service struct {
 	peerRepo             *peer.Repo
 	childBotRepo         *Repo
 	replyRepo            *reply.Repo
+	operatorRepo         *operator.Repo
+	inviteRepo           *invite.Repo
+	msglogRepo           *msglog.Repo
+	versionRepo          *version.Repo
+	broadcastRepo        *broadcast.Repo
+	scheduledRepo        *scheduled.Repo
+	leaderRepo           *leader.Repo
+	instanceID           string
 	keywordsLimitPerBot  uint16
 	inLimitPerKeyword    uint16
 	inLimitChars         uint16
 	outLimitChars        uint16
-	parentBotUsername    string
+	repliesRetention     uint16
+	peersRetention       uint16
+	messagesRetention    uint16
+	location             *time.Location
+	parentBot            *tgbotapi.BotAPI
 	setWebhooks          bool
 	timeoutOnHandle      bool
 	logger               zerolog.Logger
@@ -43,6 +64,7 @@ type service struct {
 
 func NewService(
 	logger zerolog.Logger,
+	client *mongo.Client,
 	childBotHost,
 	childBotPort,
 	childTokenPathPrefix string,
@@ -51,15 +73,27 @@ func NewService(
 	peerRepo *peer.Repo,
 	childBotRepo *Repo,
 	replyRepo *reply.Repo,
+	operatorRepo *operator.Repo,
+	inviteRepo *invite.Repo,
+	msglogRepo *msglog.Repo,
+	versionRepo *version.Repo,
+	broadcastRepo *broadcast.Repo,
+	scheduledRepo *scheduled.Repo,
+	leaderRepo *leader.Repo,
 	keywordsLimitPerBot,
 	inLimitPerKeyword,
 	inLimitChars,
-	outLimitChars uint16,
-	parentBotUsername string,
+	outLimitChars,
+	repliesRetentionDays,
+	peersRetentionDays,
+	messagesRetentionDays uint16,
+	location *time.Location,
+	parentBot *tgbotapi.BotAPI,
 	setWebhooks,
 	timeoutOnHandle bool,
 ) *service {
 	return &service{
+		client:               client,
 		childBotHost:         childBotHost,
 		childBotPort:         childBotPort,
 		childTokenPathPrefix: childTokenPathPrefix,
@@ -68,11 +102,23 @@ func NewService(
 		peerRepo:             peerRepo,
 		childBotRepo:         childBotRepo,
 		replyRepo:            replyRepo,
+		operatorRepo:         operatorRepo,
+		inviteRepo:           inviteRepo,
+		msglogRepo:           msglogRepo,
+		versionRepo:          versionRepo,
+		broadcastRepo:        broadcastRepo,
+		scheduledRepo:        scheduledRepo,
+		leaderRepo:           leaderRepo,
+		instanceID:           primitive.NewObjectID().Hex(),
 		keywordsLimitPerBot:  keywordsLimitPerBot,
 		inLimitPerKeyword:    inLimitPerKeyword,
 		inLimitChars:         inLimitChars,
 		outLimitChars:        outLimitChars,
-		parentBotUsername:    parentBotUsername,
+		repliesRetention:     repliesRetentionDays,
+		peersRetention:       peersRetentionDays,
+		messagesRetention:    messagesRetentionDays,
+		location:             location,
+		parentBot:            parentBot,
 		setWebhooks:          setWebhooks,
 		timeoutOnHandle:      timeoutOnHandle,
 		logger:               logger.With().Str("package", "child_bot").Logger(),
@@ -80,16 +126,54 @@ func NewService(
 }
 
 const (
-	start       = "/start"
-	help        = "/help"
-	getStart    = "/get_start"
-	setStart    = "/set_start"
-	getKeywords = "/get_keywords"
-	setKeywords = "/set_keywords"
+	start          = "/start"
+	help           = "/help"
+	getStart       = "/get_start"
+	setStart       = "/set_start"
+	getKeywords    = "/get_keywords"
+	setKeywords    = "/set_keywords"
+	operators      = "/operators"
+	inviteAdmin    = "/invite_admin"
+	inviteAgent    = "/invite_agent"
+	setForwardMode = "/forward_mode"
+	attachGroup    = "/attach_group"
+	detachGroup    = "/detach_group"
+	history        = "/history"
+	search         = "/search"
+	retention      = "/retention"
+	forgetMe       = "/forget_me"
+	exportConfig   = "/export_config"
+	versions       = "/versions"
+	diffVersions   = "/diff"
+	rollback       = "/rollback"
+	testRules      = "/test"
+	editRules      = "/rules"
+	startButtons   = "/start_buttons"
+	editMenu       = "/menu"
+	startLinks     = "/start_links"
+	broadcastCmd   = "/broadcast"
+	later          = "/later"
+	scheduledList  = "/scheduled"
+	replyDelay     = "/delay"
+	snippetsCmd    = "/snippets"
+	peersCmd       = "/peers"
+	tagCmd         = "/tag"
+	untagCmd       = "/untag"
+	noteCmd        = "/note"
 
 	messageForward = "✉️ "
 	mute           = "mute"
 	unmute         = "unmute"
+	claim          = "claim"
+	unclaim        = "unclaim"
+
+	chatPrivate = "private"
+
+	retentionMaxDays = 3650
+
+	invitePrefix  = "inv_"
+	inviteCodeLen = 12
+	inviteTTL     = 24 * time.Hour
 
 	yes   = "да"
 	no    = "нет"
@@ -97,7 +181,29 @@ const (
 	comma = ","
 )
 
+// isTokenRejected reports whether Telegram answered 401 to the token, network failures do not count
+func isTokenRejected(err error) bool {
+	var tgErr tgbotapi.Error
+	return errors.As(err, &tgErr) && tgErr.Message == "Unauthorized"
+}
+
+// markTokenFailed stores that the token of the bot no longer works, so the bot card shows it
+func (s *service) markTokenFailed(ctx context.Context, bot Bot, err error) {
+	if !isTokenRejected(err) || !bot.TokenFailedAt.IsZero() {
+		return
+	}
+
+	e := s.childBotRepo.SetTokenFailed(ctx, bot.ID, true)
+	if e != nil {
+		s.logger.Error().Err(e).Str("childBotID", bot.ID.Hex()).Send()
+	}
+}
+
 func (s *service) Serve(ctx context.Context) error {
+	go s.serveBroadcasts(ctx)
+	go s.serveScheduled(ctx)
+	go s.backfillExpireAt(ctx)
+
 	if s.setWebhooks {
 		go func() {
 			wh := s.childBotRepo.Get(ctx)
@@ -110,9 +216,17 @@ func (s *service) Serve(ctx context.Context) error {
 				api, err := tgbotapi.NewBotAPI(item.Doc.Token)
 				if err != nil {
 					s.logger.Warn().Err(err).Send()
+					s.markTokenFailed(ctx, item.Doc, err)
 					continue
 				}
 
+				if !item.Doc.TokenFailedAt.IsZero() {
+					err = s.childBotRepo.SetTokenFailed(ctx, item.Doc.ID, false)
+					if err != nil {
+						s.logger.Error().Err(err).Send()
+					}
+				}
+
 				_, err = api.SetWebhook(tgbotapi.NewWebhook(fmt.Sprintf(
 					"%s/%s/%s", s.childBotHost, s.childTokenPathPrefix, item.Doc.Token,
 				)))
@@ -126,6 +240,14 @@ func (s *service) Serve(ctx context.Context) error {
 					s.logger.Error().Err(err).Send()
 					continue
 				}
+
+				if item.Doc.Username != api.Self.UserName {
+					err = s.childBotRepo.SetUsername(ctx, item.Doc.ID, api.Self.UserName)
+					if err != nil {
+						s.logger.Error().Err(err).Send()
+						continue
+					}
+				}
 			}
 		}()
 	}
@@ -186,15 +308,45 @@ func (s *service) Serve(ctx context.Context) error {
 }
 
 type update struct {
+	Message       message           `json:"message"`
+	EditedMessage message           `json:"edited_message"`
+	CallbackQuery callbackQuery     `json:"callback_query"`
+	MyChatMember  chatMemberUpdated `json:"my_chat_member"`
+}
+
+type callbackQuery struct {
+	ID      string  `json:"id"`
+	From    from    `json:"from"`
 	Message message `json:"message"`
+	Data    string  `json:"data"`
 }
 
 type message struct {
-	MessageID      int64          `json:"message_id"`
-	Chat           chat           `json:"chat"`
-	From           from           `json:"from"`
-	Text           string         `json:"text"`
-	ReplyToMessage replyToMessage `json:"reply_to_message"`
+	MessageID       int64          `json:"message_id"`
+	MessageThreadID int64          `json:"message_thread_id"`
+	IsTopicMessage  bool           `json:"is_topic_message"`
+	Chat            chat           `json:"chat"`
+	From            from           `json:"from"`
+	Text            string         `json:"text"`
+	ReplyToMessage  replyToMessage `json:"reply_to_message"`
+	Document        document       `json:"document"`
+	Photo           []photoSize    `json:"photo"`
+	Video           video          `json:"video"`
+	Caption         string         `json:"caption"`
+}
+
+type photoSize struct {
+	FileID string `json:"file_id"`
+}
+
+type video struct {
+	FileID string `json:"file_id"`
+}
+
+type document struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int    `json:"file_size"`
 }
 
 type replyToMessage struct {
@@ -204,11 +356,14 @@ type replyToMessage struct {
 }
 
 type chat struct {
-	ID int64 `json:"id"`
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	IsForum bool   `json:"is_forum"`
 }
 
 type from struct {
 	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
 	FirstName string `json:"first_name"`
 	Username  string `json:"username"`
 }
@@ -232,7 +387,9 @@ func (s *service) handle(ctx context.Context, token string, body io.ReadCloser)
 		return true, fmt.Errorf("json.Unmarshal: %w", err)
 	}
 
-	if upd.Message.Text == "" {
+	_, hasMedia := mediaOf(upd.Message)
+	if upd.Message.Text == "" && !hasMedia && upd.CallbackQuery.ID == "" && upd.EditedMessage.Text == "" &&
+		upd.MyChatMember.Chat.ID == 0 {
 		return true, nil
 	}
 
@@ -244,6 +401,14 @@ func (s *service) handle(ctx context.Context, token string, body io.ReadCloser)
 		return false, nil
 	}
 
+	if upd.MyChatMember.Chat.ID != 0 {
+		err = s.handleMyChatMember(ctx, upd.MyChatMember, bot)
+		if err != nil {
+			return true, fmt.Errorf("s.handleMyChatMember: %w", err)
+		}
+		return true, nil
+	}
+
 	var eg errgroup.Group
 	var owner user.User
 	eg.Go(func() error {
@@ -269,25 +434,99 @@ func (s *service) handle(ctx context.Context, token string, body io.ReadCloser)
 		return true, fmt.Errorf("eg.Wait: %w", err)
 	}
 
-	switch upd.Message.From.ID {
-	case owner.TgUserID:
-		err = s.handleOwner(ctx, api, upd, bot, owner)
+	if upd.EditedMessage.Text != "" {
+		err = s.handleEdit(ctx, api, upd.EditedMessage, bot, owner)
+		if err != nil {
+			return true, fmt.Errorf("s.handleEdit: %w", err)
+		}
+		return true, nil
+	}
+
+	if upd.CallbackQuery.ID != "" {
+		err = s.handleCallback(ctx, api, upd, bot, owner)
+		if err != nil {
+			return true, fmt.Errorf("s.handleCallback: %w", err)
+		}
+		return true, nil
+	}
+
+	if upd.Message.Chat.Type != chatPrivate {
+		err = s.handleGroup(ctx, api, upd, bot, owner)
+		if err != nil {
+			return true, fmt.Errorf("s.handleGroup: %w", err)
+		}
+		return true, nil
+	}
+
+	if upd.Message.From.ID == owner.TgUserID {
+		err = s.handleOwner(ctx, api, upd, bot, owner, operator.Admin)
 		if err != nil {
 			return true, fmt.Errorf("s.handleOwner: %w", err)
 		}
-	default:
-		err = s.handlePeer(ctx, api, upd, bot)
+		return true, nil
+	}
+
+	if strings.HasPrefix(upd.Message.Text, start+" "+invitePrefix) {
+		err = s.handleInvite(ctx, api, upd, bot)
+		if err != nil {
+			return true, fmt.Errorf("s.handleInvite: %w", err)
+		}
+		return true, nil
+	}
+
+	op, isOperator, err := s.operatorRepo.Get(ctx, bot.ID, upd.Message.From.ID)
+	if err != nil {
+		return true, fmt.Errorf("s.operatorRepo.Get: %w", err)
+	}
+
+	if isOperator {
+		usr, e := s.userRepo.Create(ctx, upd.Message.From.ID, upd.Message.Chat.ID)
+		if e != nil {
+			return true, fmt.Errorf("s.userRepo.Create: %w", e)
+		}
+
+		err = s.handleOwner(ctx, api, upd, bot, usr, op.Role)
 		if err != nil {
-			return true, fmt.Errorf("s.handlePeer: %w", err)
+			return true, fmt.Errorf("s.handleOwner: %w", err)
 		}
+		return true, nil
+	}
+
+	err = s.handlePeer(ctx, api, upd, bot, owner)
+	if err != nil {
+		return true, fmt.Errorf("s.handlePeer: %w", err)
 	}
 	return true, nil
 }
 
-func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
-	err := s.childBotRepo.SetUserChatID(ctx, bot.ID, upd.Message.Chat.ID)
-	if err != nil {
-		return fmt.Errorf("s.childBotRepo.SetUserChatID: %w", err)
+// handleOwner handles messages of the owner and operators. The owner is an admin, for operators owner is
+// their own user
+func (s *service) handleOwner(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	role operator.Role,
+) error {
+	isOwner := owner.ID == bot.OwnerUserID
+	if isOwner {
+		err := s.childBotRepo.SetUserChatID(ctx, bot.ID, upd.Message.Chat.ID)
+		if err != nil {
+			return fmt.Errorf("s.childBotRepo.SetUserChatID: %w", err)
+		}
+	}
+
+	if media, ok := mediaOf(upd.Message); ok {
+		if role == operator.Agent {
+			return nil
+		}
+
+		err := s.handleOwnerMedia(ctx, api, upd, bot, owner, media)
+		if err != nil {
+			return fmt.Errorf("s.handleOwnerMedia: %w", err)
+		}
+		return nil
 	}
 
 	text := upd.Message.Text
@@ -300,10 +539,27 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 				return fmt.Errorf("primitive.ObjectIDFromHex: %w", er)
 			}
 
-			repl, er := s.replyRepo.GetByID(ctx, id)
+			repl, found, er := s.replyRepo.GetByID(ctx, id)
 			if er != nil {
 				return fmt.Errorf("s.replyRepo.GetByID: %w", er)
 			}
+			if !found {
+				er = s.replyErr(api, upd, fmt.Sprintf("Диалог устарел: переписка хранится %d дн., после чего ответить "+
+					"через пересланное сообщение нельзя. Дождитесь нового сообщения собеседника",
+					s.repliesDays(bot)))
+				if er != nil {
+					return fmt.Errorf("s.replyErr: %w", er)
+				}
+				return nil
+			}
+
+			if cmd, arg := cutToken(text); cmd == tagCmd || cmd == untagCmd || cmd == noteCmd {
+				e := s.handlePeerLabel(ctx, api, upd, bot, repl.TgUserID, cmd, arg)
+				if e != nil {
+					return fmt.Errorf("s.handlePeerLabel: %w", e)
+				}
+				return nil
+			}
 
 			switch text {
 			case mute:
@@ -318,7 +574,7 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 				}
 				return nil
 			case unmute:
-				e := s.peerRepo.CreateUnMuted(ctx, bot.ID, repl.TgUserID, repl.TgChatID)
+				e := s.peerRepo.CreateUnMuted(ctx, bot.ID, repl.TgUserID, repl.TgChatID, expireAt(s.peersDays(bot)))
 				if e != nil {
 					return fmt.Errorf("s.peerRepo.CreateUnMuted: %w", e)
 				}
@@ -328,9 +584,113 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 					return fmt.Errorf("s.replyOK: %w", e)
 				}
 				return nil
+			case claim:
+				ok, e := s.peerRepo.Claim(
+					ctx,
+					bot.ID,
+					repl.TgUserID,
+					upd.Message.From.ID,
+					tplName(upd.Message.From.FirstName),
+					role == operator.Admin,
+				)
+				if e != nil {
+					return fmt.Errorf("s.peerRepo.Claim: %w", e)
+				}
+				if !ok {
+					e = s.replyErr(api, upd, "Собеседнику уже отвечает другой оператор")
+					if e != nil {
+						return fmt.Errorf("s.replyErr: %w", e)
+					}
+					return nil
+				}
+
+				e = s.replyOK(api, upd, "Теперь собеседнику отвечаете вы")
+				if e != nil {
+					return fmt.Errorf("s.replyOK: %w", e)
+				}
+				return nil
+			case unclaim:
+				p, _, e := s.peerRepo.Get(ctx, bot.ID, repl.TgUserID)
+				if e != nil {
+					return fmt.Errorf("s.peerRepo.Get: %w", e)
+				}
+
+				if p.ClaimedBy != upd.Message.From.ID && role != operator.Admin {
+					e = s.replyErr(api, upd, "Снять можно только своего собеседника")
+					if e != nil {
+						return fmt.Errorf("s.replyErr: %w", e)
+					}
+					return nil
+				}
+
+				e = s.peerRepo.Unclaim(ctx, bot.ID, repl.TgUserID)
+				if e != nil {
+					return fmt.Errorf("s.peerRepo.Unclaim: %w", e)
+				}
+
+				e = s.replyOK(api, upd, "Собеседник свободен, ему может ответить любой оператор")
+				if e != nil {
+					return fmt.Errorf("s.replyOK: %w", e)
+				}
+				return nil
+			case history:
+				e := s.handleOwnerHistory(ctx, api, upd, bot, repl.TgUserID)
+				if e != nil {
+					return fmt.Errorf("s.handleOwnerHistory: %w", e)
+				}
+				return nil
+			}
+
+			ops, er := s.operatorRepo.GetByChildBotID(ctx, bot.ID)
+			if er != nil {
+				return fmt.Errorf("s.operatorRepo.GetByChildBotID: %w", er)
+			}
+
+			if len(ops) != 0 {
+				ok, e := s.peerRepo.Claim(
+					ctx,
+					bot.ID,
+					repl.TgUserID,
+					upd.Message.From.ID,
+					tplName(upd.Message.From.FirstName),
+					false,
+				)
+				if e != nil {
+					return fmt.Errorf("s.peerRepo.Claim: %w", e)
+				}
+				if !ok {
+					p, _, e := s.peerRepo.Get(ctx, bot.ID, repl.TgUserID)
+					if e != nil {
+						return fmt.Errorf("s.peerRepo.Get: %w", e)
+					}
+
+					e = s.replyErr(api, upd, fmt.Sprintf("Не отправлено. Собеседнику уже отвечает %s. Админ может "+
+						"забрать диалог, ответив '%s'", p.ClaimedByName, claim))
+					if e != nil {
+						return fmt.Errorf("s.replyErr: %w", e)
+					}
+					return nil
+				}
+			}
+
+			var ok bool
+			text, ok, er = s.expandSnippet(api, upd, bot, text, repl.TgChatID)
+			if er != nil {
+				return fmt.Errorf("s.expandSnippet: %w", er)
+			}
+			if !ok {
+				return nil
 			}
 
-			_, er = api.Send(tgbotapi.MessageConfig{
+			if isLater(text) {
+				er = s.scheduleReply(ctx, api, upd, bot, repl.TgUserID, repl.TgChatID, repl.TgMessageID)
+				if er != nil {
+					return fmt.Errorf("s.scheduleReply: %w", er)
+				}
+				return nil
+			}
+
+			sent, er := api.Send(tgbotapi.MessageConfig{
 				BaseChat: tgbotapi.BaseChat{
 					ChatID:           repl.TgChatID,
 					ReplyToMessageID: int(repl.TgMessageID),
@@ -338,13 +698,39 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 				Text: text,
 			})
 			if er != nil {
-				er2 := s.replyErr(api, upd, "Не отправлено. Возможно пользователь остановил бота")
+				s.logger.Warn().Err(er).Str("childBotID", bot.ID.Hex()).Msg("reply to peer failed")
+
+				// the status of the peer only refines the error message, a plain one is sent without it
+				p, _, er2 := s.peerRepo.Get(ctx, bot.ID, repl.TgUserID)
+				if er2 != nil {
+					s.logger.Error().Err(er2).Str("childBotID", bot.ID.Hex()).Send()
+					p = peer.Peer{}
+				}
+
+				er2 = s.replyErr(api, upd, tplSendFailed(p))
 				if er2 != nil {
 					return fmt.Errorf("s.replyErr: %w", er2)
 				}
 				return nil
 			}
 
+			er = s.replyRepo.AddRelay(ctx, repl.ID, reply.Relay{
+				TgChatID:      upd.Message.Chat.ID,
+				TgMessageID:   upd.Message.MessageID,
+				PeerMessageID: int64(sent.MessageID),
+			})
+			if er != nil {
+				return fmt.Errorf("s.replyRepo.AddRelay: %w", er)
+			}
+
+			s.logMessage(ctx, bot, msglog.Message{
+				ChildBotID: bot.ID,
+				TgUserID:   repl.TgUserID,
+				Author:     msglog.Operator,
+				Text:       text,
+				Name:       tplName(upd.Message.From.FirstName),
+			})
+
 			er = s.replyOK(api, upd, "Отправлено")
 			if er != nil {
 				return fmt.Errorf("s.replyOK: %w", er)
@@ -353,6 +739,115 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 		}
 	}
 
+	if role == operator.Agent && text != help && text != scheduledList {
+		e := s.replyErr(api, upd, "Агент может только отвечать собеседникам и банить их, отвечая на пересланные "+
+			"сообщения")
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(text, history+" ") {
+		tgUserID, e := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(text, history)), 10, 64)
+		if e != nil {
+			e = s.replyErr(api, upd, "Некорректный ID собеседника")
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+
+		e = s.handleOwnerHistory(ctx, api, upd, bot, tgUserID)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerHistory: %w", e)
+		}
+		return nil
+	}
+
+	if text == retention || strings.HasPrefix(text, retention+" ") {
+		if !isOwner {
+			e := s.replyErr(api, upd, "Менять срок хранения может только владелец бота")
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+
+		e := s.handleOwnerRetention(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerRetention: %w", e)
+		}
+		return nil
+	}
+
+	if text == exportConfig || strings.HasPrefix(text, exportConfig+" ") {
+		e := s.handleOwnerExportConfig(api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerExportConfig: %w", e)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(text, diffVersions+" ") {
+		e := s.handleOwnerDiff(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerDiff: %w", e)
+		}
+		return nil
+	}
+
+	if text == rollback || strings.HasPrefix(text, rollback+" ") {
+		e := s.handleOwnerRollback(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerRollback: %w", e)
+		}
+		return nil
+	}
+
+	if text == peersCmd || strings.HasPrefix(text, peersCmd+" ") {
+		e := s.handleOwnerPeers(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerPeers: %w", e)
+		}
+		return nil
+	}
+
+	if text == replyDelay || strings.HasPrefix(text, replyDelay+" ") {
+		e := s.handleOwnerDelay(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerDelay: %w", e)
+		}
+		return nil
+	}
+
+	if text == testRules || strings.HasPrefix(text, testRules+" ") {
+		e := s.handleOwnerTest(api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerTest: %w", e)
+		}
+		return nil
+	}
+
+	if text == search || strings.HasPrefix(text, search+" ") {
+		e := s.handleOwnerSearch(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerSearch: %w", e)
+		}
+		return nil
+	}
+
+	switch text {
+	case operators, inviteAdmin, inviteAgent, setForwardMode, attachGroup, detachGroup:
+		if !isOwner {
+			e := s.replyErr(api, upd, "Управлять операторами может только владелец бота")
+			if e != nil {
+				return fmt.Errorf("s.replyErr: %w", e)
+			}
+			return nil
+		}
+	}
+
 	switch text {
 	case start, setStart:
 		e := s.handleOwnerStart(ctx, api, upd, bot, owner)
@@ -360,10 +855,52 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 			return fmt.Errorf("s.handleOwnerStart: %w", e)
 		}
 	case help:
-		e := s.handleOwnerHelp(ctx, api, upd, bot, owner)
+		e := s.handleOwnerHelp(ctx, api, upd, bot, owner, role)
 		if e != nil {
 			return fmt.Errorf("s.handleOwnerHelp: %w", e)
 		}
+	case operators:
+		e := s.handleOwnerOperators(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerOperators: %w", e)
+		}
+	case inviteAdmin:
+		e := s.handleOwnerInvite(ctx, api, upd, bot, operator.Admin)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerInvite: %w", e)
+		}
+	case inviteAgent:
+		e := s.handleOwnerInvite(ctx, api, upd, bot, operator.Agent)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerInvite: %w", e)
+		}
+	case setForwardMode:
+		e := s.handleOwnerForwardMode(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerForwardMode: %w", e)
+		}
+	case attachGroup:
+		e := s.reply(api, upd, fmt.Sprintf(`Как пересылать сообщения в группу, по теме на каждого собеседника:
+
+1. Создайте супергруппу и включите в ней темы
+2. Добавьте в нее @%s и сделайте администратором с правом управлять темами
+3. Отправьте %s в группе
+
+Всё, что участники группы напишут в теме собеседника, бот отправит ему. Отключить: %s`,
+			api.Self.UserName, attachGroup, detachGroup))
+		if e != nil {
+			return fmt.Errorf("s.reply: %w", e)
+		}
+	case detachGroup:
+		e := s.childBotRepo.SetForumChatID(ctx, bot.ID, 0)
+		if e != nil {
+			return fmt.Errorf("s.childBotRepo.SetForumChatID: %w", e)
+		}
+
+		e = s.replyOK(api, upd, "Группа отключена, сообщения снова пересылаются в личные сообщения")
+		if e != nil {
+			return fmt.Errorf("s.replyOK: %w", e)
+		}
 	case setKeywords:
 		e := s.handleOwnerSetKeywords(ctx, api, upd, bot, owner)
 		if e != nil {
@@ -379,35 +916,87 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 		if e != nil {
 			return fmt.Errorf("s.handleOwnerGetStart: %w", e)
 		}
+	case startButtons:
+		e := s.handleOwnerStartButtons(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerStartButtons: %w", e)
+		}
+	case editMenu:
+		e := s.handleOwnerMenu(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerMenu: %w", e)
+		}
+	case startLinks:
+		e := s.handleOwnerStartLinks(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerStartLinks: %w", e)
+		}
+	case broadcastCmd:
+		e := s.handleOwnerBroadcast(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerBroadcast: %w", e)
+		}
+	case scheduledList:
+		e := s.handleOwnerScheduled(ctx, api, upd, bot, role)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerScheduled: %w", e)
+		}
+	case snippetsCmd:
+		e := s.handleOwnerSnippets(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerSnippets: %w", e)
+		}
+	case editRules:
+		e := s.handleOwnerRules(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerRules: %w", e)
+		}
+	case versions:
+		e := s.handleOwnerVersions(ctx, api, upd, bot)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerVersions: %w", e)
+		}
 	default:
-		scene, e := s.childStateRepo.GetScene(ctx, owner.ID, bot.ID)
+		st, e := s.childStateRepo.Get(ctx, owner.ID, bot.ID)
 		if e != nil {
-			return fmt.Errorf("s.childStateRepo.GetScene: %w", e)
+			return fmt.Errorf("s.childStateRepo.Get: %w", e)
 		}
 
-		switch scene {
+		switch st.Scene {
 		case child_state.SetStart:
-			e = s.childBotRepo.SetOnPeerStart(ctx, bot.ID, text)
+			e = s.onStartMessage(ctx, api, upd, bot, owner, text, nil)
 			if e != nil {
-				return fmt.Errorf("s.childBotRepo.SetOnPeerStart: %w", e)
+				return fmt.Errorf("s.onStartMessage: %w", e)
 			}
-
-			if !bot.SetupDone {
-				e = s.handleOwnerSetKeywords(ctx, api, upd, bot, owner)
-				if e != nil {
-					return fmt.Errorf("s.handleOwnerSetKeywords: %w", e)
-				}
-				return nil
+			return nil
+		case child_state.SetStartButton:
+			e = s.onStartButtons(ctx, api, upd, bot, owner)
+			if e != nil {
+				return fmt.Errorf("s.onStartButtons: %w", e)
 			}
-
-			e = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+			return nil
+		case child_state.SetMenu:
+			e = s.onMenu(ctx, api, upd, bot, owner)
 			if e != nil {
-				return fmt.Errorf("s.childBotRepo.SetOnPeerStart: %w", e)
+				return fmt.Errorf("s.onMenu: %w", e)
 			}
-
-			e = s.replyOK(api, upd, "Приветственное сообщение установлено")
+			return nil
+		case child_state.SetStartLinks:
+			e = s.onStartLinks(ctx, api, upd, bot, owner)
 			if e != nil {
-				return fmt.Errorf("s.replyOK: %w", e)
+				return fmt.Errorf("s.onStartLinks: %w", e)
+			}
+			return nil
+		case child_state.SetBroadcast:
+			e = s.onBroadcast(ctx, api, upd, bot, owner)
+			if e != nil {
+				return fmt.Errorf("s.onBroadcast: %w", e)
+			}
+			return nil
+		case child_state.SetSnippets:
+			e = s.onSnippets(ctx, api, upd, bot, owner)
+			if e != nil {
+				return fmt.Errorf("s.onSnippets: %w", e)
 			}
 			return nil
 		case child_state.SetKeywords:
@@ -421,16 +1010,14 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 				return nil
 			}
 
-			e = s.childBotRepo.SetKeywordsAndMode(ctx, bot.ID, kws, m)
+			kws, lost := keepRuleSettings(bot.Keywords, kws)
+			next := bot
+			next.Keywords = kws
+			next.Mode = m
+			next.SetupDone = true
+			_, e = s.applySettings(ctx, bot, next, upd.Message.From, sourceKeywords)
 			if e != nil {
-				return fmt.Errorf("s.childBotRepo.SetKeywordsAndMode: %w", e)
-			}
-
-			if !bot.SetupDone {
-				e = s.childBotRepo.SetSetupDoneTrue(ctx, bot.ID)
-				if e != nil {
-					return fmt.Errorf("s.childBotRepo.SetSetupDoneTrue: %w", e)
-				}
+				return fmt.Errorf("s.applySettings: %w", e)
 			}
 
 			e = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
@@ -447,11 +1034,35 @@ func (s *service) handleOwner(ctx context.Context, api *tgbotapi.BotAPI, upd upd
 				return nil
 			}
 
-			e = s.replyOK(api, upd, "Ключевые слова установлены")
+			res := "Ключевые слова установлены"
+			if lost != 0 {
+				res += fmt.Sprintf(". У %d прежних правил не нашлось правила с теми же словами, их медиа, кнопки, "+
+					"разметка и задержка сброшены", lost)
+			}
+			e = s.replyOK(api, upd, res)
 			if e != nil {
 				return fmt.Errorf("s.replyOK: %w", e)
 			}
 			return nil
+		case child_state.AddRuleIn, child_state.AddRuleOut, child_state.EditRuleIn, child_state.EditRuleOut,
+			child_state.EditRuleMedia, child_state.EditRuleButton:
+			e = s.onRuleText(ctx, api, upd, bot, owner, st, nil)
+			if e != nil {
+				return fmt.Errorf("s.onRuleText: %w", e)
+			}
+			return nil
+		case child_state.ImportConfig:
+			e = s.onImportConfig(ctx, api, upd, bot, owner, st.Payload)
+			if e != nil {
+				return fmt.Errorf("s.onImportConfig: %w", e)
+			}
+			return nil
+		case child_state.RemoveOperator:
+			e = s.handleOwnerRemoveOperator(ctx, api, upd, bot, owner)
+			if e != nil {
+				return fmt.Errorf("s.handleOwnerRemoveOperator: %w", e)
+			}
+			return nil
 		default:
 			e = s.replyErr(api, upd, "Неизвестная команда")
 			if e != nil {
@@ -469,24 +1080,106 @@ func (s *service) handleOwnerHelp(
 	upd update,
 	bot Bot,
 	owner user.User,
+	role operator.Role,
 ) error {
 	err := s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
 	if err != nil {
 		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
 	}
 
+	if role == operator.Agent {
+		err = s.reply(api, upd, fmt.Sprintf(`Вы агент этого бота. Бот пересылает вам сообщения собеседников.
+
+'Ответить' на пересланное сообщение текстом — ответить собеседнику. Первый ответ закрепляет собеседника за вами, другие операторы не смогут ему ответить
+'%s' — забанить собеседника, '%s' — разбанить
+'%s' — взять свободного собеседника, '%s' — освободить его
+'%s' — показать историю переписки с собеседником
+'%s 9:00 текст' — отправить ответ позже, %s — ваши запланированные ответы, отмена
+'#название' — отправить заготовку ответа, или нажмите ее кнопку под пересланным сообщением
+'%s клиент' / '%s клиент' — поставить / снять тег собеседника, '%s текст' — заметка о нем`, mute, unmute, claim,
+			unclaim, history, later, scheduledList, tagCmd, untagCmd, noteCmd))
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	if owner.ID != bot.OwnerUserID {
+		err = s.reply(api, upd, fmt.Sprintf(`Вы админ этого бота. Команды
+
+%s — показать текущее приветственное сообщение бота
+%s — установить его, можно с фото, документом или видео
+%s — кнопки под приветственным сообщением
+%s — меню тем под приветственным сообщением: собеседник выбирает тему кнопкой
+%s — ссылки с меткой источника и свои приветствия для них
+%s — рассылка сообщения всем, кто писал боту
+%s — запланированные ответы и рассылка, отмена
+%s — заготовки ответов: 'ответьте' #название на пересланное сообщение
+
+%s — показать текущие ключевые слова и автоответы, правила бана
+%s — установить их
+%s — изменить правила по одному: добавить, удалить, поменять порядок, прикрепить файл и кнопки
+%s — выгрузить настройки файлом (JSON, или '%s yaml'). Чтобы загрузить настройки, отправьте файл боту
+%s — история изменений правил, откат к прежней версии
+%s текст — проверить, что бот ответит на такое сообщение
+%s — задержка автоответа, бот покажет, что печатает
+
+%s текст — найти сообщения в переписках
+%s ID — история переписки с собеседником
+%s — собеседники, их теги и заметки, '%s тег' — только с тегом
+
+%s — выйти из любого меню и показать это сообщение
+
+'Ответить' на пересланное сообщение: текстом — ответить собеседнику, '%s' / '%s' — забанить / разбанить, '%s' / '%s' — взять / освободить собеседника, '%s' — история переписки, '%s 9:00 текст' — ответить позже`,
+			getStart, setStart, startButtons, editMenu, startLinks, broadcastCmd, scheduledList, snippetsCmd,
+			getKeywords, setKeywords, editRules, exportConfig, exportConfig, versions, testRules, replyDelay,
+			search, history, peersCmd, peersCmd, help, mute, unmute, claim, unclaim, history, later),
+		)
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
 	err = s.reply(api, upd, fmt.Sprintf(`Команды
 
 %s — показать текущее приветственное сообщение бота
-%s — установить его
+%s — установить его, можно с фото, документом или видео
+%s — кнопки под приветственным сообщением
+%s — меню тем под приветственным сообщением: собеседник выбирает тему кнопкой
+%s — ссылки с меткой источника и свои приветствия для них
+%s — рассылка сообщения всем, кто писал боту
+%s — запланированные ответы и рассылка, отмена
+%s — заготовки ответов: 'ответьте' #название на пересланное сообщение
 
 %s — показать текущие ключевые слова и автоответы, правила бана
 %s — установить их
+%s — изменить правила по одному: добавить, удалить, поменять порядок, прикрепить файл и кнопки
+%s — выгрузить настройки файлом (JSON, или '%s yaml'). Чтобы загрузить настройки, отправьте файл боту
+%s — история изменений правил, откат к прежней версии
+%s текст — проверить, что бот ответит на такое сообщение
+%s — задержка автоответа, бот покажет, что печатает
+
+%s — операторы бота и режим пересылки
+%s — пригласить админа (может менять настройки и отвечать)
+%s — пригласить агента (может только отвечать и банить)
+%s — пересылать сообщения всем операторам или по очереди
+%s — пересылать сообщения в группу, по теме на собеседника
+
+%s текст — найти сообщения в переписках
+%s ID — история переписки с собеседником, или 'ответьте' '%s' на пересланное сообщение
+%s — собеседники, их теги и заметки, '%s тег' — только с тегом. 'Ответьте' '%s клиент' или '%s текст' на пересланное сообщение, чтобы поставить тег или заметку
+'Ответьте' '%s 9:00 текст' на пересланное сообщение, чтобы ответ ушел позже
+%s — сколько хранится переписка, изменить срок
 
 %s — выйти из любого меню и показать это сообщение
 
 Для создания и удаления ботов используйте @%s`,
-		getStart, setStart, getKeywords, setKeywords, help, s.parentBotUsername),
+		getStart, setStart, startButtons, editMenu, startLinks, broadcastCmd, scheduledList, snippetsCmd,
+		getKeywords, setKeywords, editRules, exportConfig, exportConfig, versions, testRules, replyDelay,
+		operators, inviteAdmin, inviteAgent, setForwardMode, attachGroup,
+		search, history, history, peersCmd, peersCmd, tagCmd, noteCmd, later, retention, help,
+		s.parentBot.Self.UserName),
 	)
 	if err != nil {
 		return fmt.Errorf("s.reply: %w", err)
@@ -508,7 +1201,75 @@ func (s *service) handleOwnerStart(
 	}
 
 	err = s.reply(api, upd, "Какой текст бот должен отвечать "+
-		"когда нажимают кнопку 'Начать'? Например: 'Привет, слушаю вас'")
+		"когда нажимают кнопку 'Начать'? Например: 'Привет, {first_name}, слушаю вас'. Можно отправить фото, "+
+		"документ или видео с подписью, тогда бот ответит ими. Можно использовать "+tplHelp)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+// onStartMessage sets the start message, a message without media removes the previous media
+func (s *service) onStartMessage(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	text string,
+	media *Media,
+) error {
+	e := checkTemplate(text, 0, ParsePlain)
+	if e != nil {
+		e = s.replyErr(api, upd, fmt.Sprintf("В шаблоне %s. Исправьте и отправьте еще раз", e))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	next := bot
+	next.OnPeerStart = text
+	next.StartMedia = media
+	_, e = s.applySettings(ctx, bot, next, upd.Message.From, sourceStart)
+	if e != nil {
+		return fmt.Errorf("s.applySettings: %w", e)
+	}
+
+	if !bot.SetupDone {
+		e = s.handleOwnerSetKeywords(ctx, api, upd, bot, owner)
+		if e != nil {
+			return fmt.Errorf("s.handleOwnerSetKeywords: %w", e)
+		}
+		return nil
+	}
+
+	e = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if e != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", e)
+	}
+
+	e = s.replyOK(api, upd, fmt.Sprintf("Приветственное сообщение установлено. Кнопки под ним: %s", startButtons))
+	if e != nil {
+		return fmt.Errorf("s.replyOK: %w", e)
+	}
+	return nil
+}
+
+func (s *service) handleOwnerStartButtons(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	err := s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.SetStartButton)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf("Сейчас:\n%s\n\n%s", tplButtons(bot.StartButtons), buttonsHelp))
 	if err != nil {
 		return fmt.Errorf("s.reply: %w", err)
 	}
@@ -516,6 +1277,35 @@ func (s *service) handleOwnerStart(
 	return nil
 }
 
+func (s *service) onStartButtons(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	buttons, err := parseButtons(upd.Message.Text)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Кнопки не сохранены: %s. Попробуйте еще раз", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	next := bot
+	next.StartButtons = buttons
+	_, err = s.applySettings(ctx, bot, next, upd.Message.From, sourceButtons)
+	if err != nil {
+		return fmt.Errorf("s.applySettings: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	err = s.replyOK(api, upd, "Кнопки приветственного сообщения сохранены")
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
 func (s *service) handleOwnerSetKeywords(
 	ctx context.Context,
 	api *tgbotapi.BotAPI,
@@ -531,8 +1321,9 @@ func (s *service) handleOwnerSetKeywords(
 	err = s.reply(api, upd, fmt.Sprintf(`Настройка правил автоответов (не более 50), отправьте все правила одним сообщением. Если сообщение не попало под правила, бот перешлет его вам (если отправитель не в бане). Формат:
 - Режим работы. Если указано '1' — бот применяет правила только на первое сообщение, далее не вмешивается в вашу переписку с отправителем. Если указано '2' — бот применяет правила и на первое сообщение отправителя, и на дальнейшие;
 - Перечислите через запятую ключевые слова, ожидаемые в сообщении отправителя (не более 25);
-- Затем укажите автоответ, который должен отправить бот (не более 1000 символов, может быть многострочным);
+- Затем укажите автоответ, который должен отправить бот (не более 1000 символов, может быть многострочным). Можно указать несколько вариантов ответа через строку '%s', бот выберет случайный. В ответе можно использовать %s;
 - Далее напишите нужно ли банить отправителя, если данный фильтр сработал на его сообщение. Если указано 'да' – бот ответит отправителю, далее бот игнорирует любые сообщения от него, бот не пересылает вам ни первое ни последующие сообщения от данного пользователя. Если указано 'нет' — бот ответит отправителю, перешлет вам исходное сообщение и ответ на него, вы сможете вести переписку с отправителем анонимно через бота, а забанить ответив '%s', разбанить '%s';
+- Правила с теми же ключевыми словами, что и раньше, сохраняют медиа, кнопки, разметку и задержку из /rules, у остальных они сбрасываются;
 - Все элементы с новой строки и разделены '==='.
 
 Например:
@@ -560,7 +1351,7 @@ func (s *service) handleOwnerSetKeywords(
 ===
 Сотрудничество интересно, давайте обсудим
 ===
-нет`, mute, unmute))
+нет`, variantsDelim, tplHelp, mute, unmute))
 	if err != nil {
 		return fmt.Errorf("s.reply: %w", err)
 	}
@@ -579,7 +1370,7 @@ func (s *service) handleOwnerGetKeywords(
 ===
 %s
 ===
-%s`, strings.Join(word.In, comma), word.Out, boolToRU(word.Ban))
+%s`, strings.Join(word.In, comma), joinVariants(word.outs()), boolToRU(word.Ban))
 	}
 
 	err := s.reply(api, upd, fmt.Sprintf(`Ключевые слова (%d/%d). Формат:
@@ -608,11 +1399,16 @@ func (s *service) handleOwnerGetStart(
 	upd update,
 	bot Bot,
 ) error {
+	text := bot.OnPeerStart
+	if a := tplAttachments(bot.StartMedia, bot.StartButtons); a != "" {
+		text += "\n\n(" + a + ")"
+	}
+
 	err := s.reply(api, upd, fmt.Sprintf(`Приветственное сообщение бота (когда нажимают кнопку 'Начать')
 
 %s
 
-%s`, bot.OnPeerStart, help))
+%s`, text, help))
 	if err != nil {
 		return fmt.Errorf("s.reply: %w", err)
 	}
@@ -620,159 +1416,368 @@ func (s *service) handleOwnerGetStart(
 	return nil
 }
 
-func (s *service) handlePeer(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
-	if bot.Mode == None {
+func (s *service) handlePeer(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	if upd.Message.Text == "" {
+		return nil
+	}
+
+	if upd.Message.Text == forgetMe {
+		err := s.handlePeerForgetMe(ctx, api, upd, bot)
+		if err != nil {
+			return fmt.Errorf("s.handlePeerForgetMe: %w", err)
+		}
+		return nil
+	}
+
+	if bot.Mode == None || bot.Paused {
 		return nil
 	}
 
 	peerUser, peerFound, err := s.peerRepo.Get(ctx, bot.ID, upd.Message.From.ID)
 	if err != nil {
-		return fmt.Errorf("s.peerRepo.Create: %w", err)
+		return fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
+
+	if payload, ok := parseStart(upd.Message.Text); ok && validPayload(payload) && !peerUser.Muted {
+		err = s.recordSource(ctx, bot, upd.Message.From.ID, payload, peerFound)
+		if err != nil {
+			return fmt.Errorf("s.recordSource: %w", err)
+		}
+	}
+
+	if bot.MenuKeyboard && !peerUser.Muted {
+		handled, e := s.handleMenuText(ctx, api, upd, bot, owner, peerUser, peerFound)
+		if e != nil {
+			return fmt.Errorf("s.handleMenuText: %w", e)
+		}
+		if handled {
+			return nil
+		}
 	}
-	if peerUser.Muted {
+
+	d := decide(bot, upd.Message.Text, peerFound, peerUser.Muted)
+	if d.action == actIgnore {
 		return nil
 	}
 
-	text := upd.Message.Text
-	if text == start && bot.OnPeerStart != "" {
-		e := s.reply(api, upd, bot.OnPeerStart)
+	if peerUser.FreeText && d.action != actStart {
+		// the peer picked a free text item of the menu, the message goes to the owner as is
+		d = decision{action: actForward}
+		e := s.peerRepo.UnsetFreeText(ctx, bot.ID, upd.Message.From.ID)
 		if e != nil {
-			return fmt.Errorf("s.reply: %w", e)
+			return fmt.Errorf("s.peerRepo.UnsetFreeText: %w", e)
+		}
+	}
+
+	err = s.act(ctx, api, upd, bot, owner, d, peerUser, peerFound)
+	if err != nil {
+		return fmt.Errorf("s.act: %w", err)
+	}
+	return nil
+}
+
+// act replies, bans and forwards by the decision on a peer message
+func (s *service) act(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+	d decision,
+	peerUser peer.Peer,
+	peerFound bool,
+) error {
+	var botReply string
+	if len(d.replies) != 0 {
+		vars := s.peerVars(api.Self.FirstName, upd.Message.From, !peerFound)
+		vars.pm = d.parseMode
+		botReply = renderTemplate(s.pickReply(ctx, bot, d), vars)
+	}
+
+	inbound := msglog.Message{
+		ChildBotID: bot.ID,
+		TgUserID:   upd.Message.From.ID,
+		Author:     msglog.Peer,
+		Text:       upd.Message.Text,
+		Rule:       d.rule,
+		Keyword:    d.keyword,
+	}
+	s.logMessage(ctx, bot, inbound)
+	if botReply != "" {
+		s.logMessage(ctx, bot, msglog.Message{
+			ChildBotID: bot.ID,
+			TgUserID:   upd.Message.From.ID,
+			Author:     msglog.Bot,
+			Text:       botReply,
+			Rule:       d.rule,
+			Keyword:    d.keyword,
+		})
+	}
+
+	if d.action == actStart {
+		e := s.sendReply(ctx, api, bot, d, upd.Message.From.ID, richReply{
+			chatID:       upd.Message.Chat.ID,
+			replyTo:      int(upd.Message.MessageID),
+			text:         botReply,
+			media:        d.media,
+			buttons:      d.buttons,
+			menu:         d.menu,
+			menuKeyboard: d.menuKeyboard,
+		})
+		if e != nil {
+			return fmt.Errorf("s.sendReply: %w", e)
 		}
 		return nil
 	}
 
+	e := s.peerRepo.Create(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID, expireAt(s.peersDays(bot)))
+	if e != nil {
+		return fmt.Errorf("s.peerRepo.Create: %w", e)
+	}
+
 	if !peerFound {
-		e := s.peerRepo.Create(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID)
+		src, found, e := s.peerRepo.TakePendingSource(ctx, bot.ID, upd.Message.From.ID)
 		if e != nil {
-			return fmt.Errorf("s.peerRepo.Create: %w", e)
+			return fmt.Errorf("s.peerRepo.TakePendingSource: %w", e)
+		}
+		if found {
+			e = s.peerRepo.SetSource(ctx, bot.ID, upd.Message.From.ID, src)
+			if e != nil {
+				return fmt.Errorf("s.peerRepo.SetSource: %w", e)
+			}
+		}
+		if peerUser.Source != "" {
+			src = peerUser.Source
+		}
+
+		peerUser = peer.Peer{
+			ChildBotID: bot.ID,
+			TgUserID:   upd.Message.From.ID,
+			TgChatID:   upd.Message.Chat.ID,
+			Source:     src,
 		}
 	}
 
-	if bot.Mode == OnlyFirst && peerFound {
-		id, e := s.replyRepo.Create(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID, upd.Message.MessageID)
+	if d.action == actBan {
+		e = s.peerRepo.CreateMuted(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID)
 		if e != nil {
-			return fmt.Errorf("s.replyRepo.Create: %w", e)
+			return fmt.Errorf("s.peerRepo.CreateMuted: %w", e)
 		}
+	}
 
-		_, e = api.Send(tgbotapi.MessageConfig{
-			BaseChat: tgbotapi.BaseChat{
-				ChatID: bot.OwnerUserChatID,
-			},
-			Text: fmt.Sprintf(`%s%s
-%s / %s:
-%s
-
-'Ответить' на это сообщение текстом, чтобы ответить отправителю, или '%s' чтобы забанить его, '%s' разбанить`,
-				messageForward, id.Hex(),
-				tplUsername(upd.Message.From.Username), tplName(upd.Message.From.FirstName),
-				text,
-				mute,
-				unmute),
+	if botReply != "" {
+		e = s.sendReply(ctx, api, bot, d, upd.Message.From.ID, richReply{
+			chatID:    upd.Message.Chat.ID,
+			replyTo:   int(upd.Message.MessageID),
+			text:      botReply,
+			media:     d.media,
+			buttons:   d.buttons,
+			parseMode: d.parseMode,
+			noPreview: d.noPreview,
 		})
 		if e != nil {
-			return fmt.Errorf("api.Send: %w", e)
+			return fmt.Errorf("s.sendReply: %w", e)
 		}
+	}
+
+	if !d.forwards() {
 		return nil
 	}
 
-	lowText := strings.ToLower(text)
+	id, e := s.replyRepo.Create(
+		ctx,
+		bot.ID,
+		upd.Message.From.ID,
+		upd.Message.Chat.ID,
+		upd.Message.MessageID,
+		expireAt(s.repliesDays(bot)),
+	)
+	if e != nil {
+		return fmt.Errorf("s.replyRepo.Create: %w", e)
+	}
 
-	var match bool
-kws:
-	for _, kw := range bot.Keywords {
-		for _, in := range kw.In {
-			if strings.Contains(lowText, in) {
-				if kw.Ban {
-					e := s.peerRepo.CreateMuted(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID)
-					if e != nil {
-						return fmt.Errorf("s.peerRepo.CreateMuted: %w", e)
-					}
+	copies, e := s.forward(ctx, api, bot, owner, peerUser, upd.Message.From, tplForward(id, upd, peerUser, botReply))
+	if e != nil {
+		return fmt.Errorf("s.forward: %w", e)
+	}
 
-					e = s.reply(api, upd, kw.Out)
-					if e != nil {
-						return fmt.Errorf("s.reply: %w", e)
-					}
-					return nil
-				}
+	if len(copies) != 0 {
+		e = s.replyRepo.AddCopies(ctx, id, copies)
+		if e != nil {
+			return fmt.Errorf("s.replyRepo.AddCopies: %w", e)
+		}
+	}
+	return nil
+}
 
-				e := s.reply(api, upd, kw.Out)
-				if e != nil {
-					return fmt.Errorf("s.reply: %w", e)
-				}
+// handlePeerForgetMe erases the peer data on request. A ban is kept, otherwise a banned peer could lift it
+func (s *service) handlePeerForgetMe(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	tgUserID := upd.Message.From.ID
 
-				if bot.OwnerUserChatID != 0 {
-					id, er := s.replyRepo.Create(
-						ctx,
-						bot.ID,
-						upd.Message.From.ID,
-						upd.Message.Chat.ID,
-						upd.Message.MessageID,
-					)
-					if er != nil {
-						return fmt.Errorf("s.replyRepo.Create: %w", er)
-					}
+	p, _, err := s.peerRepo.Get(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.Get: %w", err)
+	}
 
-					_, er = api.Send(tgbotapi.MessageConfig{
-						BaseChat: tgbotapi.BaseChat{
-							ChatID: bot.OwnerUserChatID,
-						},
-						Text: fmt.Sprintf(`%s%s
-%s / %s:
-%s
+	err = s.replyRepo.DeleteByPeer(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.replyRepo.DeleteByPeer: %w", err)
+	}
 
-Бот ответил:
-%s
+	err = s.scheduledRepo.DeleteByPeer(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.scheduledRepo.DeleteByPeer: %w", err)
+	}
 
-'Ответить' на это сообщение текстом, чтобы ответить отправителю, или '%s' чтобы забанить его, '%s' разбанить`,
-							messageForward, id.Hex(),
-							tplUsername(upd.Message.From.Username), tplName(upd.Message.From.FirstName),
-							text,
-							kw.Out,
-							mute,
-							unmute),
-					})
-					if er != nil {
-						return fmt.Errorf("api.Send: %w", er)
-					}
-				}
+	err = s.msglogRepo.DeleteByPeer(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.msglogRepo.DeleteByPeer: %w", err)
+	}
 
-				match = true
-				break kws
-			}
+	_, err = s.peerRepo.Delete(ctx, bot.ID, tgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.Delete: %w", err)
+	}
+
+	text := "Ваши данные в этом боте удалены: переписка и связь с владельцем бота. Сообщения, которые уже были " +
+		"пересланы владельцу, удалить нельзя"
+	if p.Muted {
+		text += ". Вы заблокированы владельцем бота, поэтому запись о блокировке сохранена"
+	}
+	err = s.reply(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	if bot.OwnerUserChatID != 0 {
+		_, err = api.Send(tgbotapi.NewMessage(bot.OwnerUserChatID, fmt.Sprintf("Собеседник %s / %s (ID %d) "+
+			"удалил свои данные командой %s. Ответить на его прежние сообщения больше нельзя",
+			tplUsername(upd.Message.From.Username), tplName(upd.Message.From.FirstName), tgUserID, forgetMe)))
+		if err != nil {
+			s.logger.Warn().Err(err).Send()
 		}
 	}
 
-	if !match {
-		id, e := s.replyRepo.Create(ctx, bot.ID, upd.Message.From.ID, upd.Message.Chat.ID, upd.Message.MessageID)
-		if e != nil {
-			return fmt.Errorf("s.replyRepo.Create: %w", e)
+	return nil
+}
+
+type recipient struct {
+	tgUserID int64
+	chatID   int64
+}
+
+// forward delivers a message about the peer to the owner and operators. In round robin mode a claimed peer
+// goes to its operator, others go to the next recipient in turn. Copies which fit one message are returned, so
+// they can be edited later
+func (s *service) forward(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	bot Bot,
+	owner user.User,
+	p peer.Peer,
+	f from,
+	text string,
+) ([]reply.Copy, error) {
+	if bot.ForumChatID != 0 {
+		copies, err := s.forwardToTopic(ctx, api, bot, p, f, text+tplTopicHint())
+		if err == nil {
+			return copies, nil
 		}
+		s.logger.Warn().Err(err).Str("childBotID", bot.ID.Hex()).Msg("forward to topic failed, sending to chats")
+	}
 
-		_, e = api.Send(tgbotapi.MessageConfig{
-			BaseChat: tgbotapi.BaseChat{
-				ChatID: bot.OwnerUserChatID,
-			},
-			Text: fmt.Sprintf(`%s%s
-%s / %s:
-%s
+	text += tplForwardHint()
 
-'Ответить' на это сообщение текстом, чтобы ответить отправителю, или '%s' чтобы забанить его, '%s' разбанить`,
-				messageForward, id.Hex(),
-				tplUsername(upd.Message.From.Username), tplName(upd.Message.From.FirstName),
-				text,
-				mute,
-				unmute),
+	ops, err := s.operatorRepo.GetByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return nil, fmt.Errorf("s.operatorRepo.GetByChildBotID: %w", err)
+	}
+
+	var rs []recipient
+	if bot.OwnerUserChatID != 0 {
+		rs = append(rs, recipient{
+			tgUserID: owner.TgUserID,
+			chatID:   bot.OwnerUserChatID,
 		})
-		if e != nil {
-			return fmt.Errorf("api.Send: %w", e)
+	}
+	for _, op := range ops {
+		rs = append(rs, recipient{
+			tgUserID: op.TgUserID,
+			chatID:   op.TgChatID,
+		})
+	}
+
+	if bot.ForwardMode == ForwardRoundRobin && len(rs) > 1 {
+		var claimed []recipient
+		for _, r := range rs {
+			if p.ClaimedBy != 0 && r.tgUserID == p.ClaimedBy {
+				claimed = append(claimed, r)
+			}
+		}
+
+		if len(claimed) != 0 {
+			rs = claimed
+		} else {
+			n, e := s.childBotRepo.NextRoundRobin(ctx, bot.ID)
+			if e != nil {
+				return nil, fmt.Errorf("s.childBotRepo.NextRoundRobin: %w", e)
+			}
+			rs = []recipient{rs[n%uint64(len(rs))]}
 		}
 	}
-	return nil
+
+	parts := splitForward(text)
+
+	var (
+		sent   int
+		copies []reply.Copy
+	)
+recipients:
+	for _, r := range rs {
+		for i, part := range parts {
+			cfg := tgbotapi.NewMessage(r.chatID, part)
+			if i == len(parts)-1 {
+				cfg.ReplyMarkup = forwardMarkup(bot, p.TgUserID)
+			}
+			msg, e := api.Send(cfg)
+			if e != nil {
+				err = e
+				s.logger.Warn().Err(e).Int64("chatID", r.chatID).Send()
+				continue recipients
+			}
+			if len(parts) == 1 {
+				copies = append(copies, reply.Copy{
+					TgChatID:    r.chatID,
+					TgMessageID: int64(msg.MessageID),
+				})
+			}
+		}
+		sent += 1
+	}
+	if sent == 0 && err != nil {
+		return nil, fmt.Errorf("api.Send: %w", err)
+	}
+
+	return copies, nil
+}
+
+func tplTopicHint() string {
+	return fmt.Sprintf(`
+
+Напишите в эту тему, чтобы ответить отправителю, или '%s' чтобы забанить его, '%s' разбанить`, mute, unmute)
+}
+
+func tplForwardHint() string {
+	return fmt.Sprintf(`
+
+'Ответить' на это сообщение текстом, чтобы ответить отправителю, или '%s' чтобы забанить его, '%s' разбанить`,
+		mute,
+		unmute,
+	)
 }
 
 func (s *service) reply(api *tgbotapi.BotAPI, upd update, text string) error {
-	_, err := api.Send(tgbotapi.MessageConfig{
+	err := sendText(api, tgbotapi.MessageConfig{
 		BaseChat: tgbotapi.BaseChat{
 			ChatID:           upd.Message.Chat.ID,
 			ReplyToMessageID: int(upd.Message.MessageID),
@@ -780,7 +1785,7 @@ func (s *service) reply(api *tgbotapi.BotAPI, upd update, text string) error {
 		Text: text,
 	})
 	if err != nil {
-		return fmt.Errorf("api.Send: %w", err)
+		return fmt.Errorf("sendText: %w", err)
 	}
 	return nil
 }
@@ -842,43 +1847,27 @@ func (s *service) parseKeywordsAndMode(in string) ([]Keyword, mode, bool) {
 
 	var keywords []Keyword
 	for i := 1; i < len(words); i += 3 {
-		out := words[i+1]
-		if utf8.RuneCountInString(out) > int(s.outLimitChars) {
+		outs := splitVariants(words[i+1])
+		if s.checkVariants(outs, ParsePlain) != nil {
 			return nil, 0, false
 		}
 
-		rawInKws := strings.Split(words[i], comma)
-		if len(rawInKws) > int(s.inLimitPerKeyword) {
+		kwIn, ok := s.parseIn(words[i])
+		if !ok {
 			return nil, 0, false
 		}
 
-		unique := map[string]struct{}{}
-		for _, kw := range rawInKws {
-			k := strings.ToLower(strings.TrimSpace(kw))
-			if k == "" || utf8.RuneCountInString(k) > int(s.inLimitChars) {
-				return nil, 0, false
-			}
-
-			unique[k] = struct{}{}
-		}
-
-		kwIn := make([]string, len(unique))
-		ix := 0
-		for kw := range unique {
-			kwIn[ix] = kw
-			ix += 1
-		}
-
 		ban, ok := ruToBool(words[i+2])
 		if !ok {
 			return nil, 0, false
 		}
 
-		keywords = append(keywords, Keyword{
+		kw := Keyword{
 			In:  kwIn,
-			Out: out,
 			Ban: ban,
-		})
+		}
+		kw.setOuts(outs)
+		keywords = append(keywords, kw)
 	}
 	if len(keywords) > int(s.keywordsLimitPerBot) {
 		return nil, 0, false
@@ -887,6 +1876,73 @@ func (s *service) parseKeywordsAndMode(in string) ([]Keyword, mode, bool) {
 	return keywords, m, true
 }
 
+// parseIn parses comma separated keywords of a rule, lowercased and without duplicates
+func (s *service) parseIn(in string) ([]string, bool) {
+	rawInKws := strings.Split(in, comma)
+	if len(rawInKws) > int(s.inLimitPerKeyword) {
+		return nil, false
+	}
+
+	unique := map[string]struct{}{}
+	kwIn := make([]string, 0, len(rawInKws))
+	for _, kw := range rawInKws {
+		k := strings.ToLower(strings.TrimSpace(kw))
+		if k == "" || utf8.RuneCountInString(k) > int(s.inLimitChars) {
+			return nil, false
+		}
+
+		if _, ok := unique[k]; ok {
+			continue
+		}
+		unique[k] = struct{}{}
+		kwIn = append(kwIn, k)
+	}
+
+	return kwIn, true
+}
+
+func tplForward(id primitive.ObjectID, upd update, p peer.Peer, botReply string) string {
+	source := ""
+	if p.Source != "" {
+		source = fmt.Sprintf(" (источник: %s)", p.Source)
+	}
+	if status := tplPeerStatus(p); status != "" {
+		source += fmt.Sprintf(" (%s)", status)
+	}
+	if labels := tplPeerLabels(p); labels != "" {
+		source += fmt.Sprintf(" (%s)", labels)
+	}
+
+	text := fmt.Sprintf(`%s%s
+%s / %s%s:
+%s`,
+		messageForward, id.Hex(),
+		tplUsername(upd.Message.From.Username), tplName(upd.Message.From.FirstName), source,
+		upd.Message.Text,
+	)
+
+	if botReply != "" {
+		text += fmt.Sprintf(`
+
+Бот ответил:
+%s`, botReply)
+	}
+
+	if p.Note != "" {
+		text += fmt.Sprintf(`
+
+Заметка: %s`, p.Note)
+	}
+
+	if p.ClaimedByName != "" {
+		text += fmt.Sprintf(`
+
+Отвечает: %s`, p.ClaimedByName)
+	}
+
+	return text
+}
+
 func tplName(in string) string {
 	name := "Нет имени"
 	if in != "" {
@@ -1,6 +1,9 @@
 package child_bot
 
 import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/stretchr/testify/assert"
 	"sort"
 	"testing"
@@ -69,3 +72,9 @@ func TestParseKeywordsAndModeOK(t *testing.T) {
 	assert.Equal(t, OnlyFirst, m)
 	assert.Equal(t, ok, true)
 }
+
+func TestIsTokenRejected(t *testing.T) {
+	assert.True(t, isTokenRejected(fmt.Errorf("getMe: %w", tgbotapi.Error{Message: "Unauthorized"})))
+	assert.False(t, isTokenRejected(tgbotapi.Error{Message: "Bad Request: chat not found"}))
+	assert.False(t, isTokenRejected(errors.New("connection refused")))
+}
@@ -0,0 +1,283 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/user"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Snippet is a saved reply of operators. It is sent by 'replying' #Name to a forward or by its button under
+// the forward
+type Snippet struct {
+	Name string `bson:"n,omitempty"`
+	Text string `bson:"t,omitempty"`
+}
+
+const (
+	snippetsCallbackTag = "q"
+	snippetPrefix       = "#"
+	// labelChars keeps the callback data of a button within 64 bytes
+	labelChars     = 16
+	snippetsLimit  = 10
+	snippetsPerRow = 2
+	snippetsNone   = "-"
+)
+
+// snippetName returns the lower case name if the text is a single #Name
+func snippetName(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, snippetPrefix) {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(text, snippetPrefix)
+	if !validLabel(name) {
+		return "", false
+	}
+	return strings.ToLower(name), true
+}
+
+// validLabel checks a snippet name or a peer tag: up to labelChars letters, digits and _
+func validLabel(in string) bool {
+	if in == "" || utf8.RuneCountInString(in) > labelChars {
+		return false
+	}
+	for _, r := range in {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func findSnippet(bot Bot, name string) (Snippet, bool) {
+	for _, sn := range bot.Snippets {
+		if sn.Name == name {
+			return sn, true
+		}
+	}
+	return Snippet{}, false
+}
+
+// parseSnippets parses pairs of a name and its text separated by delim. The error is ready to be shown to the user
+func parseSnippets(in string, limit uint16) ([]Snippet, error) {
+	if strings.TrimSpace(in) == snippetsNone {
+		return nil, nil
+	}
+
+	parts := strings.Split(in, delim)
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("нужны пары: название заготовки и ее текст, разделенные '%s'",
+			strings.TrimSpace(delim))
+	}
+	if len(parts)/2 > snippetsLimit {
+		return nil, fmt.Errorf("не более %d заготовок", snippetsLimit)
+	}
+
+	var res []Snippet
+	unique := map[string]struct{}{}
+	for i := 0; i < len(parts); i += 2 {
+		name := strings.TrimPrefix(strings.TrimSpace(parts[i]), snippetPrefix)
+		if !validLabel(name) {
+			return nil, fmt.Errorf("название '%s' должно быть до %d символов: буквы, цифры и _", name,
+				labelChars)
+		}
+		name = strings.ToLower(name)
+		if _, ok := unique[name]; ok {
+			return nil, fmt.Errorf("заготовка '%s' указана дважды", name)
+		}
+		unique[name] = struct{}{}
+
+		text := strings.TrimSpace(parts[i+1])
+		err := checkTemplate(text, limit, ParsePlain)
+		if text == "" || err != nil {
+			return nil, fmt.Errorf("текст заготовки '%s' пустой или с ошибкой в шаблоне: %v", name, err)
+		}
+		res = append(res, Snippet{
+			Name: name,
+			Text: text,
+		})
+	}
+	return res, nil
+}
+
+// snippetsMarkup is the snippet buttons under a forward, nil if the bot has no snippets
+func snippetsMarkup(bot Bot) *tgbotapi.InlineKeyboardMarkup {
+	if len(bot.Snippets) == 0 {
+		return nil
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, sn := range bot.Snippets {
+		btn := tgbotapi.NewInlineKeyboardButtonData(snippetPrefix+sn.Name,
+			snippetsCallbackTag+callbackDelim+sn.Name)
+		if i%snippetsPerRow == 0 {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+			continue
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], btn)
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &markup
+}
+
+// renderSnippet fills template variables with the current name of the peer
+func (s *service) renderSnippet(api *tgbotapi.BotAPI, sn Snippet, tgChatID int64) string {
+	c, err := api.GetChat(tgbotapi.ChatConfig{ChatID: tgChatID})
+	if err != nil {
+		s.logger.Warn().Err(err).Int64("chatID", tgChatID).Send()
+	}
+
+	return renderTemplate(sn.Text, s.peerVars(api.Self.FirstName, from{
+		FirstName: c.FirstName,
+		Username:  c.UserName,
+	}, false))
+}
+
+// expandSnippet replaces a single #Name with the snippet rendered for the peer. It returns false if there is no
+// such snippet, the author is told so
+func (s *service) expandSnippet(
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	text string,
+	tgChatID int64,
+) (
+	string,
+	bool,
+	error,
+) {
+	name, ok := snippetName(text)
+	if !ok || len(bot.Snippets) == 0 {
+		return text, true, nil
+	}
+
+	sn, found := findSnippet(bot, name)
+	if !found {
+		err := s.replyErr(api, upd, fmt.Sprintf("Не отправлено: нет заготовки %s%s. Заготовки: %s", snippetPrefix,
+			name, snippetsCmd))
+		if err != nil {
+			return "", false, fmt.Errorf("s.replyErr: %w", err)
+		}
+		return "", false, nil
+	}
+	return s.renderSnippet(api, sn, tgChatID), true, nil
+}
+
+func (s *service) handleOwnerSnippets(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	upd update,
+	bot Bot,
+	owner user.User,
+) error {
+	err := s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.SetSnippets)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	current := no
+	if len(bot.Snippets) != 0 {
+		pairs := make([]string, 0, len(bot.Snippets))
+		for _, sn := range bot.Snippets {
+			pairs = append(pairs, snippetPrefix+sn.Name+delim+sn.Text)
+		}
+		current = strings.Join(pairs, delim)
+	}
+
+	err = s.reply(api, upd, fmt.Sprintf(`Заготовки — готовые ответы собеседникам. Чтобы отправить заготовку, 'ответьте' на пересланное сообщение ее названием, например #цены, или нажмите ее кнопку под пересланным сообщением.
+
+Заготовки сейчас:
+%s
+
+Напишите пары: название, затем текст, разделенные '%s'. Например:
+
+#цены
+===
+{first_name}, прайс на рекламу: пост 1000 ₽, закреп 2000 ₽
+
+'%s' — удалить все заготовки, %s — отмена. Можно использовать %s`, current, strings.TrimSpace(delim),
+		snippetsNone, help, tplHelp))
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) onSnippets(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot, owner user.User) error {
+	snippets, err := parseSnippets(upd.Message.Text, s.outLimitChars)
+	if err != nil {
+		e := s.replyErr(api, upd, fmt.Sprintf("Не сохранено: %s. Попробуйте еще раз", err))
+		if e != nil {
+			return fmt.Errorf("s.replyErr: %w", e)
+		}
+		return nil
+	}
+
+	err = s.childBotRepo.SetSnippets(ctx, bot.ID, snippets)
+	if err != nil {
+		return fmt.Errorf("s.childBotRepo.SetSnippets: %w", err)
+	}
+
+	err = s.childStateRepo.SetScene(ctx, owner.ID, bot.ID, child_state.None)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.SetScene: %w", err)
+	}
+
+	names := make([]string, 0, len(snippets))
+	for _, sn := range snippets {
+		names = append(names, snippetPrefix+sn.Name)
+	}
+	text := "Заготовки удалены"
+	if len(names) != 0 {
+		text = "Заготовки сохранены: " + strings.Join(names, ", ") + ". Кнопки появятся под новыми пересланными " +
+			"сообщениями"
+	}
+
+	err = s.replyOK(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+	return nil
+}
+
+// handleSnippetCallback works as if the operator 'replied' #Name to the forward under which the button is
+func (s *service) handleSnippetCallback(
+	ctx context.Context,
+	api *tgbotapi.BotAPI,
+	cb callbackQuery,
+	bot Bot,
+	usr user.User,
+	role operator.Role,
+) error {
+	name := strings.TrimPrefix(cb.Data, snippetsCallbackTag+callbackDelim)
+	if !validLabel(name) {
+		return nil
+	}
+
+	err := s.handleOwner(ctx, api, update{
+		Message: message{
+			MessageID: cb.Message.MessageID,
+			Chat:      cb.Message.Chat,
+			From:      cb.From,
+			Text:      snippetPrefix + name,
+			ReplyToMessage: replyToMessage{
+				MessageID: cb.Message.MessageID,
+				From:      cb.Message.From,
+				Text:      cb.Message.Text,
+			},
+		},
+	}, bot, usr, role)
+	if err != nil {
+		return fmt.Errorf("s.handleOwner: %w", err)
+	}
+	return nil
+}
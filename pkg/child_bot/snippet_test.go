@@ -0,0 +1,48 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSnippets(t *testing.T) {
+	res, err := parseSnippets("#Цены\n===\n{first_name}, пост 1000 ₽\n===\nспасибо\n===\nСпасибо, ответим завтра", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Snippet{
+		{Name: "цены", Text: "{first_name}, пост 1000 ₽"},
+		{Name: "спасибо", Text: "Спасибо, ответим завтра"},
+	}, res)
+
+	res, err = parseSnippets(snippetsNone, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = parseSnippets("цены", 0)
+	assert.Error(t, err)
+	_, err = parseSnippets("два слова\n===\nтекст", 0)
+	assert.Error(t, err)
+	_, err = parseSnippets("цены\n===\nа\n===\n#ЦЕНЫ\n===\nб", 0)
+	assert.Error(t, err)
+	_, err = parseSnippets("цены\n===\n{if new}а", 0)
+	assert.Error(t, err)
+}
+
+func TestSnippetName(t *testing.T) {
+	name, ok := snippetName(" #Цены ")
+	assert.True(t, ok)
+	assert.Equal(t, "цены", name)
+
+	_, ok = snippetName("#цены и доставка")
+	assert.False(t, ok)
+	_, ok = snippetName("цены")
+	assert.False(t, ok)
+}
+
+func TestSnippetsMarkup(t *testing.T) {
+	assert.Nil(t, snippetsMarkup(Bot{}))
+
+	markup := snippetsMarkup(Bot{Snippets: []Snippet{{Name: "a"}, {Name: "b"}, {Name: "c"}}})
+	assert.Len(t, markup.InlineKeyboard, 2)
+	assert.Len(t, markup.InlineKeyboard[0], 2)
+	assert.Equal(t, "#c", markup.InlineKeyboard[1][0].Text)
+}
@@ -0,0 +1,65 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	"github.com/vahter-robot/backend/pkg/peer"
+)
+
+// Statuses of the bot in a private chat, Telegram reports a blocked bot as kicked
+const (
+	memberKicked = "kicked"
+	memberMember = "member"
+)
+
+type chatMemberUpdated struct {
+	Chat          chat       `json:"chat"`
+	From          from       `json:"from"`
+	NewChatMember chatMember `json:"new_chat_member"`
+}
+
+type chatMember struct {
+	Status string `json:"status"`
+}
+
+// handleMyChatMember tracks peers who stopped the bot and started it again
+func (s *service) handleMyChatMember(ctx context.Context, upd chatMemberUpdated, bot Bot) error {
+	if upd.Chat.Type != chatPrivate {
+		return nil
+	}
+
+	var stopped bool
+	switch upd.NewChatMember.Status {
+	case memberKicked:
+		stopped = true
+	case memberMember:
+	default:
+		return nil
+	}
+
+	err := s.peerRepo.SetStopped(ctx, bot.ID, upd.From.ID, stopped)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.SetStopped: %w", err)
+	}
+	return nil
+}
+
+// tplPeerStatus is empty for a peer who never stopped the bot
+func tplPeerStatus(p peer.Peer) string {
+	switch {
+	case p.Stopped:
+		return "остановил бота " + p.StoppedAt.UTC().Format("02.01.2006")
+	case !p.RestartedAt.IsZero():
+		return "перезапустил бота " + p.RestartedAt.UTC().Format("02.01.2006")
+	default:
+		return ""
+	}
+}
+
+func tplSendFailed(p peer.Peer) string {
+	if p.Stopped {
+		return fmt.Sprintf("Не отправлено. Собеседник %s, ответ дойдет, только если он запустит бота снова",
+			tplPeerStatus(p))
+	}
+	return "Не отправлено. Возможно пользователь остановил бота"
+}
@@ -0,0 +1,15 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"testing"
+	"time"
+)
+
+func TestTplPeerStatus(t *testing.T) {
+	at := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, "", tplPeerStatus(peer.Peer{}))
+	assert.Equal(t, "остановил бота 05.03.2024", tplPeerStatus(peer.Peer{Stopped: true, StoppedAt: at}))
+	assert.Equal(t, "перезапустил бота 05.03.2024", tplPeerStatus(peer.Peer{StoppedAt: at, RestartedAt: at}))
+}
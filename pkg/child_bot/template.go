@@ -0,0 +1,317 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	"github.com/vahter-robot/backend/pkg/random"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Autoreplies and the start message are templates: {first_name}, {username}, {time} and {bot_name} are replaced
+// with values, {if new}...{else}...{end} picks a part depending on whether the peer writes for the first time,
+// {{ and }} are literal braces, other braces are kept as text. A rule may have several reply variants separated
+// by a line of variantsDelim
+const (
+	tplVarFirstName = "first_name"
+	tplVarUsername  = "username"
+	tplVarTime      = "time"
+	tplVarBotName   = "bot_name"
+	tplIfNew        = "if new"
+	tplElse         = "else"
+	tplEnd          = "end"
+
+	variantsDelim = "~~~"
+	variantsLimit = 10
+)
+
+// tplVarMaxChars are the longest values of variables, by Telegram limits, used to check the reply length
+var tplVarMaxChars = map[string]int{
+	tplVarFirstName: 64,
+	tplVarUsername:  33,
+	tplVarTime:      5,
+	tplVarBotName:   64,
+}
+
+type tplVars struct {
+	firstName string
+	username  string
+	botName   string
+	now       time.Time
+	isNew     bool
+	// pm escapes the values
+	pm parseMode
+}
+
+type tplNode struct {
+	text string
+	// name of the variable
+	name string
+	// cond is {if new}, then and els are its branches
+	cond bool
+	then []tplNode
+	els  []tplNode
+}
+
+func parseTemplate(in string) ([]tplNode, error) {
+	var (
+		root   []tplNode
+		cond   *tplNode
+		inElse bool
+		buf    strings.Builder
+	)
+	add := func(n tplNode) {
+		switch {
+		case cond == nil:
+			root = append(root, n)
+		case inElse:
+			cond.els = append(cond.els, n)
+		default:
+			cond.then = append(cond.then, n)
+		}
+	}
+	flush := func() {
+		if buf.Len() != 0 {
+			add(tplNode{text: buf.String()})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(in); {
+		switch {
+		case strings.HasPrefix(in[i:], "{{"):
+			buf.WriteByte('{')
+			i += 2
+		case strings.HasPrefix(in[i:], "}}"):
+			buf.WriteByte('}')
+			i += 2
+		case in[i] == '{':
+			j := strings.IndexByte(in[i:], '}')
+			tag := ""
+			if j > 0 {
+				tag = strings.TrimSpace(in[i+1 : i+j])
+			}
+			if _, ok := tplVarMaxChars[tag]; !ok && tag != tplIfNew && tag != tplElse && tag != tplEnd {
+				// texts saved before templates existed may have braces of their own
+				buf.WriteByte('{')
+				i++
+				continue
+			}
+			i += j + 1
+			flush()
+
+			switch tag {
+			case tplIfNew:
+				if cond != nil {
+					return nil, fmt.Errorf("{%s} внутри {%s} не поддерживается", tplIfNew, tplIfNew)
+				}
+				cond = &tplNode{cond: true}
+				inElse = false
+			case tplElse:
+				if cond == nil || inElse {
+					return nil, fmt.Errorf("{%s} без {%s}", tplElse, tplIfNew)
+				}
+				inElse = true
+			case tplEnd:
+				if cond == nil {
+					return nil, fmt.Errorf("{%s} без {%s}", tplEnd, tplIfNew)
+				}
+				n := *cond
+				cond = nil
+				add(n)
+			default:
+				add(tplNode{name: tag})
+			}
+		default:
+			buf.WriteByte(in[i])
+			i++
+		}
+	}
+	flush()
+
+	if cond != nil {
+		return nil, fmt.Errorf("{%s} без {%s}", tplIfNew, tplEnd)
+	}
+	return root, nil
+}
+
+// tplMaxChars is the longest possible length of the rendered template
+func tplMaxChars(nodes []tplNode) int {
+	var res int
+	for _, n := range nodes {
+		switch {
+		case n.cond:
+			then, els := tplMaxChars(n.then), tplMaxChars(n.els)
+			if then > els {
+				res += then
+			} else {
+				res += els
+			}
+		case n.name != "":
+			res += tplVarMaxChars[n.name]
+		default:
+			res += utf8.RuneCountInString(n.text)
+		}
+	}
+	return res
+}
+
+func renderNodes(sb *strings.Builder, nodes []tplNode, v tplVars) {
+	for _, n := range nodes {
+		switch {
+		case n.cond && v.isNew:
+			renderNodes(sb, n.then, v)
+		case n.cond:
+			renderNodes(sb, n.els, v)
+		case n.name == tplVarFirstName:
+			sb.WriteString(v.pm.escape(v.firstName))
+		case n.name == tplVarUsername:
+			sb.WriteString(v.pm.escape(v.username))
+		case n.name == tplVarTime:
+			sb.WriteString(v.pm.escape(v.now.Format("15:04")))
+		case n.name == tplVarBotName:
+			sb.WriteString(v.pm.escape(v.botName))
+		default:
+			sb.WriteString(n.text)
+		}
+	}
+}
+
+// renderTemplate fills the template. Texts saved before templates existed may not parse, they are sent as is
+func renderTemplate(in string, v tplVars) string {
+	nodes, err := parseTemplate(in)
+	if err != nil {
+		return in
+	}
+
+	var sb strings.Builder
+	renderNodes(&sb, nodes, v)
+	return sb.String()
+}
+
+// checkTemplate validates the template, its longest rendering against limit, zero limit is not checked, and the
+// markup of both {if new} branches
+func checkTemplate(in string, limit uint16, pm parseMode) error {
+	nodes, err := parseTemplate(in)
+	if err != nil {
+		return err
+	}
+
+	if limit != 0 && tplMaxChars(nodes) > int(limit) {
+		return fmt.Errorf("с подставленными значениями может быть длиннее %d символов", limit)
+	}
+
+	for _, isNew := range []bool{true, false} {
+		var sb strings.Builder
+		renderNodes(&sb, nodes, tplVars{
+			firstName: "x",
+			username:  "x",
+			botName:   "x",
+			isNew:     isNew,
+			pm:        pm,
+		})
+
+		err = checkFormat(sb.String(), pm)
+		if err != nil {
+			return fmt.Errorf("разметка %s: %w", pm, err)
+		}
+	}
+	return nil
+}
+
+// splitVariants splits reply variants by a line of variantsDelim
+func splitVariants(in string) []string {
+	var (
+		res []string
+		cur []string
+	)
+	for _, line := range strings.Split(in, "\n") {
+		if strings.TrimSpace(line) == variantsDelim {
+			res = append(res, strings.Join(cur, "\n"))
+			cur = nil
+			continue
+		}
+		cur = append(cur, line)
+	}
+	return append(res, strings.Join(cur, "\n"))
+}
+
+func joinVariants(in []string) string {
+	return strings.Join(in, "\n"+variantsDelim+"\n")
+}
+
+// checkVariants validates reply variants, the error is ready to be shown to the user
+func (s *service) checkVariants(outs []string, pm parseMode) error {
+	if len(outs) > variantsLimit {
+		return fmt.Errorf("не более %d вариантов ответа", variantsLimit)
+	}
+	for i, out := range outs {
+		if strings.TrimSpace(out) == "" {
+			return fmt.Errorf("вариант ответа %d пустой", i+1)
+		}
+
+		err := checkTemplate(out, s.outLimitChars, pm)
+		if err != nil {
+			return fmt.Errorf("вариант ответа %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// tplHelp describes the template language to owners
+const tplHelp = "{first_name} — имя собеседника, {username} — его @username, {time} — текущее время, " +
+	"{bot_name} — имя бота, {if new}текст для первого сообщения{else}для остальных{end}. Фигурные скобки " +
+	"пишутся как {{ и }}"
+
+// outs returns all reply variants of the rule
+func (kw Keyword) outs() []string {
+	return append([]string{kw.Out}, kw.Variants...)
+}
+
+func (kw *Keyword) setOuts(outs []string) {
+	kw.Out = outs[0]
+	kw.Variants = nil
+	if len(outs) > 1 {
+		kw.Variants = outs[1:]
+	}
+}
+
+// pickReply chooses one of reply variants. Round robin falls back to random when the counter is unavailable
+func (s *service) pickReply(ctx context.Context, bot Bot, d decision) string {
+	if len(d.replies) == 1 {
+		return d.replies[0]
+	}
+
+	if d.roundRobin && !d.keywordID.IsZero() {
+		n, found, err := s.childBotRepo.NextKeywordCounter(ctx, bot.ID, d.keywordID)
+		if err != nil {
+			s.logger.Warn().Err(err).Str("childBotID", bot.ID.Hex()).Send()
+		}
+		if found {
+			return d.replies[n%uint64(len(d.replies))]
+		}
+	}
+
+	ix, err := random.Intn(len(d.replies))
+	if err != nil {
+		s.logger.Warn().Err(err).Send()
+		return d.replies[0]
+	}
+	return d.replies[ix]
+}
+
+func (s *service) peerVars(botName string, f from, isNew bool) tplVars {
+	username := ""
+	if f.Username != "" {
+		username = "@" + f.Username
+	}
+
+	return tplVars{
+		firstName: f.FirstName,
+		username:  username,
+		botName:   botName,
+		now:       time.Now().In(s.location),
+		isNew:     isNew,
+	}
+}
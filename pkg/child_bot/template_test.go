@@ -0,0 +1,46 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tpl := "{if new}Привет{else}Снова здравствуйте{end}, {first_name} ({username})! {{бот}} {bot_name}, {time}"
+	v := tplVars{
+		firstName: "Аня",
+		username:  "@anya",
+		botName:   "Вахтёр",
+		now:       time.Date(2021, 1, 2, 9, 5, 0, 0, time.UTC),
+		isNew:     true,
+	}
+
+	assert.Equal(t, "Привет, Аня (@anya)! {бот} Вахтёр, 09:05", renderTemplate(tpl, v))
+
+	v.isNew = false
+	assert.Equal(t, "Снова здравствуйте, Аня (@anya)! {бот} Вахтёр, 09:05", renderTemplate(tpl, v))
+
+	assert.Equal(t, "Цена {от 100}", renderTemplate("Цена {от 100}", v))
+	assert.Equal(t, "{name} Аня }", renderTemplate("{name} {first_name} }", v))
+	assert.Equal(t, "скобка { Аня", renderTemplate("скобка { {first_name}", v))
+}
+
+func TestCheckTemplate(t *testing.T) {
+	assert.NoError(t, checkTemplate("Привет, {first_name}", 80, ParsePlain))
+	assert.Error(t, checkTemplate("Привет, {first_name}", 20, ParsePlain))
+	assert.NoError(t, checkTemplate("Привет, {name}", 0, ParsePlain))
+	assert.NoError(t, checkTemplate("Привет } {", 0, ParsePlain))
+	assert.Error(t, checkTemplate("{if new}Привет", 0, ParsePlain))
+	assert.Error(t, checkTemplate("Привет{end}", 0, ParsePlain))
+	assert.Error(t, checkTemplate("{if new}{if new}{end}{end}", 0, ParsePlain))
+}
+
+func TestSplitVariants(t *testing.T) {
+	assert.Equal(t, []string{"Привет", "Здравствуйте\nслушаю"}, splitVariants("Привет\n~~~\nЗдравствуйте\nслушаю"))
+	assert.Equal(t, []string{"Привет"}, splitVariants("Привет"))
+
+	s := &service{outLimitChars: 100}
+	assert.NoError(t, s.checkVariants(splitVariants("Привет\n ~~~ \nЗдравствуйте"), ParsePlain))
+	assert.Error(t, s.checkVariants(splitVariants("Привет\n~~~\n"), ParsePlain))
+}
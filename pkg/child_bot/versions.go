@@ -0,0 +1,312 @@
+package child_bot
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"github.com/vahter-robot/backend/pkg/version"
+	"go.mongodb.org/mongo-driver/bson"
+	"strconv"
+	"strings"
+)
+
+const (
+	versionsLimit = 20
+
+	sourceStart    = "приветствие"
+	sourceButtons  = "кнопки приветствия"
+	sourceMenu     = "меню"
+	sourceLinks    = "ссылки"
+	sourceKeywords = "ключевые слова"
+	sourceImport   = "импорт файла"
+	sourceRollback = "откат к v%d"
+	sourceInitial  = "исходная"
+)
+
+// recordVersion stores the settings after a change. The first change of a bot also stores the state before it,
+// so it can be rolled back
+func (s *service) recordVersion(ctx context.Context, prev, next Bot, f from, source string) (int64, error) {
+	count, err := s.versionRepo.Count(ctx, prev.ID)
+	if err != nil {
+		return 0, fmt.Errorf("s.versionRepo.Count: %w", err)
+	}
+
+	if count == 0 && hasSettings(prev) {
+		_, err = s.versionRepo.Create(ctx, version.Version{
+			ChildBotID: prev.ID,
+			Settings:   settingsOf(prev),
+			Source:     sourceInitial,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("s.versionRepo.Create: %w", err)
+		}
+	}
+
+	n, err := s.versionRepo.Create(ctx, version.Version{
+		ChildBotID: next.ID,
+		Settings:   settingsOf(next),
+		TgUserID:   f.ID,
+		Name:       tplName(f.FirstName),
+		Source:     source,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("s.versionRepo.Create: %w", err)
+	}
+
+	return n, nil
+}
+
+func hasSettings(bot Bot) bool {
+	return bot.OnPeerStart != "" || bot.StartMedia != nil || len(bot.StartButtons) != 0 || len(bot.Menu) != 0 ||
+		len(bot.StartPayloads) != 0 || len(bot.Keywords) != 0
+}
+
+// botOf restores the settings of the version. Versions stored before media, buttons, menu and payloads were
+// versioned leave them empty
+func botOf(v version.Version) (Bot, error) {
+	raw, err := bson.Marshal(v.Settings)
+	if err != nil {
+		return Bot{}, fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	var bot Bot
+	err = bson.Unmarshal(raw, &bot)
+	if err != nil {
+		return Bot{}, fmt.Errorf("bson.Unmarshal: %w", err)
+	}
+	bot.ID = v.ChildBotID
+
+	return bot, nil
+}
+
+// applySettings saves the settings and records them as a version in one transaction. Every change of the
+// versioned settings goes through it or applyChange, so no change is left without a version
+func (s *service) applySettings(ctx context.Context, prev, next Bot, f from, source string) (int64, error) {
+	next.Keywords = withKeywordIDs(next.Keywords)
+
+	var n int64
+	err := m.WithTransaction(ctx, s.client, func(tc context.Context) error {
+		e := s.childBotRepo.SetSettings(tc, next.ID, next)
+		if e != nil {
+			return fmt.Errorf("s.childBotRepo.SetSettings: %w", e)
+		}
+
+		n, e = s.recordVersion(tc, prev, next, f, source)
+		if e != nil {
+			return fmt.Errorf("s.recordVersion: %w", e)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("m.WithTransaction: %w", err)
+	}
+
+	return n, nil
+}
+
+// applyChange runs a change of single settings and records the result as a version in one transaction. The
+// change returns false if there was nothing to change, then no version is recorded. The fresh bot is returned
+func (s *service) applyChange(
+	ctx context.Context,
+	prev Bot,
+	f from,
+	source string,
+	change func(context.Context) (bool, error),
+) (
+	Bot,
+	bool,
+	error,
+) {
+	var next Bot
+	var changed bool
+	err := m.WithTransaction(ctx, s.client, func(tc context.Context) error {
+		var e error
+		changed, e = change(tc)
+		if e != nil {
+			return fmt.Errorf("change: %w", e)
+		}
+
+		next, e = s.reloadBot(tc, prev)
+		if e != nil {
+			return fmt.Errorf("s.reloadBot: %w", e)
+		}
+		if !changed {
+			return nil
+		}
+
+		_, e = s.recordVersion(tc, prev, next, f, source)
+		if e != nil {
+			return fmt.Errorf("s.recordVersion: %w", e)
+		}
+		return nil
+	})
+	if err != nil {
+		return Bot{}, false, fmt.Errorf("m.WithTransaction: %w", err)
+	}
+
+	return next, changed, nil
+}
+
+func (s *service) handleOwnerVersions(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	vs, err := s.versionRepo.GetLatest(ctx, bot.ID, versionsLimit)
+	if err != nil {
+		return fmt.Errorf("s.versionRepo.GetLatest: %w", err)
+	}
+
+	if len(vs) == 0 {
+		err = s.reply(api, upd, "Версий пока нет. Они появятся после первого изменения правил или приветствия")
+		if err != nil {
+			return fmt.Errorf("s.reply: %w", err)
+		}
+		return nil
+	}
+
+	text := fmt.Sprintf(`Версии правил, последние %d. Время UTC
+
+%s N — что изменится при откате к версии N, %s N M — разница между версиями
+%s N — откатить правила и приветствие к версии N`, len(vs), diffVersions, diffVersions, rollback)
+	for _, v := range vs {
+		vb, e := botOf(v)
+		if e != nil {
+			return fmt.Errorf("botOf: %w", e)
+		}
+
+		who := "—"
+		if v.TgUserID != 0 {
+			who = tplName(v.Name)
+		}
+
+		text += fmt.Sprintf(`
+
+v%d — %s
+%s, %s, правил: %d`, v.Number, v.CreatedAt.UTC().Format("02.01.2006 15:04"), who, v.Source, len(vb.Keywords))
+	}
+
+	err = s.reply(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerDiff(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	nums, ok := parseVersionNumbers(strings.TrimPrefix(upd.Message.Text, diffVersions))
+	if !ok || len(nums) == 0 || len(nums) > 2 {
+		err := s.replyErr(api, upd, fmt.Sprintf("Укажите одну или две версии, например: %s 3 или %s 3 5",
+			diffVersions, diffVersions))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	base := configOf(bot)
+	baseName := "текущие"
+	var to botConfig
+	toName := ""
+	for i, n := range nums {
+		v, found, err := s.versionRepo.Get(ctx, bot.ID, n)
+		if err != nil {
+			return fmt.Errorf("s.versionRepo.Get: %w", err)
+		}
+		if !found {
+			err = s.replyErr(api, upd, fmt.Sprintf("Версия v%d не найдена. Список: %s", n, versions))
+			if err != nil {
+				return fmt.Errorf("s.replyErr: %w", err)
+			}
+			return nil
+		}
+
+		vb, err := botOf(v)
+		if err != nil {
+			return fmt.Errorf("botOf: %w", err)
+		}
+
+		if i == 0 && len(nums) == 2 {
+			base = configOf(vb)
+			baseName = fmt.Sprintf("v%d", n)
+			continue
+		}
+		to = configOf(vb)
+		toName = fmt.Sprintf("v%d", n)
+	}
+
+	diff := diffConfig(base, to)
+	text := fmt.Sprintf("Разница %s → %s:\n\n%s", baseName, toName, strings.Join(diff, "\n"))
+	if len(diff) == 0 {
+		text = fmt.Sprintf("Разницы между %s и %s нет", baseName, toName)
+	}
+
+	err := s.reply(api, upd, text)
+	if err != nil {
+		return fmt.Errorf("s.reply: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) handleOwnerRollback(ctx context.Context, api *tgbotapi.BotAPI, upd update, bot Bot) error {
+	nums, ok := parseVersionNumbers(strings.TrimPrefix(upd.Message.Text, rollback))
+	if !ok || len(nums) != 1 {
+		err := s.replyErr(api, upd, fmt.Sprintf("Укажите номер версии, например: %s 3. Список: %s", rollback,
+			versions))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	v, found, err := s.versionRepo.Get(ctx, bot.ID, nums[0])
+	if err != nil {
+		return fmt.Errorf("s.versionRepo.Get: %w", err)
+	}
+	if !found {
+		err = s.replyErr(api, upd, fmt.Sprintf("Версия v%d не найдена. Список: %s", nums[0], versions))
+		if err != nil {
+			return fmt.Errorf("s.replyErr: %w", err)
+		}
+		return nil
+	}
+
+	next, err := botOf(v)
+	if err != nil {
+		return fmt.Errorf("botOf: %w", err)
+	}
+	next.SetupDone = true
+
+	diff := diffConfig(configOf(bot), configOf(next))
+	if len(diff) == 0 {
+		err = s.replyOK(api, upd, fmt.Sprintf("Текущие правила совпадают с v%d", v.Number))
+		if err != nil {
+			return fmt.Errorf("s.replyOK: %w", err)
+		}
+		return nil
+	}
+
+	n, err := s.applySettings(ctx, bot, next, upd.Message.From, fmt.Sprintf(sourceRollback, v.Number))
+	if err != nil {
+		return fmt.Errorf("s.applySettings: %w", err)
+	}
+
+	err = s.replyOK(api, upd, fmt.Sprintf("Правила откачены к v%d, сохранено как v%d:\n\n%s", v.Number, n,
+		strings.Join(diff, "\n")))
+	if err != nil {
+		return fmt.Errorf("s.replyOK: %w", err)
+	}
+
+	return nil
+}
+
+func parseVersionNumbers(in string) ([]int64, bool) {
+	var res []int64
+	for _, f := range strings.Fields(in) {
+		n, err := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(f), "v"), 10, 64)
+		if err != nil || n <= 0 {
+			return nil, false
+		}
+		res = append(res, n)
+	}
+	return res, true
+}
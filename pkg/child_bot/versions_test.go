@@ -0,0 +1,41 @@
+package child_bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vahter-robot/backend/pkg/version"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestBotOf(t *testing.T) {
+	bot := Bot{
+		ID:            primitive.NewObjectID(),
+		Mode:          Always,
+		OnPeerStart:   "Привет",
+		StartMedia:    &Media{Kind: MediaPhoto, FileID: "f"},
+		StartButtons:  []Button{{Text: "Сайт", URL: "https://example.com"}},
+		Menu:          []MenuItem{{Text: "Цены"}},
+		StartPayloads: []StartPayload{{Payload: "ads", Text: "Из рекламы"}},
+		Keywords:      []Keyword{{In: []string{"цена"}, Out: "1000"}},
+	}
+
+	raw, err := bson.Marshal(version.Version{ChildBotID: bot.ID, Number: 2, Settings: settingsOf(bot)})
+	assert.NoError(t, err)
+	var v version.Version
+	assert.NoError(t, bson.Unmarshal(raw, &v))
+
+	res, err := botOf(v)
+	assert.NoError(t, err)
+	assert.Equal(t, bot, res)
+
+	// versions stored before settings were inline have the same field names
+	raw, err = bson.Marshal(bson.M{"cbi": bot.ID, "v": 1, "m": OnlyFirst, "ops": "Старое", "k": bot.Keywords})
+	assert.NoError(t, err)
+	v = version.Version{}
+	assert.NoError(t, bson.Unmarshal(raw, &v))
+
+	res, err = botOf(v)
+	assert.NoError(t, err)
+	assert.Equal(t, Bot{ID: bot.ID, Mode: OnlyFirst, OnPeerStart: "Старое", Keywords: bot.Keywords}, res)
+}
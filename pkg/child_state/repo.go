@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -16,14 +17,28 @@ type State struct {
 	UserID     primitive.ObjectID `bson:"ui,omitempty"`
 	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
 	Scene      Scene              `bson:"s,omitempty"`
+	Payload    string             `bson:"p,omitempty"`
 }
 
 type Scene uint32
 
 const (
-	None        Scene = 1
-	SetStart    Scene = 2
-	SetKeywords Scene = 3
+	None           Scene = 1
+	SetStart       Scene = 2
+	SetKeywords    Scene = 3
+	RemoveOperator Scene = 4
+	ImportConfig   Scene = 5
+	AddRuleIn      Scene = 6
+	AddRuleOut     Scene = 7
+	EditRuleIn     Scene = 8
+	EditRuleOut    Scene = 9
+	EditRuleMedia  Scene = 10
+	EditRuleButton Scene = 11
+	SetStartButton Scene = 12
+	SetMenu        Scene = 13
+	SetStartLinks  Scene = 14
+	SetBroadcast   Scene = 15
+	SetSnippets    Scene = 16
 )
 
 type Repo struct {
@@ -72,6 +87,9 @@ func (r *Repo) SetScene(c context.Context, userID, childBotID primitive.ObjectID
 		"$set": bson.M{
 			"s": sc,
 		},
+		"$unset": bson.M{
+			"p": "",
+		},
 	}, options.Update().SetUpsert(true))
 	if err != nil {
 		return fmt.Errorf("r.coll.UpdateOne: %w", err)
@@ -99,6 +117,56 @@ func (r *Repo) GetScene(c context.Context, userID, childBotID primitive.ObjectID
 	return st.Scene, nil
 }
 
+// SetSceneWithPayload sets the scene together with data the scene needs on the next message
+func (r *Repo) SetSceneWithPayload(
+	c context.Context,
+	userID,
+	childBotID primitive.ObjectID,
+	sc Scene,
+	payload string,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"ui":  userID,
+		"cbi": childBotID,
+	}, bson.M{
+		"$set": bson.M{
+			"s": sc,
+			"p": payload,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Get(c context.Context, userID, childBotID primitive.ObjectID) (State, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var st State
+	err := r.coll.FindOne(ctx, bson.M{
+		"ui":  userID,
+		"cbi": childBotID,
+	}).Decode(&st)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return State{
+				UserID:     userID,
+				ChildBotID: childBotID,
+				Scene:      None,
+			}, nil
+		}
+		return State{}, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return st, nil
+}
+
 func (r *Repo) Delete(c context.Context, userID, childBotID primitive.ObjectID) error {
 	_, err := r.coll.DeleteOne(c, bson.M{
 		"ui":  userID,
@@ -110,3 +178,62 @@ func (r *Repo) Delete(c context.Context, userID, childBotID primitive.ObjectID)
 
 	return nil
 }
+
+func (r *Repo) SetUserID(c context.Context, fromUserID, toUserID, childBotID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteOne(ctx, bson.M{
+		"ui":  toUserID,
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteOne: %w", err)
+	}
+
+	_, err = r.coll.UpdateOne(ctx, bson.M{
+		"ui":  fromUserID,
+		"cbi": childBotID,
+	}, bson.M{
+		"$set": bson.M{
+			"ui": toUserID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByUserID(c context.Context, userID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"ui": userID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
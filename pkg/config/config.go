@@ -10,6 +10,7 @@ type Config struct {
 	MongoDB            mongodb
 	ParentBot          parentBot
 	ChildBot           childBot
+	Retention          retention
 	SetWebhooksOnStart bool
 	LogLevel           string
 }
@@ -35,6 +36,14 @@ type childBot struct {
 	InLimitChars        uint16
 	OutLimitChars       uint16
 	TimeoutOnHandle     bool
+	DeletedKeepDays     uint16 `default:"30"`
+	TimeZone            string `default:"Europe/Moscow"`
+}
+
+type retention struct {
+	RepliesDays  uint16 `default:"90"`
+	PeersDays    uint16 `default:"365"`
+	MessagesDays uint16 `default:"90"`
 }
 
 func NewConfig() (Config, error) {
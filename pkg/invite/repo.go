@@ -0,0 +1,125 @@
+package invite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Invite struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Code       string             `bson:"c,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	Role       operator.Role      `bson:"r,omitempty"`
+	ExpireAt   time.Time          `bson:"ea,omitempty"`
+}
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("invites"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.M{
+			"c": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Create(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	code string,
+	role operator.Role,
+	expireAt time.Time,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.InsertOne(ctx, Invite{
+		Code:       code,
+		ChildBotID: childBotID,
+		Role:       role,
+		ExpireAt:   expireAt,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// Redeem consumes the invite, so every link adds a single operator
+func (r *Repo) Redeem(c context.Context, childBotID primitive.ObjectID, code string) (Invite, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var inv Invite
+	err := r.coll.FindOneAndDelete(ctx, bson.M{
+		"c":   code,
+		"cbi": childBotID,
+		"ea": bson.M{
+			"$gt": time.Now().UTC(),
+		},
+	}).Decode(&inv)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Invite{}, false, nil
+		}
+
+		return Invite{}, false, fmt.Errorf("r.coll.FindOneAndDelete: %w", err)
+	}
+
+	return inv, true, nil
+}
+
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Repo elects one instance to run a periodic task. The leader holds a lease and prolongs it on every run,
+// another instance takes over once the lease is over
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(_ context.Context, db *mongo.Database) (*Repo, error) {
+	return &Repo{
+		coll: db.Collection("leaders"),
+	}, nil
+}
+
+// Acquire takes or prolongs the lease of the task for the holder. It returns false if another holder has it
+func (r *Repo) Acquire(c context.Context, task, holder string, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": task,
+		"$or": bson.A{bson.M{
+			"h": holder,
+		}, bson.M{
+			"lu": bson.M{
+				"$lt": now,
+			},
+		}},
+	}, bson.M{
+		"$set": bson.M{
+			"h":  holder,
+			"lu": now.Add(lease),
+		},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return true, nil
+}
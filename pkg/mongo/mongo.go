@@ -2,7 +2,9 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -36,6 +38,65 @@ func NewConn(ctx context.Context, service string, url string) (*mongo.Database,
 	return conn.Database("vahter_robot_" + service), nil
 }
 
+// codeIllegalOperation is returned by a standalone server on transaction start
+const codeIllegalOperation = 20
+
+// WithTransaction runs fn in a transaction reading from the primary. When the server does not support
+// transactions, fn runs without one, so it should order its writes to be safe to repeat
+func WithTransaction(ctx context.Context, client *mongo.Client, fn func(context.Context) error) error {
+	sess, err := client.StartSession()
+	if err != nil {
+		return fmt.Errorf("client.StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, options.Transaction().SetReadPreference(readpref.Primary()))
+	if err != nil {
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Code == codeIllegalOperation {
+			return fn(ctx)
+		}
+		return fmt.Errorf("sess.WithTransaction: %w", err)
+	}
+
+	return nil
+}
+
+// InTransaction reports whether ctx runs inside a transaction started by WithTransaction
+func InTransaction(ctx context.Context) bool {
+	sess, ok := mongo.SessionFromContext(ctx).(mongo.XSession)
+	return ok && sess.ClientSession().TransactionRunning()
+}
+
 type Doc struct {
 	ID primitive.ObjectID `bson:"_id,omitempty"`
 }
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection. It reads from the primary, so a bot
+// created right before is not missed by cleanups comparing it with existing bots
+func GetChildBotIDs(c context.Context, coll *mongo.Collection) ([]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	primary, err := coll.Clone(options.Collection().SetReadPreference(readpref.Primary()))
+	if err != nil {
+		return nil, fmt.Errorf("coll.Clone: %w", err)
+	}
+
+	raw, err := primary.Distinct(ctx, "cbi", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("primary.Distinct: %w", err)
+	}
+
+	res := make([]primitive.ObjectID, 0, len(raw))
+	for _, item := range raw {
+		id, ok := item.(primitive.ObjectID)
+		if ok {
+			res = append(res, id)
+		}
+	}
+
+	return res, nil
+}
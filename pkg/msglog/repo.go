@@ -0,0 +1,276 @@
+package msglog
+
+import (
+	"context"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Message struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	TgUserID   int64              `bson:"tui,omitempty"`
+	Author     Author             `bson:"a,omitempty"`
+	Text       string             `bson:"t,omitempty"`
+	Rule       int                `bson:"r,omitempty"`
+	Keyword    string             `bson:"k,omitempty"`
+	Name       string             `bson:"n,omitempty"`
+	CreatedAt  time.Time          `bson:"ca,omitempty"`
+	ExpireAt   time.Time          `bson:"ea,omitempty"`
+}
+
+type Author uint8
+
+const (
+	// Peer is an inbound message of the peer
+	Peer Author = 1
+	// Bot is an auto reply, Rule and Keyword are set when it was matched by a keyword rule
+	Bot Author = 2
+	// Operator is a reply of the owner or an operator, Name is set to the operator name
+	Operator Author = 3
+)
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("message_log"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "tui",
+			Value: 1,
+		}, {
+			Key:   "_id",
+			Value: -1,
+		}},
+	}, {
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "t",
+			Value: "text",
+		}},
+		Options: options.Index().SetDefaultLanguage("russian"),
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Create(c context.Context, msg Message) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	msg.ID = primitive.NilObjectID
+	msg.CreatedAt = time.Now().UTC()
+	_, err := r.coll.InsertOne(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("r.coll.InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetByPeer returns a page of the peer conversation, newest first. The bool is true if there are older messages
+func (r *Repo) GetByPeer(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID int64,
+	skip,
+	limit int64,
+) (
+	[]Message,
+	bool,
+	error,
+) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, options.Find().SetSort(bson.M{
+		"_id": -1,
+	}).SetSkip(skip).SetLimit(limit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Message
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, false, fmt.Errorf("cur.All: %w", err)
+	}
+
+	if int64(len(res)) > limit {
+		return res[:limit], true, nil
+	}
+	return res, false, nil
+}
+
+// Search finds messages of the bot by full-text query, most relevant first
+func (r *Repo) Search(c context.Context, childBotID primitive.ObjectID, query string, limit int64) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+		"$text": bson.M{
+			"$search": query,
+		},
+	}, options.Find().SetProjection(bson.M{
+		"score": bson.M{
+			"$meta": "textScore",
+		},
+	}).SetSort(bson.D{{
+		Key: "score",
+		Value: bson.M{
+			"$meta": "textScore",
+		},
+	}, {
+		Key:   "_id",
+		Value: -1,
+	}}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Message
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// CountByAuthorSince counts messages of the author created after since. Creation time is taken from _id
+func (r *Repo) CountByAuthorSince(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	author Author,
+	since time.Time,
+) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{
+		"cbi": childBotID,
+		"a":   author,
+		"_id": bson.M{
+			"$gte": primitive.NewObjectIDFromTimestamp(since),
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) DeleteByPeer(c context.Context, childBotID primitive.ObjectID, tgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteMany(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetByChildBotID(c context.Context, childBotID primitive.ObjectID) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Message
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// BackfillExpireAt sets expiry on documents of the bot stored without it
+func (r *Repo) BackfillExpireAt(c context.Context, childBotID primitive.ObjectID, expireAt time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	ur, err := r.coll.UpdateMany(ctx, bson.M{
+		"cbi": childBotID,
+		"ea": bson.M{
+			"$exists": false,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"ea": expireAt,
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return ur.ModifiedCount, nil
+}
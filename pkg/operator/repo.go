@@ -0,0 +1,209 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Operator struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	TgUserID   int64              `bson:"tui,omitempty"`
+	TgChatID   int64              `bson:"tci,omitempty"`
+	Name       string             `bson:"n,omitempty"`
+	Role       Role               `bson:"r,omitempty"`
+}
+
+type Role uint8
+
+const (
+	// Admin can edit bot settings, reply to and ban peers
+	Admin Role = 1
+	// Agent can only reply to and ban peers
+	Agent Role = 2
+)
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("operators"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "tui",
+			Value: 1,
+		}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Create(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	tgChatID int64,
+	name string,
+	role Role,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$set": bson.M{
+			"tci": tgChatID,
+			"n":   name,
+			"r":   role,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Get(c context.Context, childBotID primitive.ObjectID, tgUserID int64) (Operator, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var op Operator
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}).Decode(&op)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Operator{}, false, nil
+		}
+
+		return Operator{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return op, true, nil
+}
+
+func (r *Repo) GetByChildBotID(c context.Context, childBotID primitive.ObjectID) ([]Operator, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+	}, options.Find().SetSort(bson.M{
+		"_id": 1,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Operator
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *Repo) Delete(c context.Context, childBotID, id primitive.ObjectID) (Operator, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var op Operator
+	err := r.coll.FindOneAndDelete(ctx, bson.M{
+		"_id": id,
+		"cbi": childBotID,
+	}).Decode(&op)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Operator{}, false, nil
+		}
+
+		return Operator{}, false, fmt.Errorf("r.coll.FindOneAndDelete: %w", err)
+	}
+
+	return op, true, nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteByTgUserID removes the user from operators of all bots
+func (r *Repo) DeleteByTgUserID(c context.Context, tgUserID int64) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetByTgUserID(c context.Context, tgUserID int64) ([]Operator, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Operator
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,367 @@
+package parent_bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_bot"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/parent_state"
+	"github.com/vahter-robot/backend/pkg/user"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"strings"
+	"time"
+)
+
+const (
+	exportMyData  = "/export_my_data"
+	deleteAccount = "/delete_account"
+)
+
+type accountDeleter interface {
+	DeleteAccount(ctx context.Context, usr user.User) error
+}
+
+type exportData struct {
+	ExportedAt time.Time    `json:"exported_at"`
+	User       exportUser   `json:"user"`
+	Bots       []exportBot  `json:"bots"`
+	OperatorOf []exportRole `json:"operator_of,omitempty"`
+}
+
+type exportUser struct {
+	TgUserID int64 `json:"telegram_user_id"`
+	TgChatID int64 `json:"telegram_chat_id"`
+}
+
+type exportBot struct {
+	ID           string          `json:"id"`
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"`
+	Paused       bool            `json:"paused"`
+	Mode         uint8           `json:"mode"`
+	StartMessage string          `json:"start_message"`
+	Keywords     []exportKeyword `json:"keywords"`
+	Retention    exportRetention `json:"retention"`
+	Operators    []exportRole    `json:"operators"`
+	Peers        []exportPeer    `json:"peers"`
+	Messages     []exportMessage `json:"messages"`
+}
+
+// exportRetention is days the bot keeps its data, zero is the default of the service
+type exportRetention struct {
+	MessagesDays uint16 `json:"messages_days,omitempty"`
+	RepliesDays  uint16 `json:"replies_days,omitempty"`
+	PeersDays    uint16 `json:"peers_days,omitempty"`
+}
+
+type exportKeyword struct {
+	In         []string       `json:"in"`
+	Out        string         `json:"out"`
+	Variants   []string       `json:"variants,omitempty"`
+	RoundRobin bool           `json:"round_robin,omitempty"`
+	ParseMode  string         `json:"parse_mode,omitempty"`
+	NoPreview  bool           `json:"disable_preview,omitempty"`
+	Media      string         `json:"media,omitempty"`
+	Buttons    []exportButton `json:"buttons,omitempty"`
+	Ban        bool           `json:"ban"`
+}
+
+type exportButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+type exportRole struct {
+	BotID    string `json:"bot_id,omitempty"`
+	TgUserID int64  `json:"telegram_user_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role"`
+}
+
+type exportPeer struct {
+	TgUserID    int64      `json:"telegram_user_id"`
+	Muted       bool       `json:"muted"`
+	ClaimedBy   int64      `json:"claimed_by,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Stopped     bool       `json:"stopped,omitempty"`
+	StoppedAt   *time.Time `json:"stopped_at,omitempty"`
+	RestartedAt *time.Time `json:"restarted_at,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Note        string     `json:"note,omitempty"`
+}
+
+type exportMessage struct {
+	TgUserID  int64     `json:"telegram_user_id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Rule      int       `json:"rule,omitempty"`
+	Keyword   string    `json:"keyword,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (b *service) handleExportMyData(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	data, err := b.exportData(ctx, usr)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	_, err = b.bot.Send(msg.Sender, &tb.Document{
+		File:     tb.FromReader(bytes.NewReader(raw)),
+		MIME:     "application/json",
+		FileName: "vahter-data.json",
+		Caption:  "Ваши данные в Вахтёре. Токены ботов не включены",
+	})
+	if err != nil {
+		b.replyFatalErr(msg, err)
+	}
+}
+
+func (b *service) exportData(ctx context.Context, usr user.User) (exportData, error) {
+	bots, err := b.childBotRepo.GetAllByUserID(ctx, usr.ID)
+	if err != nil {
+		return exportData{}, fmt.Errorf("b.childBotRepo.GetAllByUserID: %w", err)
+	}
+
+	data := exportData{
+		ExportedAt: time.Now().UTC(),
+		User: exportUser{
+			TgUserID: usr.TgUserID,
+			TgChatID: usr.TgChatID,
+		},
+		Bots: make([]exportBot, 0, len(bots)),
+	}
+
+	for _, bot := range bots {
+		eb, e := b.exportBot(ctx, bot)
+		if e != nil {
+			return exportData{}, fmt.Errorf("b.exportBot: %w", e)
+		}
+		data.Bots = append(data.Bots, eb)
+	}
+
+	ops, err := b.operatorRepo.GetByTgUserID(ctx, usr.TgUserID)
+	if err != nil {
+		return exportData{}, fmt.Errorf("b.operatorRepo.GetByTgUserID: %w", err)
+	}
+	for _, op := range ops {
+		data.OperatorOf = append(data.OperatorOf, exportRole{
+			BotID: op.ChildBotID.Hex(),
+			Name:  op.Name,
+			Role:  exportRoleName(op.Role),
+		})
+	}
+
+	return data, nil
+}
+
+func (b *service) exportBot(ctx context.Context, bot child_bot.Bot) (exportBot, error) {
+	eb := exportBot{
+		ID:           bot.ID.Hex(),
+		Paused:       bot.Paused,
+		Mode:         uint8(bot.Mode),
+		StartMessage: bot.OnPeerStart,
+		Keywords:     make([]exportKeyword, 0, len(bot.Keywords)),
+	}
+	ret := bot.Retention
+	eb.Retention = exportRetention{
+		MessagesDays: ret.Messages,
+		RepliesDays:  ret.Replies,
+		PeersDays:    ret.Peers,
+	}
+	if !bot.DeletedAt.IsZero() {
+		da := bot.DeletedAt
+		eb.DeletedAt = &da
+	}
+	for _, kw := range bot.Keywords {
+		media := ""
+		if kw.Media != nil {
+			media = kw.Media.Kind.Name()
+		}
+		var buttons []exportButton
+		for _, btn := range kw.Buttons {
+			buttons = append(buttons, exportButton(btn))
+		}
+
+		eb.Keywords = append(eb.Keywords, exportKeyword{
+			In:         kw.In,
+			Out:        kw.Out,
+			Variants:   kw.Variants,
+			RoundRobin: kw.RoundRobin,
+			ParseMode:  kw.ParseMode.Name(),
+			NoPreview:  kw.NoPreview,
+			Media:      media,
+			Buttons:    buttons,
+			Ban:        kw.Ban,
+		})
+	}
+
+	ops, err := b.operatorRepo.GetByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return exportBot{}, fmt.Errorf("b.operatorRepo.GetByChildBotID: %w", err)
+	}
+	eb.Operators = make([]exportRole, 0, len(ops))
+	for _, op := range ops {
+		eb.Operators = append(eb.Operators, exportRole{
+			TgUserID: op.TgUserID,
+			Name:     op.Name,
+			Role:     exportRoleName(op.Role),
+		})
+	}
+
+	peers, err := b.peerRepo.GetByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return exportBot{}, fmt.Errorf("b.peerRepo.GetByChildBotID: %w", err)
+	}
+	eb.Peers = make([]exportPeer, 0, len(peers))
+	for _, p := range peers {
+		eb.Peers = append(eb.Peers, exportPeer{
+			TgUserID:    p.TgUserID,
+			Muted:       p.Muted,
+			ClaimedBy:   p.ClaimedBy,
+			Source:      p.Source,
+			Stopped:     p.Stopped,
+			StoppedAt:   timeOrNil(p.StoppedAt),
+			RestartedAt: timeOrNil(p.RestartedAt),
+			Tags:        p.Tags,
+			Note:        p.Note,
+		})
+	}
+
+	msgs, err := b.msglogRepo.GetByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return exportBot{}, fmt.Errorf("b.msglogRepo.GetByChildBotID: %w", err)
+	}
+	eb.Messages = make([]exportMessage, 0, len(msgs))
+	for _, m := range msgs {
+		eb.Messages = append(eb.Messages, exportMessage{
+			TgUserID:  m.TgUserID,
+			Author:    exportAuthorName(m.Author),
+			Text:      m.Text,
+			Rule:      m.Rule,
+			Keyword:   m.Keyword,
+			Name:      m.Name,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+
+	return eb, nil
+}
+
+func exportRoleName(r operator.Role) string {
+	if r == operator.Admin {
+		return "admin"
+	}
+	return "agent"
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func exportAuthorName(a msglog.Author) string {
+	switch a {
+	case msglog.Peer:
+		return "peer"
+	case msglog.Bot:
+		return "bot"
+	default:
+		return "operator"
+	}
+}
+
+func (b *service) handleDeleteAccount(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.DeleteAccount)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	b.reply(msg, fmt.Sprintf("Удалить аккаунт? Будут безвозвратно удалены все ваши боты, включая недавно "+
+		"удаленные, их настройки, собеседники, переписка и операторы, а также ваше участие операторами в чужих "+
+		"ботах. Сохранить копию данных можно командой %s. Напишите '%s' для подтверждения или %s для отмены",
+		exportMyData, yes, help))
+}
+
+func (b *service) onDeleteAccount(msg *tb.Message, usr user.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if strings.ToLower(strings.TrimSpace(msg.Text)) != yes {
+		err := b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+		if err != nil {
+			b.replyFatalErr(msg, err)
+			return
+		}
+
+		b.replyOK(msg, withHelp("Удаление аккаунта отменено"))
+		return
+	}
+
+	bots, err := b.childBotRepo.GetAllByUserID(ctx, usr.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	for _, bot := range bots {
+		api, e := tgbotapi.NewBotAPI(bot.Token)
+		if e != nil {
+			continue
+		}
+
+		_, e = api.RemoveWebhook()
+		if e != nil {
+			b.logger.Warn().Err(e).Send()
+		}
+	}
+
+	err = b.accountDeleter.DeleteAccount(ctx, usr)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	b.reply(msg, fmt.Sprintf("Аккаунт и все данные удалены. Чтобы снова пользоваться Вахтёром, нажмите %s",
+		start))
+}
@@ -7,11 +7,14 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/vahter-robot/backend/pkg/child_bot"
 	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
 	"github.com/vahter-robot/backend/pkg/parent_state"
 	"github.com/vahter-robot/backend/pkg/peer"
-	"github.com/vahter-robot/backend/pkg/reply"
+	"github.com/vahter-robot/backend/pkg/transfer"
 	"github.com/vahter-robot/backend/pkg/user"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	tb "gopkg.in/tucnak/telebot.v2"
 	"net"
 	"strings"
@@ -20,28 +23,65 @@ import (
 
 type service struct {
 	bot                   *tb.Bot
+	client                *mongo.Client
 	parentStateRepo       *parent_state.Repo
 	userRepo              *user.Repo
 	peerRepo              *peer.Repo
 	childBotRepo          *child_bot.Repo
-	replyRepo             *reply.Repo
 	childStateRepo        *child_state.Repo
+	transferRepo          *transfer.Repo
+	operatorRepo          *operator.Repo
+	msglogRepo            *msglog.Repo
+	accountDeleter        accountDeleter
 	childBotHost          string
 	childTokenPathPrefix  string
 	childBotsLimitPerUser uint16
+	deletedKeepDays       uint16
 	logger                zerolog.Logger
 }
 
 const (
-	start     = "/start"
-	help      = "/help"
-	createBot = "/new_bot"
-	deleteBot = "/delete_bot"
-	cleanup   = "/cleanup"
+	start      = "/start"
+	help       = "/help"
+	createBot  = "/new_bot"
+	deleteBot  = "/delete_bot"
+	cleanup    = "/cleanup"
+	listBots   = "/bots"
+	restoreBot = "/restore"
+
+	yes = "да"
+)
+
+var (
+	btnPauseBot = tb.InlineButton{
+		Unique: "pause_bot",
+		Text:   "⏸ Пауза",
+	}
+	btnResumeBot = tb.InlineButton{
+		Unique: "resume_bot",
+		Text:   "▶️ Возобновить",
+	}
+	btnChangeToken = tb.InlineButton{
+		Unique: "change_token",
+		Text:   "🔑 Сменить токен",
+	}
+	btnDeleteBot = tb.InlineButton{
+		Unique: "delete_bot",
+		Text:   "🗑 Удалить",
+	}
+	btnDeleteBotConfirm = tb.InlineButton{
+		Unique: "delete_bot_confirm",
+		Text:   "Да, удалить",
+	}
+	btnDeleteBotCancel = tb.InlineButton{
+		Unique: "delete_bot_cancel",
+		Text:   "Отмена",
+	}
 )
 
 func NewService(
 	logger zerolog.Logger,
+	client *mongo.Client,
 	parentBotHost,
 	parentBotPort,
 	parentTokenPathPrefix,
@@ -50,11 +90,15 @@ func NewService(
 	userRepo *user.Repo,
 	peerRepo *peer.Repo,
 	childBotRepo *child_bot.Repo,
-	replyRepo *reply.Repo,
 	childStateRepo *child_state.Repo,
+	transferRepo *transfer.Repo,
+	operatorRepo *operator.Repo,
+	msglogRepo *msglog.Repo,
+	accountDeleter accountDeleter,
 	childBotHost,
 	childTokenPathPrefix string,
-	childBotsLimitPerUser uint16,
+	childBotsLimitPerUser,
+	deletedKeepDays uint16,
 ) (
 	*service,
 	error,
@@ -77,15 +121,20 @@ func NewService(
 
 	return &service{
 		bot:                   b,
+		client:                client,
 		parentStateRepo:       parentStateRepo,
 		userRepo:              userRepo,
 		peerRepo:              peerRepo,
 		childBotRepo:          childBotRepo,
-		replyRepo:             replyRepo,
 		childStateRepo:        childStateRepo,
+		transferRepo:          transferRepo,
+		operatorRepo:          operatorRepo,
+		msglogRepo:            msglogRepo,
+		accountDeleter:        accountDeleter,
 		childBotHost:          childBotHost,
 		childTokenPathPrefix:  childTokenPathPrefix,
 		childBotsLimitPerUser: childBotsLimitPerUser,
+		deletedKeepDays:       deletedKeepDays,
 		logger:                logger.With().Str("package", "parent_bot").Logger(),
 	}, nil
 }
@@ -150,10 +199,17 @@ func (b *service) handleHelp(msg *tb.Message) {
 	b.reply(msg, fmt.Sprintf(`Команды
 
 %s — создать нового бота
+%s — список ботов со статистикой и управлением
 %s — вывести список ботов и удалить выбранного
+%s — восстановить недавно удаленного бота
+%s — передать бота другому пользователю
+%s — принять бота по коду передачи
+%s — выгрузить все ваши данные файлом
+%s — удалить аккаунт и все данные
 %s — выйти из любого меню и показать это сообщение
 
-Для настройки конкретного бота, используйте чат с ним`, createBot, deleteBot, help))
+Для настройки конкретного бота, используйте чат с ним`, createBot, listBots, deleteBot, restoreBot, transferBot,
+		redeemTransfer, exportMyData, deleteAccount, help))
 }
 
 func (b *service) handleDeleteBot(msg *tb.Message) {
@@ -206,6 +262,331 @@ ID /%s
 	b.replyOK(msg, text)
 }
 
+func (b *service) handleListBots(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	bots, err := b.childBotRepo.GetByUserID(ctx, usr.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	if len(bots) == 0 {
+		b.replyOK(msg, fmt.Sprintf("У вас пока нет ботов. Создайте первого: %s", createBot))
+		return
+	}
+
+	if !b.replyOK(msg, fmt.Sprintf("Ваши боты (%d/%d)", len(bots), b.childBotsLimitPerUser)) {
+		return
+	}
+
+	for _, b2 := range bots {
+		text, markup, e := b.botCard(ctx, b2)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		_, e = b.bot.Send(msg.Sender, text, markup)
+		if e != nil {
+			b.logger.Error().Err(e).Send()
+			return
+		}
+	}
+}
+
+func (b *service) botCard(ctx context.Context, bot child_bot.Bot) (string, *tb.ReplyMarkup, error) {
+	peers, err := b.peerRepo.CountByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("b.peerRepo.CountByChildBotID: %w", err)
+	}
+
+	banned, err := b.peerRepo.CountMutedByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("b.peerRepo.CountMutedByChildBotID: %w", err)
+	}
+
+	stopped, err := b.peerRepo.CountStoppedByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("b.peerRepo.CountStoppedByChildBotID: %w", err)
+	}
+
+	messages, err := b.msglogRepo.CountByAuthorSince(ctx, bot.ID, msglog.Peer, time.Now().UTC().AddDate(0, 0, -7))
+	if err != nil {
+		return "", nil, fmt.Errorf("b.msglogRepo.CountByAuthorSince: %w", err)
+	}
+
+	sources, err := b.peerRepo.CountBySource(ctx, bot.ID, 3)
+	if err != nil {
+		return "", nil, fmt.Errorf("b.peerRepo.CountBySource: %w", err)
+	}
+	topSources := "нет"
+	if len(sources) != 0 {
+		parts := make([]string, 0, len(sources))
+		for _, src := range sources {
+			parts = append(parts, fmt.Sprintf("%s — %d", src.Source, src.Count))
+		}
+		topSources = strings.Join(parts, ", ")
+	}
+
+	username := "Бот"
+	if bot.Username != "" {
+		username = "@" + bot.Username
+	}
+
+	status := "✅ работает"
+	switch {
+	case !bot.SetupDone:
+		status = "⚙️ настройка не завершена"
+	case bot.Paused:
+		status = "⏸ на паузе"
+	}
+
+	token := "✅ работает"
+	if !bot.TokenFailedAt.IsZero() {
+		token = fmt.Sprintf("⚠️ не работает с %s, смените токен", bot.TokenFailedAt.Format("02.01.2006"))
+	}
+
+	mode := "не задан"
+	switch bot.Mode {
+	case child_bot.OnlyFirst:
+		mode = "отвечать только на первое сообщение"
+	case child_bot.Always:
+		mode = "отвечать на все сообщения"
+	}
+
+	text := fmt.Sprintf(`%s
+ID %s
+
+Статус: %s
+Режим: %s
+Правил: %d
+Собеседников: %d
+Забанено: %d
+Остановили бота: %d
+Сообщений от собеседников за 7 дней: %d
+Источники: %s
+Токен: %s`,
+		username,
+		bot.ID.Hex(),
+		status,
+		mode,
+		len(bot.Keywords),
+		peers,
+		banned,
+		stopped,
+		messages,
+		topSources,
+		token,
+	)
+
+	return text, b.botMarkup(bot), nil
+}
+
+func (b *service) botMarkup(bot child_bot.Bot) *tb.ReplyMarkup {
+	id := bot.ID.Hex()
+
+	var rows [][]tb.InlineButton
+	if bot.Username != "" {
+		rows = append(rows, []tb.InlineButton{{
+			Text: "⚙️ Настройки",
+			URL:  "https://t.me/" + bot.Username,
+		}})
+	}
+
+	pause := *btnPauseBot.With(id)
+	if bot.Paused {
+		pause = *btnResumeBot.With(id)
+	}
+	rows = append(rows, []tb.InlineButton{
+		pause,
+		*btnChangeToken.With(id),
+	}, []tb.InlineButton{
+		*btnTransferBot.With(id),
+		*btnDeleteBot.With(id),
+	})
+
+	return &tb.ReplyMarkup{
+		InlineKeyboard: rows,
+	}
+}
+
+// callbackBot resolves the sender of a callback and the bot from its payload, checking ownership
+func (b *service) callbackBot(ctx context.Context, c *tb.Callback) (user.User, child_bot.Bot, bool) {
+	if c == nil || c.Sender == nil || c.Sender.ID == 0 || c.Message == nil || c.Message.Chat == nil {
+		return user.User{}, child_bot.Bot{}, false
+	}
+
+	usr, err := b.userRepo.Create(ctx, int64(c.Sender.ID), c.Message.Chat.ID)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return user.User{}, child_bot.Bot{}, false
+	}
+
+	botID, err := primitive.ObjectIDFromHex(c.Data)
+	if err != nil {
+		b.respond(c, "Некорректный ID бота")
+		return user.User{}, child_bot.Bot{}, false
+	}
+
+	bot, found, err := b.childBotRepo.GetByID(ctx, usr.ID, botID)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return user.User{}, child_bot.Bot{}, false
+	}
+	if !found {
+		b.respond(c, "Бот не найден")
+		return user.User{}, child_bot.Bot{}, false
+	}
+
+	return usr, bot, true
+}
+
+func (b *service) handlePauseBot(c *tb.Callback) {
+	b.setPaused(c, true)
+}
+
+func (b *service) handleResumeBot(c *tb.Callback) {
+	b.setPaused(c, false)
+}
+
+func (b *service) setPaused(c *tb.Callback, paused bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	usr, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	err := b.childBotRepo.SetPaused(ctx, usr.ID, bot.ID, paused)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return
+	}
+	bot.Paused = paused
+
+	b.refreshCard(ctx, c, bot)
+	if paused {
+		b.respond(c, "Бот на паузе: он не отвечает собеседникам и не пересылает сообщения")
+		return
+	}
+	b.respond(c, "Бот снова работает")
+}
+
+func (b *service) handleChangeToken(c *tb.Callback) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	err := b.parentStateRepo.SetSceneWithChildBotID(ctx, usr.ID, parent_state.ChangeToken, bot.ID)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return
+	}
+
+	b.respond(c, "")
+	_, err = b.bot.Send(c.Sender, fmt.Sprintf("Отправьте новый токен бота ID %s. Получить его можно в "+
+		"@BotFather (команда 'revoke'). Нажмите %s чтобы выйти в меню", bot.ID.Hex(), help))
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+}
+
+func (b *service) handleDeleteBotButton(c *tb.Callback) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	id := bot.ID.Hex()
+	_, err := b.bot.EditReplyMarkup(c.Message, &tb.ReplyMarkup{
+		InlineKeyboard: [][]tb.InlineButton{{
+			*btnDeleteBotConfirm.With(id),
+			*btnDeleteBotCancel.With(id),
+		}},
+	})
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+
+	b.respond(c, fmt.Sprintf("Удалить бота? Восстановить его можно будет в течение %d дн. Подтвердите "+
+		"кнопкой", b.deletedKeepDays))
+}
+
+func (b *service) handleDeleteBotConfirm(c *tb.Callback) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	err := b.deleteChildBot(ctx, usr.ID, bot)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return
+	}
+
+	_, err = b.bot.Edit(c.Message, fmt.Sprintf("Бот ID %s удален. Восстановить его можно в течение %d дн.: %s",
+		bot.ID.Hex(), b.deletedKeepDays, restoreBot))
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+	b.respond(c, "Бот удален")
+}
+
+func (b *service) handleDeleteBotCancel(c *tb.Callback) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	b.refreshCard(ctx, c, bot)
+	b.respond(c, "")
+}
+
+func (b *service) refreshCard(ctx context.Context, c *tb.Callback, bot child_bot.Bot) {
+	text, markup, err := b.botCard(ctx, bot)
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = b.bot.Edit(c.Message, text, markup)
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+}
+
 func (b *service) handleCleanup(msg *tb.Message) {
 	if !hasIDs(msg) {
 		return
@@ -229,7 +610,7 @@ func (b *service) handleCleanup(msg *tb.Message) {
 	for _, b2 := range bots {
 		_, e := tgbotapi.NewBotAPI(b2.Token)
 		if e != nil {
-			er := b.deleteChildBot(ctx, usr.ID, b2.ID)
+			er := b.deleteChildBot(ctx, usr.ID, b2)
 			if er != nil {
 				b.replyFatalErr(msg, er)
 				return
@@ -240,29 +621,86 @@ func (b *service) handleCleanup(msg *tb.Message) {
 	b.replyOK(msg, fmt.Sprintf("Боты с некорректными токенами удалены. %s", help))
 }
 
-func (b *service) deleteChildBot(ctx context.Context, userID, childBotID primitive.ObjectID) error {
-	err := b.childBotRepo.Delete(ctx, userID, childBotID)
+// deleteChildBot soft deletes the bot. Its data is kept for deletedKeepDays and removed by the purge service
+func (b *service) deleteChildBot(ctx context.Context, userID primitive.ObjectID, bot child_bot.Bot) error {
+	err := b.childBotRepo.SoftDelete(ctx, userID, bot.ID)
 	if err != nil {
-		return fmt.Errorf("b.childBotRepo.Delete: %w", err)
+		return fmt.Errorf("b.childBotRepo.SoftDelete: %w", err)
 	}
 
-	go func() {
-		bg := context.Background()
-		err = b.peerRepo.DeleteByChildBotID(bg, childBotID)
-		if err != nil {
-			b.logger.Error().Err(fmt.Errorf("b.peerRepo.DeleteByChildBotID: %w", err)).Send()
-		}
-		err = b.replyRepo.DeleteByChildBotID(bg, childBotID)
+	api, err := tgbotapi.NewBotAPI(bot.Token)
+	if err != nil {
+		return nil
+	}
+
+	_, err = api.RemoveWebhook()
+	if err != nil {
+		b.logger.Warn().Err(err).Send()
+	}
+
+	return nil
+}
+
+func (b *service) handleRestoreBot(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	bots, err := b.childBotRepo.GetDeletedByUserID(ctx, usr.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	if len(bots) == 0 {
+		err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
 		if err != nil {
-			b.logger.Error().Err(fmt.Errorf("b.replyRepo.DeleteByChildBotID: %w", err)).Send()
+			b.replyFatalErr(msg, err)
+			return
 		}
-		err = b.childStateRepo.Delete(bg, userID, childBotID)
-		if err != nil {
-			b.logger.Error().Err(fmt.Errorf("b.childStateRepo.Delete: %w", err)).Send()
+
+		b.replyOK(msg, withHelp("Удаленных ботов нет"))
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.RestoreBot)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	text := fmt.Sprintf(
+		"Удаленные боты. Кликните на ID чтобы восстановить бота. Нажмите %s чтобы выйти в меню",
+		help,
+	)
+	for _, b2 := range bots {
+		username := "токен не работает"
+		api, e := tgbotapi.NewBotAPI(b2.Token)
+		if e == nil {
+			username = "@" + api.Self.UserName
 		}
-	}()
 
-	return nil
+		text += fmt.Sprintf(`
+
+ID /%s
+%s
+Будет удален навсегда %s`,
+			b2.ID.Hex(),
+			username,
+			b2.DeletedAt.AddDate(0, 0, int(b.deletedKeepDays)).Format("02.01.2006"),
+		)
+	}
+
+	b.replyOK(msg, text)
 }
 
 func (b *service) handleOnText(msg *tb.Message) {
@@ -279,13 +717,13 @@ func (b *service) handleOnText(msg *tb.Message) {
 		return
 	}
 
-	scene, err := b.parentStateRepo.GetScene(ctx, usr.ID)
+	state, err := b.parentStateRepo.Get(ctx, usr.ID)
 	if err != nil {
 		b.replyFatalErr(msg, err)
 		return
 	}
 
-	switch scene {
+	switch state.Scene {
 	case parent_state.CreateBot:
 		const invalidBotToken = "Некорректный токен бота"
 
@@ -313,9 +751,14 @@ func (b *service) handleOnText(msg *tb.Message) {
 			return
 		}
 
-		e = b.childBotRepo.Create(ctx, usr.ID, token)
+		e = b.childBotRepo.Create(ctx, usr.ID, token, api.Self.UserName)
+		if mongo.IsDuplicateKeyError(e) {
+			b.replyErr(msg, fmt.Sprintf("Бот с таким токеном уже существует. Если вы недавно удалили его, "+
+				"восстановите через %s", restoreBot))
+			return
+		}
 		if e != nil {
-			b.replyErr(msg, "Бот с таким токеном уже существует")
+			b.replyFatalErr(msg, e)
 			return
 		}
 
@@ -341,13 +784,182 @@ func (b *service) handleOnText(msg *tb.Message) {
 			return
 		}
 
-		e = b.deleteChildBot(ctx, usr.ID, botID)
+		bot, found, e := b.childBotRepo.GetByID(ctx, usr.ID, botID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+		if !found {
+			b.replyErr(msg, "Бот не найден")
+			return
+		}
+
+		e = b.parentStateRepo.SetSceneWithChildBotID(ctx, usr.ID, parent_state.DeleteBotConfirm, bot.ID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		b.reply(msg, fmt.Sprintf("Удалить бота ID %s? Восстановить его можно будет в течение %d дн. "+
+			"командой %s. Напишите '%s' для подтверждения или %s для отмены",
+			bot.ID.Hex(), b.deletedKeepDays, restoreBot, yes, help))
+	case parent_state.DeleteBotConfirm:
+		if strings.ToLower(strings.TrimSpace(msg.Text)) != yes {
+			e := b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+			if e != nil {
+				b.replyFatalErr(msg, e)
+				return
+			}
+
+			b.replyOK(msg, withHelp("Удаление отменено"))
+			return
+		}
+
+		bot, found, e := b.childBotRepo.GetByID(ctx, usr.ID, state.ChildBotID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+		if !found {
+			b.replyErr(msg, "Бот не найден")
+			return
+		}
+
+		e = b.deleteChildBot(ctx, usr.ID, bot)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		e = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		b.replyOK(msg, withHelp(fmt.Sprintf("Бот удален. Восстановить его можно в течение %d дн.: %s",
+			b.deletedKeepDays, restoreBot)))
+	case parent_state.RestoreBot:
+		botID, e := primitive.ObjectIDFromHex(strings.Replace(msg.Text, "/", "", 1))
+		if e != nil {
+			b.replyErr(msg, "Некорректный ID бота")
+			return
+		}
+
+		count, e := b.childBotRepo.CountByUserID(ctx, usr.ID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		if count >= int64(b.childBotsLimitPerUser) {
+			b.replyErr(msg, fmt.Sprintf("Максимальное количество ботов — %d, чтобы восстановить бота "+
+				"удалите одного из текущих %s", b.childBotsLimitPerUser, deleteBot))
+			return
+		}
+
+		restored, e := b.childBotRepo.Restore(ctx, usr.ID, botID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+		if !restored {
+			b.replyErr(msg, "Бот не найден среди удаленных")
+			return
+		}
+
+		e = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
 		if e != nil {
 			b.replyFatalErr(msg, e)
 			return
 		}
 
-		b.replyOK(msg, withHelp("Бот удален"))
+		bot, found, e := b.childBotRepo.Primary().GetByID(ctx, usr.ID, botID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+		if !found {
+			b.replyErr(msg, "Бот не найден")
+			return
+		}
+
+		api, e := tgbotapi.NewBotAPI(bot.Token)
+		if e != nil {
+			b.replyOK(msg, withHelp(fmt.Sprintf("Бот восстановлен, но его токен не работает. Смените токен "+
+				"в %s", listBots)))
+			return
+		}
+
+		_, e = api.SetWebhook(tgbotapi.NewWebhook(fmt.Sprintf(
+			"%s/%s/%s", b.childBotHost, b.childTokenPathPrefix, bot.Token,
+		)))
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		e = b.childBotRepo.SetUsername(ctx, bot.ID, api.Self.UserName)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		b.replyOK(msg, withHelp("Бот восстановлен вместе с собеседниками и настройками: @"+api.Self.UserName))
+	case parent_state.ChangeToken:
+		bot, found, e := b.childBotRepo.GetByID(ctx, usr.ID, state.ChildBotID)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+		if !found {
+			b.replyErr(msg, "Бот не найден")
+			return
+		}
+
+		token := msg.Text
+		if tokenBotID(token) != tokenBotID(bot.Token) {
+			b.replyErr(msg, "Токен принадлежит другому боту. Отправьте новый токен этого же бота")
+			return
+		}
+
+		api, e := tgbotapi.NewBotAPI(token)
+		if e != nil {
+			b.replyErr(msg, "Некорректный токен бота")
+			return
+		}
+
+		e = b.childBotRepo.SetToken(ctx, usr.ID, bot.ID, token, api.Self.UserName)
+		if mongo.IsDuplicateKeyError(e) {
+			b.replyErr(msg, "Бот с таким токеном уже существует")
+			return
+		}
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		_, e = api.SetWebhook(tgbotapi.NewWebhook(fmt.Sprintf(
+			"%s/%s/%s", b.childBotHost, b.childTokenPathPrefix, token,
+		)))
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		e = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+		if e != nil {
+			b.replyFatalErr(msg, e)
+			return
+		}
+
+		b.replyOK(msg, withHelp("Токен изменен, бот @"+api.Self.UserName+" снова на связи"))
+	case parent_state.TransferBot:
+		b.onTransferBot(ctx, msg, usr)
+	case parent_state.RedeemTransfer:
+		b.onRedeemTransfer(ctx, msg, usr)
+	case parent_state.DeleteAccount:
+		b.onDeleteAccount(msg, usr)
 	default:
 		b.replyErr(msg, "Неизвестная команда")
 		return
@@ -360,6 +972,19 @@ func (b *service) initHandlers() {
 	b.bot.Handle(createBot, b.handleCreateBot)
 	b.bot.Handle(deleteBot, b.handleDeleteBot)
 	b.bot.Handle(cleanup, b.handleCleanup)
+	b.bot.Handle(restoreBot, b.handleRestoreBot)
+	b.bot.Handle(transferBot, b.handleTransferBot)
+	b.bot.Handle(redeemTransfer, b.handleRedeemTransfer)
+	b.bot.Handle(&btnTransferBot, b.handleTransferBotButton)
+	b.bot.Handle(listBots, b.handleListBots)
+	b.bot.Handle(exportMyData, b.handleExportMyData)
+	b.bot.Handle(deleteAccount, b.handleDeleteAccount)
+	b.bot.Handle(&btnPauseBot, b.handlePauseBot)
+	b.bot.Handle(&btnResumeBot, b.handleResumeBot)
+	b.bot.Handle(&btnChangeToken, b.handleChangeToken)
+	b.bot.Handle(&btnDeleteBot, b.handleDeleteBotButton)
+	b.bot.Handle(&btnDeleteBotConfirm, b.handleDeleteBotConfirm)
+	b.bot.Handle(&btnDeleteBotCancel, b.handleDeleteBotCancel)
 	b.bot.Handle(tb.OnText, b.handleOnText)
 }
 
@@ -396,10 +1021,29 @@ func (b *service) replyFatalErr(msg *tb.Message, err error) bool {
 	))
 }
 
+func (b *service) respond(c *tb.Callback, text string) {
+	err := b.bot.Respond(c, &tb.CallbackResponse{
+		Text: text,
+	})
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+}
+
+func (b *service) respondFatalErr(c *tb.Callback, err error) {
+	b.logger.Error().Err(err).Send()
+	b.respond(c, "Произошла ошибка, мы уже знаем о ней и работаем над исправлением")
+}
+
 func hasIDs(msg *tb.Message) bool {
 	return msg != nil && msg.Sender != nil && msg.Sender.ID != 0 && msg.Chat != nil && msg.Chat.ID != 0
 }
 
+// tokenBotID returns the bot ID part of a token, which does not change on revoke
+func tokenBotID(token string) string {
+	return strings.SplitN(token, ":", 2)[0]
+}
+
 func withHelp(str string) string {
 	return str + "\n" + help
 }
@@ -0,0 +1,294 @@
+package parent_bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/vahter-robot/backend/pkg/child_bot"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"github.com/vahter-robot/backend/pkg/parent_state"
+	"github.com/vahter-robot/backend/pkg/random"
+	"github.com/vahter-robot/backend/pkg/transfer"
+	"github.com/vahter-robot/backend/pkg/user"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"strings"
+	"time"
+)
+
+const (
+	transferBot    = "/transfer"
+	redeemTransfer = "/redeem"
+
+	transferCodeTTL = 24 * time.Hour
+	transferCodeLen = 8
+)
+
+var btnTransferBot = tb.InlineButton{
+	Unique: "transfer_bot",
+	Text:   "🤝 Передать",
+}
+
+func (b *service) handleTransferBot(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	bots, err := b.childBotRepo.GetByUserID(ctx, usr.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	if len(bots) == 0 {
+		b.replyOK(msg, withHelp("У вас нет ботов для передачи"))
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.TransferBot)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	text := fmt.Sprintf("Кликните на ID бота, который хотите передать другому пользователю Вахтёра. Нажмите %s "+
+		"чтобы выйти в меню", help)
+	for _, b2 := range bots {
+		username := "токен не работает"
+		api, e := tgbotapi.NewBotAPI(b2.Token)
+		if e == nil {
+			username = "@" + api.Self.UserName
+		}
+
+		text += fmt.Sprintf(`
+
+ID /%s
+%s`, b2.ID.Hex(), username)
+	}
+
+	b.replyOK(msg, text)
+}
+
+func (b *service) onTransferBot(ctx context.Context, msg *tb.Message, usr user.User) {
+	botID, err := primitive.ObjectIDFromHex(strings.Replace(msg.Text, "/", "", 1))
+	if err != nil {
+		b.replyErr(msg, "Некорректный ID бота")
+		return
+	}
+
+	bot, found, err := b.childBotRepo.GetByID(ctx, usr.ID, botID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+	if !found {
+		b.replyErr(msg, "Бот не найден")
+		return
+	}
+
+	text, err := b.createTransfer(ctx, usr, bot)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	b.replyOK(msg, text)
+}
+
+func (b *service) handleTransferBotButton(c *tb.Callback) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, bot, ok := b.callbackBot(ctx, c)
+	if !ok {
+		return
+	}
+
+	text, err := b.createTransfer(ctx, usr, bot)
+	if err != nil {
+		b.respondFatalErr(c, err)
+		return
+	}
+
+	b.respond(c, "")
+	_, err = b.bot.Send(c.Sender, text)
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+}
+
+func (b *service) createTransfer(ctx context.Context, usr user.User, bot child_bot.Bot) (string, error) {
+	code, err := random.Code(transferCodeLen)
+	if err != nil {
+		return "", fmt.Errorf("random.Code: %w", err)
+	}
+
+	err = b.transferRepo.Create(ctx, usr.ID, bot.ID, code, time.Now().UTC().Add(transferCodeTTL))
+	if err != nil {
+		return "", fmt.Errorf("b.transferRepo.Create: %w", err)
+	}
+
+	return fmt.Sprintf(`Код передачи бота ID %s:
+
+%s
+
+Код одноразовый и действует %d ч., новый код отменяет предыдущий. Получатель должен отправить его @%s после команды %s. После передачи бот со всеми собеседниками и настройками перейдет получателю, а вы потеряете к нему доступ`,
+		bot.ID.Hex(),
+		code,
+		int(transferCodeTTL.Hours()),
+		b.bot.Me.Username,
+		redeemTransfer,
+	), nil
+}
+
+func (b *service) handleRedeemTransfer(msg *tb.Message) {
+	if !hasIDs(msg) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	usr, err := b.userRepo.Create(ctx, int64(msg.Sender.ID), msg.Chat.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.RedeemTransfer)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	b.reply(msg, fmt.Sprintf("Отправьте код передачи бота, который вы получили от его владельца. Нажмите %s "+
+		"чтобы выйти в меню", help))
+}
+
+var (
+	errBotGone  = errors.New("bot is gone")
+	errCodeGone = errors.New("code is gone")
+)
+
+// redeemTransfer moves the bot to the user and consumes the code after the move succeeded
+func (b *service) redeemTransfer(ctx context.Context, t transfer.Transfer, usr user.User) error {
+	ok, err := b.childBotRepo.SetOwner(ctx, t.UserID, t.ChildBotID, usr.ID, usr.TgChatID)
+	if err != nil {
+		return fmt.Errorf("b.childBotRepo.SetOwner: %w", err)
+	}
+	if !ok {
+		return errBotGone
+	}
+
+	err = b.childStateRepo.SetUserID(ctx, t.UserID, usr.ID, t.ChildBotID)
+	if err != nil {
+		return fmt.Errorf("b.childStateRepo.SetUserID: %w", err)
+	}
+
+	ok, err = b.transferRepo.DeleteByCode(ctx, t.Code)
+	if err != nil {
+		return fmt.Errorf("b.transferRepo.DeleteByCode: %w", err)
+	}
+	if !ok {
+		return errCodeGone
+	}
+
+	return nil
+}
+
+func (b *service) onRedeemTransfer(ctx context.Context, msg *tb.Message, usr user.User) {
+	const invalidCode = "Код не найден или истек. Попросите владельца бота создать новый"
+
+	code := strings.ToUpper(strings.TrimSpace(msg.Text))
+	t, found, err := b.transferRepo.GetByCode(ctx, code)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+	if !found {
+		b.replyErr(msg, invalidCode)
+		return
+	}
+
+	if t.UserID == usr.ID {
+		b.replyErr(msg, "Этот бот уже ваш. Код нужно отправить получателю")
+		return
+	}
+
+	count, err := b.childBotRepo.CountByUserID(ctx, usr.ID)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	if count >= int64(b.childBotsLimitPerUser) {
+		b.replyErr(msg, fmt.Sprintf("Максимальное количество ботов — %d, чтобы принять бота удалите одного "+
+			"из текущих %s", b.childBotsLimitPerUser, deleteBot))
+		return
+	}
+
+	err = m.WithTransaction(ctx, b.client, func(tc context.Context) error {
+		return b.redeemTransfer(tc, t, usr)
+	})
+	if errors.Is(err, errBotGone) {
+		b.replyErr(msg, "Бот больше недоступен для передачи")
+		return
+	}
+	if errors.Is(err, errCodeGone) {
+		b.replyErr(msg, invalidCode)
+		return
+	}
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	err = b.parentStateRepo.SetScene(ctx, usr.ID, parent_state.None)
+	if err != nil {
+		b.replyFatalErr(msg, err)
+		return
+	}
+
+	username := "ID " + t.ChildBotID.Hex()
+	bot, found, err := b.childBotRepo.Primary().GetByID(ctx, usr.ID, t.ChildBotID)
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+	if found {
+		api, e := tgbotapi.NewBotAPI(bot.Token)
+		if e == nil {
+			username = "@" + api.Self.UserName
+		}
+	}
+
+	b.replyOK(msg, withHelp(fmt.Sprintf("Бот %s теперь ваш. Напишите ему %s, чтобы получать пересланные "+
+		"сообщения собеседников", username, start)))
+
+	prev, err := b.userRepo.GetByID(ctx, t.UserID)
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = b.bot.Send(tb.ChatID(prev.TgChatID), fmt.Sprintf("Бот %s передан другому пользователю. У вас "+
+		"больше нет доступа к нему", username))
+	if err != nil {
+		b.logger.Error().Err(err).Send()
+	}
+}
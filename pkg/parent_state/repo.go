@@ -12,17 +12,24 @@ import (
 )
 
 type State struct {
-	ID     primitive.ObjectID `bson:"_id,omitempty"`
-	UserID primitive.ObjectID `bson:"ui,omitempty"`
-	Scene  Scene              `bson:"s,omitempty"`
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `bson:"ui,omitempty"`
+	Scene      Scene              `bson:"s,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
 }
 
 type Scene uint32
 
 const (
-	None      Scene = 1
-	CreateBot Scene = 2
-	DeleteBot Scene = 3
+	None             Scene = 1
+	CreateBot        Scene = 2
+	DeleteBot        Scene = 3
+	ChangeToken      Scene = 4
+	DeleteBotConfirm Scene = 5
+	RestoreBot       Scene = 6
+	TransferBot      Scene = 7
+	RedeemTransfer   Scene = 8
+	DeleteAccount    Scene = 9
 )
 
 type Repo struct {
@@ -66,6 +73,9 @@ func (r *Repo) SetScene(c context.Context, userID primitive.ObjectID, sc Scene)
 		"$set": bson.M{
 			"s": sc,
 		},
+		"$unset": bson.M{
+			"cbi": "",
+		},
 	}, options.Update().SetUpsert(true))
 	if err != nil {
 		return fmt.Errorf("r.coll.UpdateOne: %w", err)
@@ -91,3 +101,54 @@ func (r *Repo) GetScene(c context.Context, userID primitive.ObjectID) (Scene, er
 
 	return st.Scene, nil
 }
+
+func (r *Repo) SetSceneWithChildBotID(c context.Context, userID primitive.ObjectID, sc Scene, childBotID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"ui": userID,
+	}, bson.M{
+		"$set": bson.M{
+			"s":   sc,
+			"cbi": childBotID,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Get(c context.Context, userID primitive.ObjectID) (State, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var st State
+	err := r.coll.FindOne(ctx, bson.M{
+		"ui": userID,
+	}).Decode(&st)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return State{
+				UserID: userID,
+				Scene:  None,
+			}, nil
+		}
+		return State{}, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return st, nil
+}
+
+func (r *Repo) DeleteByUserID(c context.Context, userID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"ui": userID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
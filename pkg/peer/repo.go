@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,20 +13,49 @@ import (
 )
 
 type Peer struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID    primitive.ObjectID `bson:"cbi,omitempty"`
+	TgUserID      int64              `bson:"tui,omitempty"`
+	TgChatID      int64              `bson:"tci,omitempty"`
+	Muted         bool               `bson:"m,omitempty"`
+	ClaimedBy     int64              `bson:"cb,omitempty"`
+	ClaimedByName string             `bson:"cbn,omitempty"`
+	TopicID       int64              `bson:"ti,omitempty"`
+	FreeText      bool               `bson:"ft,omitempty"`
+	Source        string             `bson:"src,omitempty"`
+	Stopped       bool               `bson:"st,omitempty"`
+	StoppedAt     time.Time          `bson:"sa,omitempty"`
+	RestartedAt   time.Time          `bson:"ra,omitempty"`
+	LastActiveAt  time.Time          `bson:"la,omitempty"`
+	Tags          []string           `bson:"tg,omitempty"`
+	Note          string             `bson:"nt,omitempty"`
+	ExpireAt      time.Time          `bson:"ea,omitempty"`
+}
+
+// SourceCount is the number of peers which came by a deep link
+type SourceCount struct {
+	Source string `bson:"_id"`
+	Count  int64  `bson:"n"`
+}
+
+// pendingSource is the deep link source of a user who has not written yet, it moves to the peer on the first
+// message, so users who only opened a link are not counted as peers
+type pendingSource struct {
 	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
 	TgUserID   int64              `bson:"tui,omitempty"`
-	TgChatID   int64              `bson:"tci,omitempty"`
-	Muted      bool               `bson:"m,omitempty"`
+	Source     string             `bson:"src,omitempty"`
+	ExpireAt   time.Time          `bson:"ea,omitempty"`
 }
 
 type Repo struct {
-	coll *mongo.Collection
+	coll    *mongo.Collection
+	sources *mongo.Collection
 }
 
 func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
 	r := &Repo{
-		coll: db.Collection("peers"),
+		coll:    db.Collection("peers"),
+		sources: db.Collection("peer_sources"),
 	}
 
 	err := r.createIndex(ctx)
@@ -50,26 +80,86 @@ func (r *Repo) createIndex(ctx context.Context) error {
 		Keys: bson.M{
 			"cbi": 1,
 		},
+	}, {
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "ti",
+			Value: 1,
+		}},
+		Options: options.Index().SetSparse(true),
+	}, {
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "tg",
+			Value: 1,
+		}},
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
 	}})
 	if err != nil {
 		return fmt.Errorf("r.coll.Indexes().CreateOne: %w", err)
 	}
 
+	_, err = r.sources.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{{
+			Key:   "tui",
+			Value: 1,
+		}, {
+			Key:   "cbi",
+			Value: 1,
+		}},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.M{
+			"cbi": 1,
+		},
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.sources.Indexes().CreateMany: %w", err)
+	}
+
 	return nil
 }
 
-func (r *Repo) Create(c context.Context, childBotID primitive.ObjectID, tgUserID, tgChatID int64) error {
+// Create creates the peer or prolongs its retention. Muted peers never expire, so bans are kept
+func (r *Repo) Create(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	tgChatID int64,
+	expireAt time.Time,
+) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
 	_, err := r.coll.UpdateOne(ctx, bson.M{
 		"cbi": childBotID,
 		"tui": tgUserID,
+		"m": bson.M{
+			"$ne": true,
+		},
 	}, bson.M{
 		"$set": bson.M{
 			"tci": tgChatID,
+			"ea":  expireAt,
+			"la":  time.Now().UTC(),
 		},
 	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("r.coll.UpdateOne: %w", err)
 	}
@@ -89,6 +179,9 @@ func (r *Repo) CreateMuted(c context.Context, childBotID primitive.ObjectID, tgU
 			"tci": tgChatID,
 			"m":   true,
 		},
+		"$unset": bson.M{
+			"ea": "",
+		},
 	}, options.Update().SetUpsert(true))
 	if err != nil {
 		return fmt.Errorf("r.coll.UpdateOne: %w", err)
@@ -97,7 +190,13 @@ func (r *Repo) CreateMuted(c context.Context, childBotID primitive.ObjectID, tgU
 	return nil
 }
 
-func (r *Repo) CreateUnMuted(c context.Context, childBotID primitive.ObjectID, tgUserID, tgChatID int64) error {
+func (r *Repo) CreateUnMuted(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	tgChatID int64,
+	expireAt time.Time,
+) error {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
@@ -107,6 +206,7 @@ func (r *Repo) CreateUnMuted(c context.Context, childBotID primitive.ObjectID, t
 	}, bson.M{
 		"$set": bson.M{
 			"tci": tgChatID,
+			"ea":  expireAt,
 		},
 		"$unset": bson.M{
 			"m": "",
@@ -119,6 +219,601 @@ func (r *Repo) CreateUnMuted(c context.Context, childBotID primitive.ObjectID, t
 	return nil
 }
 
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+// Claim assigns the peer to the operator. Unless force is set, a peer claimed by another operator is kept
+// and false is returned
+func (r *Repo) Claim(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	operatorTgUserID int64,
+	operatorName string,
+	force bool,
+) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}
+	if !force {
+		filter["$or"] = bson.A{bson.M{
+			"cb": bson.M{
+				"$exists": false,
+			},
+		}, bson.M{
+			"cb": operatorTgUserID,
+		}}
+	}
+
+	ur, err := r.coll.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{
+			"cb":  operatorTgUserID,
+			"cbn": operatorName,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.MatchedCount != 0, nil
+}
+
+func (r *Repo) Unclaim(c context.Context, childBotID primitive.ObjectID, tgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$unset": bson.M{
+			"cb":  "",
+			"cbn": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// UnclaimByOperator releases all peers of the bot claimed by the operator
+func (r *Repo) UnclaimByOperator(c context.Context, childBotID primitive.ObjectID, operatorTgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateMany(ctx, bson.M{
+		"cbi": childBotID,
+		"cb":  operatorTgUserID,
+	}, bson.M{
+		"$unset": bson.M{
+			"cb":  "",
+			"cbn": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return nil
+}
+
+// UnclaimAllByOperator releases peers claimed by the operator in every bot
+func (r *Repo) UnclaimAllByOperator(c context.Context, operatorTgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	_, err := r.coll.UpdateMany(ctx, bson.M{
+		"cb": operatorTgUserID,
+	}, bson.M{
+		"$unset": bson.M{
+			"cb":  "",
+			"cbn": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return nil
+}
+
+// SetFreeText marks that the next message of the peer is forwarded as is, without rules
+func (r *Repo) SetFreeText(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	tgChatID int64,
+	expireAt time.Time,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+		"m": bson.M{
+			"$ne": true,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"tci": tgChatID,
+			"ea":  expireAt,
+			"ft":  true,
+		},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetSource sets the deep link source of the peer unless it already has one
+func (r *Repo) SetSource(c context.Context, childBotID primitive.ObjectID, tgUserID int64, source string) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+		"src": bson.M{
+			"$exists": false,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"src": source,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetPendingSource keeps the deep link source of a user who has not written yet, the first link wins
+func (r *Repo) SetPendingSource(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID int64,
+	source string,
+	expireAt time.Time,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.sources.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$setOnInsert": bson.M{
+			"src": source,
+			"ea":  expireAt,
+		},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("r.sources.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// TakePendingSource removes and returns the pending source of the user
+func (r *Repo) TakePendingSource(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID int64,
+) (
+	string,
+	bool,
+	error,
+) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var ps pendingSource
+	err := r.sources.FindOneAndDelete(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}).Decode(&ps)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", false, nil
+		}
+
+		return "", false, fmt.Errorf("r.sources.FindOneAndDelete: %w", err)
+	}
+
+	return ps.Source, true, nil
+}
+
+// GetAudience returns peers who can receive a broadcast: not banned, not stopped, who wrote at least once. The
+// source, tag and activity filters are skipped when empty
+func (r *Repo) GetAudience(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	source,
+	tag string,
+	activeSince time.Time,
+) ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	filter := bson.M{
+		"cbi": childBotID,
+		"tci": bson.M{
+			"$exists": true,
+		},
+		"m": bson.M{
+			"$ne": true,
+		},
+		"st": bson.M{
+			"$ne": true,
+		},
+	}
+	if source != "" {
+		filter["src"] = source
+	}
+	if tag != "" {
+		filter["tg"] = tag
+	}
+	if !activeSince.IsZero() {
+		// peers stored before the last activity was tracked are taken as active since they were created
+		filter["$or"] = bson.A{bson.M{
+			"la": bson.M{
+				"$gte": activeSince,
+			},
+		}, bson.M{
+			"la": bson.M{
+				"$exists": false,
+			},
+			"_id": bson.M{
+				"$gte": primitive.NewObjectIDFromTimestamp(activeSince),
+			},
+		}}
+	}
+
+	cur, err := r.coll.Find(ctx, filter, options.Find().SetProjection(bson.M{
+		"tui": 1,
+		"tci": 1,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Peer
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// AddTag adds the tag to the peer. It returns false if there is no such peer
+func (r *Repo) AddTag(c context.Context, childBotID primitive.ObjectID, tgUserID int64, tag string) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	ur, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$addToSet": bson.M{
+			"tg": tag,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return ur.MatchedCount != 0, nil
+}
+
+func (r *Repo) RemoveTag(c context.Context, childBotID primitive.ObjectID, tgUserID int64, tag string) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$pull": bson.M{
+			"tg": tag,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// SetNote sets the note of the peer, an empty note removes it
+func (r *Repo) SetNote(c context.Context, childBotID primitive.ObjectID, tgUserID int64, note string) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	upd := bson.M{
+		"$set": bson.M{
+			"nt": note,
+		},
+	}
+	if note == "" {
+		upd = bson.M{
+			"$unset": bson.M{
+				"nt": "",
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetTags returns all tags used by peers of the bot
+func (r *Repo) GetTags(c context.Context, childBotID primitive.ObjectID) ([]string, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	raw, err := r.coll.Distinct(ctx, "tg", bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Distinct: %w", err)
+	}
+
+	res := make([]string, 0, len(raw))
+	for _, item := range raw {
+		tag, ok := item.(string)
+		if ok {
+			res = append(res, tag)
+		}
+	}
+
+	return res, nil
+}
+
+// List returns peers who wrote to the bot, recently active first. The tag filter is skipped when empty
+func (r *Repo) List(c context.Context, childBotID primitive.ObjectID, tag string, limit int64) ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"cbi": childBotID,
+		"tci": bson.M{
+			"$exists": true,
+		},
+	}
+	if tag != "" {
+		filter["tg"] = tag
+	}
+
+	cur, err := r.coll.Find(ctx, filter, options.Find().SetSort(bson.M{"la": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Peer
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// SetStopped marks the peer who blocked the bot, or unmarks one who started it again. Peers who never wrote are
+// not tracked
+func (r *Repo) SetStopped(c context.Context, childBotID primitive.ObjectID, tgUserID int64, stopped bool) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}
+	upd := bson.M{
+		"$set": bson.M{
+			"st": true,
+			"sa": time.Now().UTC(),
+		},
+	}
+	if !stopped {
+		// the first start also comes as a member update, only a peer who stopped the bot is restarted
+		filter["st"] = true
+		upd = bson.M{
+			"$set": bson.M{
+				"ra": time.Now().UTC(),
+			},
+			"$unset": bson.M{
+				"st": "",
+			},
+		}
+	}
+
+	_, err := r.coll.UpdateOne(ctx, filter, upd)
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// CountBySource counts peers by deep link payloads, most frequent first
+func (r *Repo) CountBySource(c context.Context, childBotID primitive.ObjectID, limit int64) ([]SourceCount, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Aggregate(ctx, mongo.Pipeline{{{
+		Key: "$match",
+		Value: bson.M{
+			"cbi": childBotID,
+			"src": bson.M{
+				"$exists": true,
+			},
+		},
+	}}, {{
+		Key: "$group",
+		Value: bson.M{
+			"_id": "$src",
+			"n": bson.M{
+				"$sum": 1,
+			},
+		},
+	}}, {{
+		Key: "$sort",
+		Value: bson.D{{
+			Key:   "n",
+			Value: -1,
+		}, {
+			Key:   "_id",
+			Value: 1,
+		}},
+	}}, {{
+		Key:   "$limit",
+		Value: limit,
+	}}})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Aggregate: %w", err)
+	}
+
+	var res []SourceCount
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *Repo) UnsetFreeText(c context.Context, childBotID primitive.ObjectID, tgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$unset": bson.M{
+			"ft": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) SetTopicID(c context.Context, childBotID primitive.ObjectID, tgUserID, topicID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	}, bson.M{
+		"$set": bson.M{
+			"ti": topicID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// UnsetTopicIDs forgets peer topics, e.g. when another forum is attached
+func (r *Repo) UnsetTopicIDs(c context.Context, childBotID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	_, err := r.coll.UpdateMany(ctx, bson.M{
+		"cbi": childBotID,
+		"ti": bson.M{
+			"$exists": true,
+		},
+	}, bson.M{
+		"$unset": bson.M{
+			"ti": "",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetByTopicID(c context.Context, childBotID primitive.ObjectID, topicID int64) (Peer, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var p Peer
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+		"ti":  topicID,
+	}).Decode(&p)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Peer{}, false, nil
+		}
+
+		return Peer{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return p, true, nil
+}
+
+// GetSourceChildBotIDs returns bots referenced by pending deep link sources
+func (r *Repo) GetSourceChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.sources)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteSourcesByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.sources.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.sources.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
 func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
 	_, err := r.coll.DeleteMany(c, bson.M{
 		"cbi": childBotID,
@@ -127,9 +822,60 @@ func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.Object
 		return fmt.Errorf("r.coll.DeleteMany: %w", err)
 	}
 
+	_, err = r.sources.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.sources.DeleteMany: %w", err)
+	}
+
 	return nil
 }
 
+func (r *Repo) CountByChildBotID(c context.Context, childBotID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
+	}
+
+	return count, nil
+}
+
+func (r *Repo) CountStoppedByChildBotID(c context.Context, childBotID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{
+		"cbi": childBotID,
+		"st":  true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
+	}
+
+	return count, nil
+}
+
+func (r *Repo) CountMutedByChildBotID(c context.Context, childBotID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{
+		"cbi": childBotID,
+		"m":   true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
+	}
+
+	return count, nil
+}
+
 func (r *Repo) Get(c context.Context, childBotID primitive.ObjectID, tgUserID int64) (Peer, bool, error) {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
@@ -151,3 +897,91 @@ func (r *Repo) Get(c context.Context, childBotID primitive.ObjectID, tgUserID in
 
 	return p, true, nil
 }
+
+// Delete removes the peer. Of a muted peer only the ban is kept, so it survives erasure. It returns false for
+// muted peers
+func (r *Repo) Delete(c context.Context, childBotID primitive.ObjectID, tgUserID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	dr, err := r.coll.DeleteOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+		"m": bson.M{
+			"$ne": true,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.DeleteOne: %w", err)
+	}
+
+	if dr.DeletedCount == 0 {
+		_, err = r.coll.ReplaceOne(ctx, bson.M{
+			"cbi": childBotID,
+			"tui": tgUserID,
+			"m":   true,
+		}, Peer{
+			ChildBotID: childBotID,
+			TgUserID:   tgUserID,
+			Muted:      true,
+		})
+		if err != nil {
+			return false, fmt.Errorf("r.coll.ReplaceOne: %w", err)
+		}
+	}
+
+	_, err = r.sources.DeleteOne(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.sources.DeleteOne: %w", err)
+	}
+
+	return dr.DeletedCount != 0, nil
+}
+
+func (r *Repo) GetByChildBotID(c context.Context, childBotID primitive.ObjectID) ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Peer
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// BackfillExpireAt sets expiry on documents of the bot stored without it, banned peers are kept forever
+func (r *Repo) BackfillExpireAt(c context.Context, childBotID primitive.ObjectID, expireAt time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	ur, err := r.coll.UpdateMany(ctx, bson.M{
+		"cbi": childBotID,
+		"ea": bson.M{
+			"$exists": false,
+		},
+		"m": bson.M{
+			"$ne": true,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"ea": expireAt,
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return ur.ModifiedCount, nil
+}
@@ -0,0 +1,392 @@
+package purge
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/vahter-robot/backend/pkg/broadcast"
+	"github.com/vahter-robot/backend/pkg/child_bot"
+	"github.com/vahter-robot/backend/pkg/child_state"
+	"github.com/vahter-robot/backend/pkg/invite"
+	"github.com/vahter-robot/backend/pkg/leader"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"github.com/vahter-robot/backend/pkg/msglog"
+	"github.com/vahter-robot/backend/pkg/operator"
+	"github.com/vahter-robot/backend/pkg/parent_state"
+	"github.com/vahter-robot/backend/pkg/peer"
+	"github.com/vahter-robot/backend/pkg/reply"
+	"github.com/vahter-robot/backend/pkg/scheduled"
+	"github.com/vahter-robot/backend/pkg/transfer"
+	"github.com/vahter-robot/backend/pkg/user"
+	"github.com/vahter-robot/backend/pkg/version"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+type service struct {
+	client          *mongo.Client
+	userRepo        *user.Repo
+	parentStateRepo *parent_state.Repo
+	childBotRepo    *child_bot.Repo
+	peerRepo        *peer.Repo
+	replyRepo       *reply.Repo
+	childStateRepo  *child_state.Repo
+	operatorRepo    *operator.Repo
+	msglogRepo      *msglog.Repo
+	versionRepo     *version.Repo
+	inviteRepo      *invite.Repo
+	transferRepo    *transfer.Repo
+	broadcastRepo   *broadcast.Repo
+	scheduledRepo   *scheduled.Repo
+	leaderRepo      *leader.Repo
+	instanceID      string
+	keep            time.Duration
+	logger          zerolog.Logger
+}
+
+const (
+	interval          = time.Hour
+	reconcileInterval = 24 * time.Hour
+	batchSize         = 100
+	attempts          = 3
+	leaderTask        = "purge"
+	// leaderLease outlasts the interval, so the leader keeps the lease between ticks
+	leaderLease = 2 * interval
+)
+
+func NewService(
+	logger zerolog.Logger,
+	client *mongo.Client,
+	userRepo *user.Repo,
+	parentStateRepo *parent_state.Repo,
+	childBotRepo *child_bot.Repo,
+	peerRepo *peer.Repo,
+	replyRepo *reply.Repo,
+	childStateRepo *child_state.Repo,
+	operatorRepo *operator.Repo,
+	msglogRepo *msglog.Repo,
+	versionRepo *version.Repo,
+	inviteRepo *invite.Repo,
+	transferRepo *transfer.Repo,
+	broadcastRepo *broadcast.Repo,
+	scheduledRepo *scheduled.Repo,
+	leaderRepo *leader.Repo,
+	deletedKeepDays uint16,
+) *service {
+	return &service{
+		client:          client,
+		userRepo:        userRepo,
+		parentStateRepo: parentStateRepo,
+		childBotRepo:    childBotRepo,
+		peerRepo:        peerRepo,
+		replyRepo:       replyRepo,
+		childStateRepo:  childStateRepo,
+		operatorRepo:    operatorRepo,
+		msglogRepo:      msglogRepo,
+		versionRepo:     versionRepo,
+		inviteRepo:      inviteRepo,
+		transferRepo:    transferRepo,
+		broadcastRepo:   broadcastRepo,
+		scheduledRepo:   scheduledRepo,
+		leaderRepo:      leaderRepo,
+		instanceID:      primitive.NewObjectID().Hex(),
+		keep:            time.Duration(deletedKeepDays) * 24 * time.Hour,
+		logger:          logger.With().Str("package", "purge").Logger(),
+	}
+}
+
+// Serve periodically removes soft deleted bots whose keep period is over, together with their data,
+// and data left from bots which no longer exist. Only the elected instance runs it
+func (s *service) Serve(ctx context.Context) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+
+	if s.lead(ctx) {
+		s.purge(ctx)
+		s.reconcile(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.lead(ctx) {
+				s.purge(ctx)
+			}
+		case <-reconcileTicker.C:
+			if s.lead(ctx) {
+				s.reconcile(ctx)
+			}
+		}
+	}
+}
+
+func (s *service) lead(ctx context.Context) bool {
+	ok, err := s.leaderRepo.Acquire(ctx, leaderTask, s.instanceID, leaderLease)
+	if err != nil {
+		s.logger.Error().Err(err).Send()
+		return false
+	}
+	return ok
+}
+
+func (s *service) purge(ctx context.Context) {
+	for {
+		bots, err := s.childBotRepo.GetDeletedBefore(ctx, time.Now().UTC().Add(-s.keep), batchSize)
+		if err != nil {
+			s.logger.Error().Err(err).Send()
+			return
+		}
+
+		var failed int
+		for _, bot := range bots {
+			err = retry(ctx, func() error {
+				return s.cascade(ctx, bot)
+			})
+			if err != nil {
+				failed += 1
+				s.logger.Error().Err(err).Str("childBotID", bot.ID.Hex()).Send()
+			}
+		}
+
+		// failed bots stay in place and are picked up again on the next tick
+		if len(bots) < batchSize || failed == len(bots) {
+			return
+		}
+	}
+}
+
+// DeleteAccount erases the user with all bots, including soft deleted ones, and everything referencing them.
+// The user document is deleted last, so a failed erasure can be repeated
+func (s *service) DeleteAccount(ctx context.Context, usr user.User) error {
+	bots, err := s.childBotRepo.GetAllByUserID(ctx, usr.ID)
+	if err != nil {
+		return fmt.Errorf("s.childBotRepo.GetAllByUserID: %w", err)
+	}
+
+	for _, bot := range bots {
+		err = retry(ctx, func() error {
+			return s.cascade(ctx, bot)
+		})
+		if err != nil {
+			return fmt.Errorf("s.cascade: %w", err)
+		}
+	}
+
+	err = s.operatorRepo.DeleteByTgUserID(ctx, usr.TgUserID)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.DeleteByTgUserID: %w", err)
+	}
+
+	err = s.peerRepo.UnclaimAllByOperator(ctx, usr.TgUserID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.UnclaimAllByOperator: %w", err)
+	}
+
+	err = s.childStateRepo.DeleteByUserID(ctx, usr.ID)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.DeleteByUserID: %w", err)
+	}
+
+	err = s.transferRepo.DeleteByUserID(ctx, usr.ID)
+	if err != nil {
+		return fmt.Errorf("s.transferRepo.DeleteByUserID: %w", err)
+	}
+
+	err = s.parentStateRepo.DeleteByUserID(ctx, usr.ID)
+	if err != nil {
+		return fmt.Errorf("s.parentStateRepo.DeleteByUserID: %w", err)
+	}
+
+	err = s.userRepo.Delete(ctx, usr.ID)
+	if err != nil {
+		return fmt.Errorf("s.userRepo.Delete: %w", err)
+	}
+
+	return nil
+}
+
+// cascade deletes the data of the bot one collection after another, then the bot itself. The data is not
+// deleted in a transaction, as a large bot would exceed the transaction time and size limits. The bot document
+// remains as a marker until all its data is gone, so a failed purge is retried on the next tick
+func (s *service) cascade(ctx context.Context, bot child_bot.Bot) error {
+	err := s.deleteData(ctx, bot)
+	if err != nil {
+		return fmt.Errorf("s.deleteData: %w", err)
+	}
+
+	err = m.WithTransaction(ctx, s.client, func(tc context.Context) error {
+		e := s.childBotRepo.Delete(tc, bot.OwnerUserID, bot.ID)
+		if e != nil {
+			return fmt.Errorf("s.childBotRepo.Delete: %w", e)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("m.WithTransaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) deleteData(ctx context.Context, bot child_bot.Bot) error {
+	err := s.peerRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.peerRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.replyRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.replyRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.childStateRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.childStateRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.operatorRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.operatorRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.msglogRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.msglogRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.versionRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.versionRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.inviteRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.inviteRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.transferRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.transferRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.broadcastRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.broadcastRepo.DeleteByChildBotID: %w", err)
+	}
+
+	err = s.scheduledRepo.DeleteByChildBotID(ctx, bot.ID)
+	if err != nil {
+		return fmt.Errorf("s.scheduledRepo.DeleteByChildBotID: %w", err)
+	}
+
+	return nil
+}
+
+// reconcile removes peers, pending deep link sources, replies, states, operators, invites, transfers, logged
+// messages, rule versions, broadcasts and scheduled replies referencing bots which do not exist, including soft
+// deleted ones as the purge handles them
+func (s *service) reconcile(ctx context.Context) {
+	repos := []struct {
+		name   string
+		get    func(context.Context) ([]primitive.ObjectID, error)
+		delete func(context.Context, primitive.ObjectID) error
+	}{{
+		name:   "peers",
+		get:    s.peerRepo.GetChildBotIDs,
+		delete: s.peerRepo.DeleteByChildBotID,
+	}, {
+		name:   "peer_sources",
+		get:    s.peerRepo.GetSourceChildBotIDs,
+		delete: s.peerRepo.DeleteSourcesByChildBotID,
+	}, {
+		name:   "replies",
+		get:    s.replyRepo.GetChildBotIDs,
+		delete: s.replyRepo.DeleteByChildBotID,
+	}, {
+		name:   "child_state",
+		get:    s.childStateRepo.GetChildBotIDs,
+		delete: s.childStateRepo.DeleteByChildBotID,
+	}, {
+		name:   "operators",
+		get:    s.operatorRepo.GetChildBotIDs,
+		delete: s.operatorRepo.DeleteByChildBotID,
+	}, {
+		name:   "invites",
+		get:    s.inviteRepo.GetChildBotIDs,
+		delete: s.inviteRepo.DeleteByChildBotID,
+	}, {
+		name:   "transfers",
+		get:    s.transferRepo.GetChildBotIDs,
+		delete: s.transferRepo.DeleteByChildBotID,
+	}, {
+		name:   "message_log",
+		get:    s.msglogRepo.GetChildBotIDs,
+		delete: s.msglogRepo.DeleteByChildBotID,
+	}, {
+		name:   "rule_versions",
+		get:    s.versionRepo.GetChildBotIDs,
+		delete: s.versionRepo.DeleteByChildBotID,
+	}, {
+		name:   "broadcasts",
+		get:    s.broadcastRepo.GetChildBotIDs,
+		delete: s.broadcastRepo.DeleteByChildBotID,
+	}, {
+		name:   "scheduled",
+		get:    s.scheduledRepo.GetChildBotIDs,
+		delete: s.scheduledRepo.DeleteByChildBotID,
+	}}
+
+	for _, repo := range repos {
+		ids, err := repo.get(ctx)
+		if err != nil {
+			s.logger.Error().Err(err).Str("collection", repo.name).Send()
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		existing, err := s.childBotRepo.GetExistingIDs(ctx, ids)
+		if err != nil {
+			s.logger.Error().Err(err).Str("collection", repo.name).Send()
+			continue
+		}
+
+		for _, id := range ids {
+			if _, ok := existing[id]; ok {
+				continue
+			}
+
+			err = retry(ctx, func() error {
+				return repo.delete(ctx, id)
+			})
+			if err != nil {
+				s.logger.Error().Err(err).Str("collection", repo.name).Str("childBotID", id.Hex()).Send()
+				continue
+			}
+			s.logger.Info().Str("collection", repo.name).Str("childBotID", id.Hex()).Msg("orphans removed")
+		}
+	}
+}
+
+func retry(ctx context.Context, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(i+1) * time.Second):
+		}
+	}
+	return err
+}
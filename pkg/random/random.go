@@ -0,0 +1,37 @@
+package random
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// alphabet has no characters which are easy to confuse, like O and 0
+const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Code returns a cryptographically random code of n characters
+func Code(n int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		ix, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("rand.Int: %w", err)
+		}
+		sb.WriteByte(alphabet[ix.Int64()])
+	}
+
+	return sb.String(), nil
+}
+
+// Intn returns a cryptographically random number in [0, n)
+func Intn(n int) (int, error) {
+	ix, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("rand.Int: %w", err)
+	}
+
+	return int(ix.Int64()), nil
+}
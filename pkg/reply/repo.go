@@ -2,6 +2,7 @@ package reply
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	m "github.com/vahter-robot/backend/pkg/mongo"
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,6 +18,22 @@ type Reply struct {
 	TgUserID    int64              `bson:"tui,omitempty"`
 	TgChatID    int64              `bson:"tci,omitempty"`
 	TgMessageID int64              `bson:"tmi,omitempty"`
+	Copies      []Copy             `bson:"cp,omitempty"`
+	Relays      []Relay            `bson:"rl,omitempty"`
+	ExpireAt    time.Time          `bson:"ea,omitempty"`
+}
+
+// Copy is the forward of the peer message in an owner or operator chat
+type Copy struct {
+	TgChatID    int64 `bson:"c,omitempty"`
+	TgMessageID int64 `bson:"m,omitempty"`
+}
+
+// Relay links an operator message to the message sent to the peer, so edits are propagated
+type Relay struct {
+	TgChatID      int64 `bson:"c,omitempty"`
+	TgMessageID   int64 `bson:"m,omitempty"`
+	PeerMessageID int64 `bson:"pm,omitempty"`
 }
 
 type Repo struct {
@@ -56,6 +73,23 @@ func (r *Repo) createIndex(ctx context.Context) error {
 		Keys: bson.M{
 			"cbi": 1,
 		},
+	}, {
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "rl.c",
+			Value: 1,
+		}, {
+			Key:   "rl.m",
+			Value: 1,
+		}},
+		Options: options.Index().SetSparse(true),
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
 	}})
 	if err != nil {
 		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
@@ -70,6 +104,7 @@ func (r *Repo) Create(
 	tgUserID,
 	tgChatID,
 	tgMessageID int64,
+	expireAt time.Time,
 ) (
 	primitive.ObjectID,
 	error,
@@ -91,6 +126,9 @@ func (r *Repo) Create(
 			"tmi": tgMessageID,
 			"cbi": childBotID,
 		},
+		"$set": bson.M{
+			"ea": expireAt,
+		},
 	}, options.Update().SetUpsert(true))
 	if err != nil {
 		return z, fmt.Errorf("r.coll.UpdateOne: %w", err)
@@ -117,7 +155,8 @@ func (r *Repo) Create(
 	return doc.ID, nil
 }
 
-func (r *Repo) GetByID(c context.Context, id primitive.ObjectID) (Reply, error) {
+// GetByID returns false if the reply does not exist, e.g. it expired by retention
+func (r *Repo) GetByID(c context.Context, id primitive.ObjectID) (Reply, bool, error) {
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 
@@ -126,10 +165,127 @@ func (r *Repo) GetByID(c context.Context, id primitive.ObjectID) (Reply, error)
 		"_id": id,
 	}).Decode(&reply)
 	if err != nil {
-		return Reply{}, fmt.Errorf("r.coll.FindOne: %w", err)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Reply{}, false, nil
+		}
+
+		return Reply{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return reply, true, nil
+}
+
+// GetByMessage returns the reply of the peer message, false if it was not forwarded or expired
+func (r *Repo) GetByMessage(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgUserID,
+	tgChatID,
+	tgMessageID int64,
+) (Reply, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var reply Reply
+	err := r.coll.FindOne(ctx, bson.M{
+		"tui": tgUserID,
+		"tci": tgChatID,
+		"tmi": tgMessageID,
+		"cbi": childBotID,
+	}).Decode(&reply)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Reply{}, false, nil
+		}
+
+		return Reply{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return reply, true, nil
+}
+
+// GetByRelay returns the reply which the operator message was relayed to and the relay
+func (r *Repo) GetByRelay(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	tgChatID,
+	tgMessageID int64,
+) (Reply, Relay, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var reply Reply
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+		"rl": bson.M{
+			"$elemMatch": bson.M{
+				"c": tgChatID,
+				"m": tgMessageID,
+			},
+		},
+	}).Decode(&reply)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Reply{}, Relay{}, false, nil
+		}
+
+		return Reply{}, Relay{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	for _, rl := range reply.Relays {
+		if rl.TgChatID == tgChatID && rl.TgMessageID == tgMessageID {
+			return reply, rl, true, nil
+		}
+	}
+	return Reply{}, Relay{}, false, nil
+}
+
+func (r *Repo) AddCopies(c context.Context, id primitive.ObjectID, copies []Copy) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$push": bson.M{
+			"cp": bson.M{
+				"$each": copies,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
 	}
 
-	return reply, nil
+	return nil
+}
+
+func (r *Repo) AddRelay(c context.Context, id primitive.ObjectID, relay Relay) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$push": bson.M{
+			"rl": relay,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
 }
 
 func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
@@ -142,3 +298,40 @@ func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.Object
 
 	return nil
 }
+
+func (r *Repo) DeleteByPeer(c context.Context, childBotID primitive.ObjectID, tgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteMany(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+// BackfillExpireAt sets expiry on documents of the bot stored without it
+func (r *Repo) BackfillExpireAt(c context.Context, childBotID primitive.ObjectID, expireAt time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, time.Minute)
+	defer cancel()
+
+	ur, err := r.coll.UpdateMany(ctx, bson.M{
+		"cbi": childBotID,
+		"ea": bson.M{
+			"$exists": false,
+		},
+	}, bson.M{
+		"$set": bson.M{
+			"ea": expireAt,
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.UpdateMany: %w", err)
+	}
+
+	return ur.ModifiedCount, nil
+}
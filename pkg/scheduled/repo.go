@@ -0,0 +1,236 @@
+package scheduled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Message is a reply of the owner or an operator to a peer, delivered at SendAt. UserID is the bot owner at the
+// time of scheduling, AuthorID is the Telegram user of the author, AuthorChatID is the chat of the author,
+// failures are reported there. Auto marks a delayed autoreply of the bot, its media and buttons are taken from
+// the rule KeywordID or from the start message
+type Message struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID       primitive.ObjectID `bson:"cbi,omitempty"`
+	UserID           primitive.ObjectID `bson:"ui,omitempty"`
+	AuthorID         int64              `bson:"ai,omitempty"`
+	AuthorChatID     int64              `bson:"ac,omitempty"`
+	AuthorName       string             `bson:"an,omitempty"`
+	TgUserID         int64              `bson:"tui,omitempty"`
+	TgChatID         int64              `bson:"tci,omitempty"`
+	ReplyToMessageID int64              `bson:"rm,omitempty"`
+	Text             string             `bson:"t,omitempty"`
+	SendAt           time.Time          `bson:"sa,omitempty"`
+	ExpireAt         time.Time          `bson:"ea,omitempty"`
+	Auto             bool               `bson:"au,omitempty"`
+	KeywordID        primitive.ObjectID `bson:"kid,omitempty"`
+	Start            bool               `bson:"st,omitempty"`
+}
+
+// keep is how long a message stays after its send time, in case the worker did not run
+const keep = 7 * 24 * time.Hour
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("scheduled"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "sa",
+			Value: 1,
+		}},
+	}, {
+		Keys: bson.M{
+			"sa": 1,
+		},
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) Create(c context.Context, m Message) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	m.ExpireAt = m.SendAt.Add(keep)
+	_, err := r.coll.InsertOne(ctx, m)
+	if err != nil {
+		return fmt.Errorf("r.coll.InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetByChildBotID returns replies of operators, or of one author if authorID is not zero. Autoreplies are not
+// listed
+func (r *Repo) GetByChildBotID(
+	c context.Context,
+	childBotID primitive.ObjectID,
+	authorID int64,
+	limit int64,
+) (
+	[]Message,
+	error,
+) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"cbi": childBotID,
+		"au": bson.M{
+			"$ne": true,
+		},
+	}
+	if authorID != 0 {
+		filter["ai"] = authorID
+	}
+
+	cur, err := r.coll.Find(ctx, filter, options.Find().SetSort(bson.M{"sa": 1}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Message
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// TakeDue removes and returns a message whose time has come. Removing before sending delivers a message at
+// most once, even if the sender fails midway
+func (r *Repo) TakeDue(c context.Context) (Message, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var m Message
+	err := r.coll.FindOneAndDelete(ctx, bson.M{
+		"sa": bson.M{
+			"$lte": time.Now().UTC(),
+		},
+	}, options.FindOneAndDelete().SetSort(bson.M{"sa": 1})).Decode(&m)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Message{}, false, nil
+		}
+
+		return Message{}, false, fmt.Errorf("r.coll.FindOneAndDelete: %w", err)
+	}
+
+	return m, true, nil
+}
+
+// TakeByID removes and returns the message. It returns false if the message was already taken
+func (r *Repo) TakeByID(c context.Context, id primitive.ObjectID) (Message, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var m Message
+	err := r.coll.FindOneAndDelete(ctx, bson.M{
+		"_id": id,
+	}).Decode(&m)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Message{}, false, nil
+		}
+
+		return Message{}, false, fmt.Errorf("r.coll.FindOneAndDelete: %w", err)
+	}
+
+	return m, true, nil
+}
+
+// Delete cancels the message, only one of the author if authorID is not zero. It returns false if it was already
+// sent or cancelled
+func (r *Repo) Delete(c context.Context, childBotID primitive.ObjectID, authorID int64, id primitive.ObjectID) (
+	bool,
+	error,
+) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": id,
+		"cbi": childBotID,
+	}
+	if authorID != 0 {
+		filter["ai"] = authorID
+	}
+
+	dr, err := r.coll.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("r.coll.DeleteOne: %w", err)
+	}
+
+	return dr.DeletedCount != 0, nil
+}
+
+func (r *Repo) DeleteByPeer(c context.Context, childBotID primitive.ObjectID, tgUserID int64) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteMany(ctx, bson.M{
+		"cbi": childBotID,
+		"tui": tgUserID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
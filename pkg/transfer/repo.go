@@ -0,0 +1,157 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Transfer struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Code       string             `bson:"c,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	UserID     primitive.ObjectID `bson:"ui,omitempty"`
+	ExpireAt   time.Time          `bson:"ea,omitempty"`
+}
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("transfers"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.M{
+			"c": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.M{
+			"cbi": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	}, {
+		Keys: bson.M{
+			"ea": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+// Create replaces a previous code of the bot, so only the latest one can be redeemed
+func (r *Repo) Create(
+	c context.Context,
+	userID,
+	childBotID primitive.ObjectID,
+	code string,
+	expireAt time.Time,
+) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.UpdateOne(ctx, bson.M{
+		"cbi": childBotID,
+	}, bson.M{
+		"$set": bson.M{
+			"c":  code,
+			"ui": userID,
+			"ea": expireAt,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("r.coll.UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetByCode(c context.Context, code string) (Transfer, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var t Transfer
+	err := r.coll.FindOne(ctx, bson.M{
+		"c": code,
+		"ea": bson.M{
+			"$gt": time.Now().UTC(),
+		},
+	}).Decode(&t)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Transfer{}, false, nil
+		}
+
+		return Transfer{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return t, true, nil
+}
+
+// DeleteByCode consumes the code. It returns false if the code was already used
+func (r *Repo) DeleteByCode(c context.Context, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	dr, err := r.coll.DeleteOne(ctx, bson.M{
+		"c": code,
+	})
+	if err != nil {
+		return false, fmt.Errorf("r.coll.DeleteOne: %w", err)
+	}
+
+	return dr.DeletedCount != 0, nil
+}
+
+func (r *Repo) DeleteByUserID(c context.Context, userID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"ui": userID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}
@@ -89,3 +89,17 @@ func (r *Repo) GetByID(c context.Context, id primitive.ObjectID) (User, error) {
 
 	return usr, nil
 }
+
+func (r *Repo) Delete(c context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	_, err := r.coll.DeleteOne(ctx, bson.M{
+		"_id": id,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteOne: %w", err)
+	}
+
+	return nil
+}
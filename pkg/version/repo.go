@@ -0,0 +1,195 @@
+package version
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/vahter-robot/backend/pkg/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Version is a snapshot of the bot settings after a change
+type Version struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ChildBotID primitive.ObjectID `bson:"cbi,omitempty"`
+	Number     int64              `bson:"v,omitempty"`
+	TgUserID   int64              `bson:"tui,omitempty"`
+	Name       string             `bson:"n,omitempty"`
+	Source     string             `bson:"s,omitempty"`
+	CreatedAt  time.Time          `bson:"ca,omitempty"`
+	// Settings are fields of the bot document, stored inline as they are named in it
+	Settings bson.M `bson:",inline"`
+}
+
+type Repo struct {
+	coll *mongo.Collection
+}
+
+const createAttempts = 3
+
+func NewRepo(ctx context.Context, db *mongo.Database) (*Repo, error) {
+	r := &Repo{
+		coll: db.Collection("rule_versions"),
+	}
+
+	err := r.createIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.createIndex: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Repo) createIndex(ctx context.Context) error {
+	_, err := r.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{
+			Key:   "cbi",
+			Value: 1,
+		}, {
+			Key:   "v",
+			Value: -1,
+		}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.Indexes().CreateOne: %w", err)
+	}
+
+	return nil
+}
+
+// Create stores the version with the next number of the bot and returns the number. A number taken meanwhile
+// is retried, except in a transaction: it is aborted by the conflict and has to be retried as a whole
+func (r *Repo) Create(c context.Context, v Version) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	attempts := createAttempts
+	if m.InTransaction(ctx) {
+		attempts = 1
+	}
+
+	for i := 0; i < attempts; i++ {
+		last, found, err := r.getLast(ctx, v.ChildBotID)
+		if err != nil {
+			return 0, fmt.Errorf("r.getLast: %w", err)
+		}
+
+		v.ID = primitive.NilObjectID
+		v.Number = 1
+		if found {
+			v.Number = last.Number + 1
+		}
+		v.CreatedAt = time.Now().UTC()
+
+		_, err = r.coll.InsertOne(ctx, v)
+		if err == nil {
+			return v.Number, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return 0, fmt.Errorf("r.coll.InsertOne: %w", err)
+		}
+	}
+
+	return 0, fmt.Errorf("version number is taken %d times in a row", attempts)
+}
+
+func (r *Repo) getLast(ctx context.Context, childBotID primitive.ObjectID) (Version, bool, error) {
+	var v Version
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+	}, options.FindOne().SetSort(bson.M{
+		"v": -1,
+	})).Decode(&v)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Version{}, false, nil
+		}
+
+		return Version{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return v, true, nil
+}
+
+func (r *Repo) Count(c context.Context, childBotID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	count, err := r.coll.CountDocuments(ctx, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("r.coll.CountDocuments: %w", err)
+	}
+
+	return count, nil
+}
+
+func (r *Repo) Get(c context.Context, childBotID primitive.ObjectID, number int64) (Version, bool, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	var v Version
+	err := r.coll.FindOne(ctx, bson.M{
+		"cbi": childBotID,
+		"v":   number,
+	}).Decode(&v)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return Version{}, false, nil
+		}
+
+		return Version{}, false, fmt.Errorf("r.coll.FindOne: %w", err)
+	}
+
+	return v, true, nil
+}
+
+// GetLatest returns the newest versions first
+func (r *Repo) GetLatest(c context.Context, childBotID primitive.ObjectID, limit int64) ([]Version, error) {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+
+	cur, err := r.coll.Find(ctx, bson.M{
+		"cbi": childBotID,
+	}, options.Find().SetSort(bson.M{
+		"v": -1,
+	}).SetLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("r.coll.Find: %w", err)
+	}
+
+	var res []Version
+	err = cur.All(ctx, &res)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return res, nil
+}
+
+// GetChildBotIDs returns IDs of all bots referenced by the collection
+func (r *Repo) GetChildBotIDs(c context.Context) ([]primitive.ObjectID, error) {
+	ids, err := m.GetChildBotIDs(c, r.coll)
+	if err != nil {
+		return nil, fmt.Errorf("m.GetChildBotIDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (r *Repo) DeleteByChildBotID(c context.Context, childBotID primitive.ObjectID) error {
+	_, err := r.coll.DeleteMany(c, bson.M{
+		"cbi": childBotID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.coll.DeleteMany: %w", err)
+	}
+
+	return nil
+}